@@ -0,0 +1,108 @@
+// Command mfsdecode prints the MooseFS packets in hex dumps, raw streams
+// (like TCP payloads saved from a capture) or files of moosefs.Recorder.
+package main
+
+import (
+    "bytes"
+    "flag"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "log"
+    "mfsdecode"
+    "moosefs"
+    "os"
+)
+
+var format = flag.String("format", "", "format of the input: hex, raw or record (guessed by default)")
+
+func main() {
+    flag.Usage = func() {
+        fmt.Fprintln(os.Stderr, "usage: mfsdecode [-format hex|raw|record] [file ...]")
+        flag.PrintDefaults()
+    }
+    flag.Parse()
+    log.SetFlags(0)
+
+    if flag.NArg() == 0 {
+        decode(os.Stdin, "stdin")
+        return
+    }
+    for _, name := range flag.Args() {
+        f, err := os.Open(name)
+        if err != nil {
+            log.Fatal(err)
+        }
+        decode(f, name)
+        f.Close()
+    }
+}
+
+func decode(r io.Reader, name string) {
+    data, err := ioutil.ReadAll(r)
+    if err != nil {
+        log.Fatal(name, ": ", err)
+    }
+    switch guess(data) {
+    case "record":
+        decodeRecords(data, name)
+    case "hex":
+        b, err := mfsdecode.ParseHex(string(data))
+        if err != nil {
+            log.Fatal(name, ": ", err)
+        }
+        decodeStream(b, name)
+    case "raw":
+        decodeStream(data, name)
+    default:
+        log.Fatal("unknown format ", *format)
+    }
+}
+
+// guess returns the format of data, unless it's given with -format
+func guess(data []byte) string {
+    if *format != "" {
+        return *format
+    }
+    if bytes.HasPrefix(data, []byte(moosefs.RECORD_MAGIC)) {
+        return "record"
+    }
+    if _, err := mfsdecode.ParseHex(string(data)); err == nil {
+        return "hex"
+    }
+    return "raw"
+}
+
+func decodeStream(b []byte, name string) {
+    msgs, rest, err := mfsdecode.DecodeStream(b)
+    for _, m := range msgs {
+        fmt.Println(m)
+    }
+    if err != nil {
+        log.Fatalf("%s: %s, %d bytes left", name, err, len(rest))
+    }
+}
+
+func decodeRecords(data []byte, name string) {
+    rr := moosefs.NewRecordReader(bytes.NewReader(data))
+    for {
+        rec, err := rr.Next()
+        if err == io.EOF {
+            return
+        }
+        if err != nil {
+            log.Fatal(name, ": ", err)
+        }
+        t := rec.Time.Format("15:04:05.000000")
+        switch rec.Type {
+        case moosefs.RECORD_MASTER:
+            fmt.Printf("%s #%d connect master %s\n", t, rec.Conn, rec.Addr)
+        case moosefs.RECORD_CHUNKSERVER:
+            fmt.Printf("%s #%d connect chunkserver %s\n", t, rec.Conn, rec.Addr)
+        case moosefs.RECORD_SEND:
+            fmt.Printf("%s #%d > %s\n", t, rec.Conn, mfsdecode.Decode(rec.Cmd, rec.Data))
+        case moosefs.RECORD_RECV:
+            fmt.Printf("%s #%d < %s\n", t, rec.Conn, mfsdecode.Decode(rec.Cmd, rec.Data))
+        }
+    }
+}
@@ -0,0 +1,156 @@
+package mfsdecode
+
+import (
+    "moosefs"
+)
+
+// a command of the protocol and the layouts of its packets, as documented
+// in moosefs/consts.go. The first layout which fits a packet exactly is
+// used to decode it.
+type command struct {
+    name    string
+    layouts [][]item
+}
+
+var commands = map[uint32]*command{}
+
+// cmd adds a command with its layouts
+func cmd(id uint32, name string, layouts ...string) {
+    c := &command{name: name}
+    for _, l := range layouts {
+        c.layouts = append(c.layouts, parseLayout(l))
+    }
+    commands[id] = c
+}
+
+// reply adds an answer of the master, which may always be a status
+func reply(id uint32, name string, layouts ...string) {
+    cmd(id, name, append([]string{"msgid:32 status:8"}, layouts...)...)
+}
+
+func init() {
+    cmd(moosefs.ANTOAN_NOP, "ANTOAN_NOP", "-", "msgid:32")
+
+    // CHUNKSERVER <-> CLIENT/CHUNKSERVER
+    cmd(moosefs.CUTOCS_READ, "CUTOCS_READ", "chunkid:64 version:32 offset:32 size:32")
+    cmd(moosefs.CSTOCU_READ_STATUS, "CSTOCU_READ_STATUS", "chunkid:64 status:8")
+    cmd(moosefs.CSTOCU_READ_DATA, "CSTOCU_READ_DATA", "chunkid:64 blocknum:16 offset:16 size:32 crc:32 size*[ databyte:8 ]")
+    cmd(moosefs.CUTOCS_WRITE, "CUTOCS_WRITE", "chunkid:64 version:32 N*[ ip:32 port:16 ]")
+    cmd(moosefs.CSTOCU_WRITE_STATUS, "CSTOCU_WRITE_STATUS", "chunkid:64 writeid:32 status:8")
+    cmd(moosefs.CUTOCS_WRITE_DATA, "CUTOCS_WRITE_DATA", "chunkid:64 writeid:32 blocknum:16 offset:16 size:32 crc:32 size*[ databyte:8 ]")
+    cmd(moosefs.CUTOCS_WRITE_FINISH, "CUTOCS_WRITE_FINISH", "chunkid:64 version:32")
+
+    // ANY <-> CHUNKSERVER
+    cmd(moosefs.ANTOCS_CHUNK_CHECKSUM, "ANTOCS_CHUNK_CHECKSUM", "chunkid:64 version:32")
+    cmd(moosefs.CSTOAN_CHUNK_CHECKSUM, "CSTOAN_CHUNK_CHECKSUM", "chunkid:64 version:32 status:8", "chunkid:64 version:32 checksum:32")
+    cmd(moosefs.ANTOCS_CHUNK_CHECKSUM_TAB, "ANTOCS_CHUNK_CHECKSUM_TAB", "chunkid:64 version:32")
+    cmd(moosefs.CSTOAN_CHUNK_CHECKSUM_TAB, "CSTOAN_CHUNK_CHECKSUM_TAB", "chunkid:64 version:32 status:8", "chunkid:64 version:32 1024*[ checksum:32 ]")
+
+    // CLIENT <-> MASTER
+    cmd(moosefs.CUTOMA_FUSE_REGISTER, "CUTOMA_FUSE_REGISTER",
+        "blob:64B rcode:8 version:32 ileng:32 info:ilengB pleng:32 path:plengB [ passcode:16B ]",
+        "blob:64B rcode:8 sessionid:32 version:32",
+        "blob:64B rcode:8 version:32 ileng:32 info:ilengB [ passcode:16B ]",
+        "blob:64B rcode:8",
+        "blob:64B clientid:32 [ version:32 ]",
+        "blob:64B")
+    cmd(moosefs.MATOCU_FUSE_REGISTER, "MATOCU_FUSE_REGISTER",
+        "status:8",
+        "sessionid:32 sesflags:8 rootuid:32 rootgid:32",
+        "sessionid:32 sesflags:8 rootuid:32 rootgid:32 mapalluid:32 mapallgid:32",
+        "version:32 sessionid:32 sesflags:8 rootuid:32 rootgid:32 mapalluid:32 mapallgid:32",
+        "version:32 sessionid:32 sesflags:8 rootuid:32 rootgid:32 mapalluid:32 mapallgid:32 mingoal:8 maxgoal:8 mintrashtime:32 maxtrashtime:32",
+        "randomblob:32B")
+    cmd(moosefs.CUTOMA_FUSE_STATFS, "CUTOMA_FUSE_STATFS", "msgid:32")
+    reply(moosefs.MATOCU_FUSE_STATFS, "MATOCU_FUSE_STATFS",
+        "msgid:32 totalspace:64 availspace:64 trashspace:64 inodes:32",
+        "msgid:32 totalspace:64 availspace:64 trashspace:64 reservedspace:64 inodes:32")
+    cmd(moosefs.CUTOMA_FUSE_ACCESS, "CUTOMA_FUSE_ACCESS", "msgid:32 inode:32 uid:32 gid:32 modemask:8")
+    reply(moosefs.MATOCU_FUSE_ACCESS, "MATOCU_FUSE_ACCESS")
+    cmd(moosefs.CUTOMA_FUSE_LOOKUP, "CUTOMA_FUSE_LOOKUP", "msgid:32 inode:32 name:NAME uid:32 gid:32")
+    reply(moosefs.MATOCU_FUSE_LOOKUP, "MATOCU_FUSE_LOOKUP", "msgid:32 inode:32 attr:35B")
+    cmd(moosefs.CUTOMA_FUSE_GETATTR, "CUTOMA_FUSE_GETATTR", "msgid:32 inode:32", "msgid:32 inode:32 uid:32 gid:32")
+    reply(moosefs.MATOCU_FUSE_GETATTR, "MATOCU_FUSE_GETATTR", "msgid:32 attr:35B")
+    cmd(moosefs.CUTOMA_FUSE_SETATTR, "CUTOMA_FUSE_SETATTR",
+        "msgid:32 inode:32 uid:32 gid:32 setmask:8 attrmode:16 attruid:32 attrgid:32 attratime:32 attrmtime:32",
+        "msgid:32 inode:32 uid:32 gid:32 setmask:8 attr:32B",
+        "msgid:32 inode:32 uid:32 gid:32 setmask:16 attr:32B")
+    reply(moosefs.MATOCU_FUSE_SETATTR, "MATOCU_FUSE_SETATTR", "msgid:32 attr:35B")
+    cmd(moosefs.CUTOMA_FUSE_READLINK, "CUTOMA_FUSE_READLINK", "msgid:32 inode:32")
+    reply(moosefs.MATOCU_FUSE_READLINK, "MATOCU_FUSE_READLINK", "msgid:32 length:32 path:lengthB")
+    cmd(moosefs.CUTOMA_FUSE_SYMLINK, "CUTOMA_FUSE_SYMLINK", "msgid:32 inode:32 name:NAME length:32 path:lengthB uid:32 gid:32")
+    reply(moosefs.MATOCU_FUSE_SYMLINK, "MATOCU_FUSE_SYMLINK", "msgid:32 inode:32 attr:35B")
+    cmd(moosefs.CUTOMA_FUSE_MKNOD, "CUTOMA_FUSE_MKNOD", "msgid:32 inode:32 name:NAME type:8 mode:16 uid:32 gid:32 rdev:32")
+    reply(moosefs.MATOCU_FUSE_MKNOD, "MATOCU_FUSE_MKNOD", "msgid:32 inode:32 attr:35B")
+    cmd(moosefs.CUTOMA_FUSE_MKDIR, "CUTOMA_FUSE_MKDIR", "msgid:32 inode:32 name:NAME mode:16 uid:32 gid:32")
+    reply(moosefs.MATOCU_FUSE_MKDIR, "MATOCU_FUSE_MKDIR", "msgid:32 inode:32 attr:35B")
+    cmd(moosefs.CUTOMA_FUSE_UNLINK, "CUTOMA_FUSE_UNLINK", "msgid:32 inode:32 name:NAME uid:32 gid:32")
+    reply(moosefs.MATOCU_FUSE_UNLINK, "MATOCU_FUSE_UNLINK")
+    cmd(moosefs.CUTOMA_FUSE_RMDIR, "CUTOMA_FUSE_RMDIR", "msgid:32 inode:32 name:NAME uid:32 gid:32")
+    reply(moosefs.MATOCU_FUSE_RMDIR, "MATOCU_FUSE_RMDIR")
+    cmd(moosefs.CUTOMA_FUSE_RENAME, "CUTOMA_FUSE_RENAME", "msgid:32 inode_src:32 name_src:NAME inode_dst:32 name_dst:NAME uid:32 gid:32")
+    reply(moosefs.MATOCU_FUSE_RENAME, "MATOCU_FUSE_RENAME")
+    cmd(moosefs.CUTOMA_FUSE_LINK, "CUTOMA_FUSE_LINK", "msgid:32 inode:32 inode_dst:32 name_dst:NAME uid:32 gid:32")
+    reply(moosefs.MATOCU_FUSE_LINK, "MATOCU_FUSE_LINK", "msgid:32 inode:32 attr:35B")
+    cmd(moosefs.CUTOMA_FUSE_GETDIR, "CUTOMA_FUSE_GETDIR", "msgid:32 inode:32 uid:32 gid:32 flags:8", "msgid:32 inode:32 uid:32 gid:32")
+    reply(moosefs.MATOCU_FUSE_GETDIR, "MATOCU_FUSE_GETDIR",
+        "msgid:32 N*[ name:NAME inode:32 type:8 ]",
+        "msgid:32 N*[ name:NAME inode:32 attr:35B ]")
+    cmd(moosefs.CUTOMA_FUSE_OPEN, "CUTOMA_FUSE_OPEN", "msgid:32 inode:32 uid:32 gid:32 flags:8")
+    reply(moosefs.MATOCU_FUSE_OPEN, "MATOCU_FUSE_OPEN", "msgid:32 attr:35B")
+
+    cmd(moosefs.CUTOMA_FUSE_READ_CHUNK, "CUTOMA_FUSE_READ_CHUNK", "msgid:32 inode:32 chunkindx:32")
+    reply(moosefs.MATOCU_FUSE_READ_CHUNK, "MATOCU_FUSE_READ_CHUNK", "msgid:32 length:64 chunkid:64 version:32 N*[ ip:32 port:16 ]")
+    cmd(moosefs.CUTOMA_FUSE_WRITE_CHUNK, "CUTOMA_FUSE_WRITE_CHUNK", "msgid:32 inode:32 chunkindx:32")
+    reply(moosefs.MATOCU_FUSE_WRITE_CHUNK, "MATOCU_FUSE_WRITE_CHUNK", "msgid:32 length:64 chunkid:64 version:32 N*[ ip:32 port:16 ]")
+    cmd(moosefs.CUTOMA_FUSE_WRITE_CHUNK_END, "CUTOMA_FUSE_WRITE_CHUNK_END", "msgid:32 chunkid:64 inode:32 length:64")
+    reply(moosefs.MATOCU_FUSE_WRITE_CHUNK_END, "MATOCU_FUSE_WRITE_CHUNK_END")
+
+    cmd(moosefs.CUTOMA_FUSE_APPEND, "CUTOMA_FUSE_APPEND", "msgid:32 inode:32 srcinode:32 uid:32 gid:32")
+    reply(moosefs.MATOCU_FUSE_APPEND, "MATOCU_FUSE_APPEND")
+    cmd(moosefs.CUTOMA_FUSE_CHECK, "CUTOMA_FUSE_CHECK", "msgid:32 inode:32")
+    reply(moosefs.MATOCU_FUSE_CHECK, "MATOCU_FUSE_CHECK", "msgid:32 N*[ copies:8 chunks:16 ]")
+    cmd(moosefs.CUTOMA_FUSE_GETTRASHTIME, "CUTOMA_FUSE_GETTRASHTIME", "msgid:32 inode:32 gmode:8")
+    reply(moosefs.MATOCU_FUSE_GETTRASHTIME, "MATOCU_FUSE_GETTRASHTIME", "msgid:32 tdirs:32 tfiles:32 tdirs*[ trashtime:32 dirs:32 ] tfiles*[ trashtime:32 files:32 ]")
+    cmd(moosefs.CUTOMA_FUSE_SETTRASHTIME, "CUTOMA_FUSE_SETTRASHTIME", "msgid:32 inode:32 uid:32 trashtimeout:32 smode:8")
+    reply(moosefs.MATOCU_FUSE_SETTRASHTIME, "MATOCU_FUSE_SETTRASHTIME", "msgid:32 changed:32 notchanged:32 notpermitted:32")
+    cmd(moosefs.CUTOMA_FUSE_GETGOAL, "CUTOMA_FUSE_GETGOAL", "msgid:32 inode:32 gmode:8")
+    reply(moosefs.MATOCU_FUSE_GETGOAL, "MATOCU_FUSE_GETGOAL", "msgid:32 gdirs:8 gfiles:8 gdirs*[ goal:8 dirs:32 ] gfiles*[ goal:8 files:32 ]")
+    cmd(moosefs.CUTOMA_FUSE_SETGOAL, "CUTOMA_FUSE_SETGOAL", "msgid:32 inode:32 uid:32 goal:8 smode:8")
+    reply(moosefs.MATOCU_FUSE_SETGOAL, "MATOCU_FUSE_SETGOAL", "msgid:32 changed:32 notchanged:32 notpermitted:32")
+    cmd(moosefs.CUTOMA_FUSE_GETTRASH, "CUTOMA_FUSE_GETTRASH", "msgid:32")
+    reply(moosefs.MATOCU_FUSE_GETTRASH, "MATOCU_FUSE_GETTRASH", "msgid:32 N*[ name:NAME inode:32 ]")
+    cmd(moosefs.CUTOMA_FUSE_GETDETACHEDATTR, "CUTOMA_FUSE_GETDETACHEDATTR", "msgid:32 inode:32 dtype:8", "msgid:32 inode:32")
+    reply(moosefs.MATOCU_FUSE_GETDETACHEDATTR, "MATOCU_FUSE_GETDETACHEDATTR", "msgid:32 attr:35B")
+    cmd(moosefs.CUTOMA_FUSE_GETTRASHPATH, "CUTOMA_FUSE_GETTRASHPATH", "msgid:32 inode:32")
+    reply(moosefs.MATOCU_FUSE_GETTRASHPATH, "MATOCU_FUSE_GETTRASHPATH", "msgid:32 length:32 path:lengthB")
+    cmd(moosefs.CUTOMA_FUSE_SETTRASHPATH, "CUTOMA_FUSE_SETTRASHPATH", "msgid:32 inode:32 length:32 path:lengthB")
+    reply(moosefs.MATOCU_FUSE_SETTRASHPATH, "MATOCU_FUSE_SETTRASHPATH")
+    cmd(moosefs.CUTOMA_FUSE_UNDEL, "CUTOMA_FUSE_UNDEL", "msgid:32 inode:32")
+    reply(moosefs.MATOCU_FUSE_UNDEL, "MATOCU_FUSE_UNDEL")
+    cmd(moosefs.CUTOMA_FUSE_PURGE, "CUTOMA_FUSE_PURGE", "msgid:32 inode:32")
+    reply(moosefs.MATOCU_FUSE_PURGE, "MATOCU_FUSE_PURGE")
+    cmd(moosefs.CUTOMA_FUSE_GETDIRSTATS, "CUTOMA_FUSE_GETDIRSTATS", "msgid:32 inode:32")
+    reply(moosefs.MATOCU_FUSE_GETDIRSTATS, "MATOCU_FUSE_GETDIRSTATS",
+        "msgid:32 inodes:32 dirs:32 files:32 ugfiles:32 mfiles:32 chunks:32 ugchunks:32 mchunks:32 length:64 size:64 gsize:64")
+    cmd(moosefs.CUTOMA_FUSE_TRUNCATE, "CUTOMA_FUSE_TRUNCATE",
+        "msgid:32 inode:32 opened:8 uid:32 gid:32 length:64",
+        "msgid:32 inode:32 uid:32 gid:32 length:64")
+    reply(moosefs.MATOCU_FUSE_TRUNCATE, "MATOCU_FUSE_TRUNCATE", "msgid:32 attr:35B")
+    cmd(moosefs.CUTOMA_FUSE_REPAIR, "CUTOMA_FUSE_REPAIR", "msgid:32 inode:32 uid:32 gid:32")
+    reply(moosefs.MATOCU_FUSE_REPAIR, "MATOCU_FUSE_REPAIR", "msgid:32 notchanged:32 erased:32 repaired:32")
+    cmd(moosefs.CUTOMA_FUSE_SNAPSHOT, "CUTOMA_FUSE_SNAPSHOT", "msgid:32 inode:32 inode_dst:32 name_dst:NAME uid:32 gid:32 canoverwrite:8")
+    reply(moosefs.MATOCU_FUSE_SNAPSHOT, "MATOCU_FUSE_SNAPSHOT")
+    cmd(moosefs.CUTOMA_FUSE_GETRESERVED, "CUTOMA_FUSE_GETRESERVED", "msgid:32")
+    reply(moosefs.MATOCU_FUSE_GETRESERVED, "MATOCU_FUSE_GETRESERVED", "msgid:32 N*[ name:NAME inode:32 ]")
+    cmd(moosefs.CUTOMA_FUSE_GETEATTR, "CUTOMA_FUSE_GETEATTR", "msgid:32 inode:32 gmode:8")
+    reply(moosefs.MATOCU_FUSE_GETEATTR, "MATOCU_FUSE_GETEATTR", "msgid:32 eattrdirs:8 eattrfiles:8 eattrdirs*[ eattr:8 dirs:32 ] eattrfiles*[ eattr:8 files:32 ]")
+    cmd(moosefs.CUTOMA_FUSE_SETEATTR, "CUTOMA_FUSE_SETEATTR", "msgid:32 inode:32 uid:32 eattr:8 smode:8")
+    reply(moosefs.MATOCU_FUSE_SETEATTR, "MATOCU_FUSE_SETEATTR", "msgid:32 changed:32 notchanged:32 notpermitted:32")
+    cmd(moosefs.CUTOMA_FUSE_QUOTACONTROL, "CUTOMA_FUSE_QUOTACONTROL",
+        "msgid:32 inode:32 qflags:8",
+        "msgid:32 inode:32 qflags:8 sinodes:32 slength:64 ssize:64 srealsize:64 hinodes:32 hlength:64 hsize:64 hrealsize:64")
+    reply(moosefs.MATOCU_FUSE_QUOTACONTROL, "MATOCU_FUSE_QUOTACONTROL",
+        "msgid:32 qflags:8 sinodes:32 slength:64 ssize:64 srealsize:64 hinodes:32 hlength:64 hsize:64 hrealsize:64 curinodes:32 curlength:64 cursize:64 currealsize:64")
+    cmd(moosefs.CUTOMA_FUSE_RESERVED_INODES, "CUTOMA_FUSE_RESERVED_INODES", "N*[ inode:32 ]")
+}
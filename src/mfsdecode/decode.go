@@ -0,0 +1,198 @@
+// Package mfsdecode turns the packets of the MooseFS protocol into
+// readable messages, using the layouts documented in moosefs/consts.go.
+package mfsdecode
+
+import (
+    "encoding/binary"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "moosefs"
+    "strconv"
+    "strings"
+)
+
+// A Field is a decoded field of a packet. Value is an uint64, a string
+// (NAME and paths), a []byte, an *Attr, or a []Group for the repeated
+// parts of a packet.
+type Field struct {
+    Name  string
+    Value interface{}
+}
+
+// A Group is one of the repeated parts of a packet.
+type Group []Field
+
+// A Message is a decoded packet.
+type Message struct {
+    Cmd    uint32
+    Name   string // empty for unknown commands
+    Fields []Field
+    Data   []byte // the payload
+    Err    error  // set when no layout fits the payload
+}
+
+// Name returns the name of a command, like "CUTOMA_FUSE_LOOKUP".
+func Name(cmd uint32) string {
+    if c, ok := commands[cmd]; ok {
+        return c.name
+    }
+    return "CMD_" + strconv.FormatUint(uint64(cmd), 10)
+}
+
+// Decode decodes the payload of a packet of command cmd.
+func Decode(cmd uint32, payload []byte) *Message {
+    m := &Message{Cmd: cmd, Data: payload}
+    c, ok := commands[cmd]
+    if !ok {
+        m.Err = errors.New("unknown command")
+        return m
+    }
+    m.Name = c.name
+    var first error
+    for _, layout := range c.layouts {
+        fields, rest, err := decodeItems(layout, payload, nil)
+        if err == nil && len(rest) > 0 {
+            err = errLong
+        }
+        if err == nil {
+            m.Fields = fields
+            return m
+        }
+        if first == nil {
+            first = err
+        }
+    }
+    m.Err = first
+    return m
+}
+
+// DecodeFrame decodes the packet cmd:32 length:32 payload at the start of
+// b and returns its size. It returns an error if b doesn't hold the whole
+// packet.
+func DecodeFrame(b []byte) (*Message, int, error) {
+    if len(b) < 8 {
+        return nil, 0, errShort
+    }
+    cmd, size := binary.BigEndian.Uint32(b), binary.BigEndian.Uint32(b[4:])
+    if size > moosefs.MAX_DIR_PACKET_SIZE {
+        return nil, 0, errLong
+    }
+    if uint64(len(b)) < 8+uint64(size) {
+        return nil, 0, errShort
+    }
+    return Decode(cmd, b[8:8+size]), 8 + int(size), nil
+}
+
+// DecodeStream decodes the packets of a stream, like the payloads of the
+// TCP segments of a connection put together. It returns the packets
+// decoded before an error and the bytes left over.
+func DecodeStream(b []byte) ([]*Message, []byte, error) {
+    var msgs []*Message
+    for len(b) > 0 {
+        m, n, err := DecodeFrame(b)
+        if err != nil {
+            return msgs, b, err
+        }
+        msgs = append(msgs, m)
+        b = b[n:]
+    }
+    return msgs, nil, nil
+}
+
+// ParseHex parses hex dumps like "0000019e 0000000c", "00:00:01:9e" or
+// "0x0000019e", spaces, colons and 0x prefixes are ignored.
+func ParseHex(s string) ([]byte, error) {
+    s = strings.Replace(s, "0x", "", -1)
+    s = strings.Map(func(r rune) rune {
+        switch r {
+        case ' ', '\t', '\r', '\n', ':':
+            return -1
+        }
+        return r
+    }, s)
+    return hex.DecodeString(s)
+}
+
+func (m *Message) String() string {
+    var b strings.Builder
+    if m.Name == "" {
+        b.WriteString(Name(m.Cmd))
+    } else {
+        b.WriteString(m.Name)
+    }
+    if m.Err != nil {
+        fmt.Fprintf(&b, " (%s) %s", m.Err, formatBytes(m.Data))
+        return b.String()
+    }
+    writeFields(&b, m.Fields)
+    return b.String()
+}
+
+func writeFields(b *strings.Builder, fields []Field) {
+    for _, f := range fields {
+        b.WriteByte(' ')
+        if groups, ok := f.Value.([]Group); ok {
+            b.WriteByte('[')
+            for i, g := range groups {
+                if i > 0 {
+                    b.WriteByte(',')
+                }
+                b.WriteByte('{')
+                var gb strings.Builder
+                writeFields(&gb, g)
+                b.WriteString(strings.TrimPrefix(gb.String(), " "))
+                b.WriteByte('}')
+            }
+            b.WriteByte(']')
+            continue
+        }
+        b.WriteString(f.String())
+    }
+}
+
+func (f Field) String() string {
+    return f.Name + "=" + formatValue(f.Name, f.Value)
+}
+
+func formatValue(name string, v interface{}) string {
+    switch v := v.(type) {
+    case uint64:
+        switch {
+        case name == "ip":
+            return fmt.Sprintf("%d.%d.%d.%d", v>>24, 0xff&(v>>16), 0xff&(v>>8), 0xff&v)
+        case name == "status":
+            return fmt.Sprintf("%d(%s)", v, moosefs.Error(v))
+        case name == "type" && v >= ' ' && v < 0x7f:
+            return strconv.QuoteRune(rune(v))
+        case strings.HasSuffix(name, "mode") && name != "gmode" && name != "smode":
+            return fmt.Sprintf("%#o", v)
+        case name == "crc" || name == "checksum" || name == "setmask":
+            return fmt.Sprintf("%#x", v)
+        }
+        return strconv.FormatUint(v, 10)
+    case string:
+        return strconv.Quote(v)
+    case []byte:
+        return formatBytes(v)
+    case *Attr:
+        return v.String()
+    }
+    return fmt.Sprint(v)
+}
+
+func formatBytes(b []byte) string {
+    if len(b) <= 16 {
+        return hex.EncodeToString(b)
+    }
+    return fmt.Sprintf("%s...(%d bytes)", hex.EncodeToString(b[:16]), len(b))
+}
+
+func (a *Attr) String() string {
+    s := fmt.Sprintf("{type=%q mode=%#o uid=%d gid=%d atime=%d mtime=%d ctime=%d nlink=%d",
+        rune(a.Type), a.Mode, a.Uid, a.Gid, a.Atime, a.Mtime, a.Ctime, a.Nlink)
+    if a.Type == moosefs.TYPE_BLOCKDEV || a.Type == moosefs.TYPE_CHARDEV {
+        return s + fmt.Sprintf(" rdev=%d:%d}", a.Length>>48, 0xffff&(a.Length>>32))
+    }
+    return s + fmt.Sprintf(" length=%d}", a.Length)
+}
@@ -0,0 +1,91 @@
+package mfsdecode
+
+import (
+    "bytes"
+    "io/ioutil"
+    "moosefs"
+    "moosefstest"
+    "strings"
+    "testing"
+)
+
+func TestDecode(t *testing.T) {
+    b, err := ParseHex("0x00000196 00000014 00000001 00000001 03:66:6f:6f 00000000 00000000")
+    if err != nil {
+        t.Fatal(err)
+    }
+    msgs, rest, err := DecodeStream(b)
+    if err != nil || len(rest) != 0 || len(msgs) != 1 {
+        t.Fatal("decode stream", err, len(rest), len(msgs))
+    }
+    want := `CUTOMA_FUSE_LOOKUP msgid=1 inode=1 name="foo" uid=0 gid=0`
+    if s := msgs[0].String(); s != want {
+        t.Errorf("got %s, want %s", s, want)
+    }
+
+    m := Decode(moosefs.MATOCU_FUSE_LOOKUP, []byte{0, 0, 0, 1, 3})
+    if s := m.String(); s != "MATOCU_FUSE_LOOKUP msgid=1 status=3(No such file or directory)" {
+        t.Error("status", s)
+    }
+    m = Decode(moosefs.MATOCU_FUSE_LOOKUP, []byte{0, 0, 0, 1, 3, 4})
+    if m.Err == nil {
+        t.Error("no error for a bad packet")
+    }
+    m = Decode(1000, []byte{1, 2})
+    if s := m.String(); s != "CMD_1000 (unknown command) 0102" {
+        t.Error("unknown", s)
+    }
+    if _, _, err := DecodeFrame([]byte{0, 0, 0, 0, 0, 0, 0, 4, 0}); err == nil {
+        t.Error("no error for a short frame")
+    }
+}
+
+// every packet of a session with the fake master must be understood
+func TestDecodeRecording(t *testing.T) {
+    m, err := moosefstest.Start(1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer m.Close()
+
+    var file bytes.Buffer
+    rec := moosefs.NewRecorder(&file)
+    c := moosefs.NewClient(m.Addr(), "/", false)
+    c.SetRecorder(rec)
+    f, err := c.Create("decoded")
+    if err != nil {
+        t.Fatal(err)
+    }
+    f.Write(bytes.Repeat([]byte("x"), 100000))
+    f.Close()
+    c.Mkdir("decoded.d", 0755)
+    c.Symlink("decoded", "decoded.d/link")
+    c.ReadDir("/")
+    if f, err = c.Open("decoded"); err == nil {
+        ioutil.ReadAll(f)
+        f.Close()
+    }
+    c.Close()
+    rec.Close()
+
+    recs, err := moosefs.ReadRecords(&file)
+    if err != nil {
+        t.Fatal(err)
+    }
+    seen := make(map[string]bool)
+    for _, r := range recs {
+        if r.Type != moosefs.RECORD_SEND && r.Type != moosefs.RECORD_RECV {
+            continue
+        }
+        msg := Decode(r.Cmd, r.Data)
+        if msg.Err != nil {
+            t.Error(msg)
+        }
+        seen[strings.Fields(msg.String())[0]] = true
+    }
+    for _, name := range []string{"CUTOMA_FUSE_REGISTER", "MATOCU_FUSE_GETDIR", "CUTOCS_WRITE_DATA", "CSTOCU_READ_DATA"} {
+        if !seen[name] {
+            t.Error("not seen", name)
+        }
+    }
+}
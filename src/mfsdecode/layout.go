@@ -0,0 +1,240 @@
+package mfsdecode
+
+import (
+    "encoding/binary"
+    "errors"
+    "moosefs"
+    "regexp"
+    "strconv"
+    "strings"
+)
+
+// the kinds of the items of a layout
+const (
+    ITEM_INT      = iota // name:8, name:16, name:32 or name:64
+    ITEM_NAME            // name:NAME, length:8 and the bytes
+    ITEM_BYTES           // name:16B
+    ITEM_ATTR            // name:35B
+    ITEM_STRING          // name:lengthB, as many bytes as the field length
+    ITEM_DATA            // size*[ databyte:8 ]
+    ITEM_REPEAT          // N*[ ... ] till the end, or count*[ ... ]
+    ITEM_OPTIONAL        // [ ... ] if anything is left
+)
+
+// an item of a layout, like the ones in the comments of moosefs/consts.go:
+// "msgid:32 inode:32 name:NAME uid:32 gid:32"
+type item struct {
+    kind  int
+    name  string
+    size  int    // bits of an int, bytes of ITEM_BYTES, count of ITEM_REPEAT
+    ref   string // the field holding the length or the count
+    items []item // of ITEM_REPEAT and ITEM_OPTIONAL
+}
+
+var (
+    errShort  = errors.New("packet too short")
+    errLong   = errors.New("packet too long")
+    errLayout = errors.New("bad layout")
+
+    bytesRe  = regexp.MustCompile(`^([0-9]+)B$`)
+    stringRe = regexp.MustCompile(`^([a-z_]+)B$`)
+)
+
+// parseLayout parses a layout, it panics on errors as the layouts are
+// part of the command table.
+func parseLayout(layout string) []item {
+    layout = strings.Replace(layout, "[", " [ ", -1)
+    layout = strings.Replace(layout, "]", " ] ", -1)
+    items, rest := parseItems(strings.Fields(layout))
+    if len(rest) > 0 {
+        panic("mfsdecode: unbalanced layout: " + layout)
+    }
+    return items
+}
+
+func parseItems(toks []string) (items []item, rest []string) {
+    for len(toks) > 0 {
+        tok := toks[0]
+        toks = toks[1:]
+        switch {
+        case tok == "]":
+            return items, toks
+        case tok == "-":
+        case tok == "[":
+            var it item
+            it.kind = ITEM_OPTIONAL
+            if it.items, toks = parseItems(toks); len(it.items) == 0 {
+                panic("mfsdecode: empty optional part")
+            }
+            items = append(items, it)
+        case strings.HasSuffix(tok, "*"):
+            if len(toks) == 0 || toks[0] != "[" {
+                panic("mfsdecode: bad repeat " + tok)
+            }
+            it := item{kind: ITEM_REPEAT}
+            count := tok[:len(tok)-1]
+            if n, err := strconv.Atoi(count); err == nil {
+                it.size = n
+            } else if count != "N" {
+                it.ref = count
+            }
+            if it.items, toks = parseItems(toks[1:]); len(it.items) == 0 {
+                panic("mfsdecode: empty repeat " + tok)
+            }
+            if len(it.items) == 1 && it.items[0].name == "databyte" && it.ref != "" {
+                it = item{kind: ITEM_DATA, name: "data", ref: it.ref}
+            }
+            items = append(items, it)
+        default:
+            items = append(items, parseField(tok))
+        }
+    }
+    return items, nil
+}
+
+func parseField(tok string) item {
+    i := strings.Index(tok, ":")
+    if i <= 0 {
+        panic("mfsdecode: bad field " + tok)
+    }
+    it := item{name: tok[:i]}
+    spec := tok[i+1:]
+    switch spec {
+    case "8", "16", "32", "64":
+        it.kind = ITEM_INT
+        it.size, _ = strconv.Atoi(spec)
+    case "NAME":
+        it.kind = ITEM_NAME
+    default:
+        if m := bytesRe.FindStringSubmatch(spec); m != nil {
+            it.kind = ITEM_BYTES
+            it.size, _ = strconv.Atoi(m[1])
+            if it.size == moosefs.ATTR_SIZE {
+                it.kind = ITEM_ATTR
+            }
+        } else if m := stringRe.FindStringSubmatch(spec); m != nil {
+            it.kind = ITEM_STRING
+            it.ref = m[1]
+        } else {
+            panic("mfsdecode: bad field " + tok)
+        }
+    }
+    return it
+}
+
+// decodeItems decodes buf with items, fields holds what has been decoded
+// so far for the lengths and counts.
+func decodeItems(items []item, buf []byte, fields []Field) ([]Field, []byte, error) {
+    var err error
+    for _, it := range items {
+        switch it.kind {
+        case ITEM_INT:
+            n := it.size / 8
+            if len(buf) < n {
+                return fields, buf, errShort
+            }
+            var v uint64
+            for _, b := range buf[:n] {
+                v = v<<8 | uint64(b)
+            }
+            buf = buf[n:]
+            fields = append(fields, Field{it.name, v})
+        case ITEM_NAME:
+            if len(buf) < 1 || len(buf) < 1+int(buf[0]) {
+                return fields, buf, errShort
+            }
+            n := int(buf[0])
+            fields = append(fields, Field{it.name, string(buf[1 : 1+n])})
+            buf = buf[1+n:]
+        case ITEM_BYTES, ITEM_ATTR:
+            if len(buf) < it.size {
+                return fields, buf, errShort
+            }
+            if it.kind == ITEM_ATTR {
+                fields = append(fields, Field{it.name, decodeAttr(buf[:it.size])})
+            } else {
+                fields = append(fields, Field{it.name, buf[:it.size]})
+            }
+            buf = buf[it.size:]
+        case ITEM_STRING, ITEM_DATA:
+            n, ok := lookup(fields, it.ref)
+            if !ok {
+                return fields, buf, errLayout
+            }
+            if uint64(len(buf)) < n {
+                return fields, buf, errShort
+            }
+            if it.kind == ITEM_DATA {
+                fields = append(fields, Field{it.name, buf[:n]})
+            } else {
+                fields = append(fields, Field{it.name, strings.TrimSuffix(string(buf[:n]), "\x00")})
+            }
+            buf = buf[n:]
+        case ITEM_OPTIONAL:
+            if len(buf) > 0 {
+                if fields, buf, err = decodeItems(it.items, buf, fields); err != nil {
+                    return fields, buf, err
+                }
+            }
+        case ITEM_REPEAT:
+            count, all := uint64(it.size), it.ref == "" && it.size == 0
+            if it.ref != "" {
+                var ok bool
+                if count, ok = lookup(fields, it.ref); !ok {
+                    return fields, buf, errLayout
+                }
+            }
+            var groups []Group
+            for i := uint64(0); all && len(buf) > 0 || !all && i < count; i++ {
+                var g []Field
+                left := len(buf)
+                if g, buf, err = decodeItems(it.items, buf, nil); err != nil {
+                    return fields, buf, err
+                }
+                if len(buf) == left {
+                    return fields, buf, errLayout
+                }
+                groups = append(groups, Group(g))
+            }
+            fields = append(fields, Field{"", groups})
+        }
+    }
+    return fields, buf, nil
+}
+
+// lookup returns the value of the last integer field called name
+func lookup(fields []Field, name string) (uint64, bool) {
+    for i := len(fields) - 1; i >= 0; i-- {
+        if v, ok := fields[i].Value.(uint64); ok && fields[i].Name == name {
+            return v, true
+        }
+    }
+    return 0, false
+}
+
+// Attr is the attributes of an inode:
+// type:8 mode:16 uid:32 gid:32 atime:32 mtime:32 ctime:32 nlink:32 length:64
+type Attr struct {
+    Type                uint8
+    Mode                uint16 // 4 bits of flags and 12 bits of mode
+    Uid, Gid            uint32
+    Atime, Mtime, Ctime uint32
+    Nlink               uint32
+    Length              uint64 // major:16 minor:16 empty:32 for devices
+}
+
+func decodeAttr(b []byte) *Attr {
+    be := binary.BigEndian
+    return &Attr{
+        Type:  b[0],
+        Mode:  be.Uint16(b[1:]),
+        Uid:   be.Uint32(b[3:]),
+        Gid:   be.Uint32(b[7:]),
+        Atime: be.Uint32(b[11:]),
+        Mtime: be.Uint32(b[15:]),
+        Ctime: be.Uint32(b[19:]),
+        Nlink: be.Uint32(b[23:]),
+
+        Length: be.Uint64(b[27:]),
+    }
+}
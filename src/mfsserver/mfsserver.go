@@ -4,6 +4,7 @@ import (
     "flag"
     "fmt"
     "log"
+    "log/slog"
     "moosefs"
     "net/http"
     _ "net/http/pprof"
@@ -11,6 +12,7 @@ import (
     "runtime/pprof"
     "strings"
     "time"
+    "vfs"
 )
 
 var listen = flag.String("listen", ":9500", "http service address")
@@ -20,14 +22,11 @@ var local = flag.String("local", "", "use local dir instead")
 //var subdir = flag.String("subdir", "/", "subdir in MFS as root")
 var cpuprofile = flag.String("cpuprofile", "", "write cpu profile to file")
 var enable_cache = flag.Bool("cache", false, "enable inode cache")
-
-type mooseFS struct {
-    client *moosefs.Client
-}
-
-func (fs *mooseFS) Open(name string) (http.File, error) {
-    return fs.client.Open(name)
-}
+var blockcache = flag.String("blockcache", "", "keep hot blocks in this local dir")
+var blockcache_size = flag.Int64("blockcache-size", 1024, "size of block cache in MB")
+var record = flag.String("record", "", "record the traffic with mfsmaster and chunkservers to file")
+var replay = flag.String("replay", "", "serve the answers recorded in file instead of mfsmaster")
+var verbose = flag.Bool("verbose", false, "log reconnections, retries and errors of the client")
 
 type mfsServerController struct {
     client *moosefs.Client
@@ -36,8 +35,14 @@ type mfsServerController struct {
 func (ctrl *mfsServerController) ServeHTTP(w http.ResponseWriter, r *http.Request) {
     var pathsegs = strings.SplitN(r.URL.Path, "/", 4)
     var cmd = pathsegs[2]
-    var path = pathsegs[3]
-    if cmd == "purge-inode-cache" {
+    var path = "/"
+    if len(pathsegs) > 3 {
+        path = pathsegs[3]
+    }
+    if cmd == "metrics" {
+        w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+        ctrl.client.Metrics().WritePrometheus(w)
+    } else if cmd == "purge-inode-cache" {
         n, err := ctrl.client.PurgeINodeCache(path)
         if err != nil {
             fmt.Fprintf(w, "Error: %s\n", err)
@@ -63,16 +68,52 @@ func main() {
         }()
     }
 
-    var fs http.FileSystem
+    var fs vfs.FileSystem
     if *local != "" {
-        fs = http.Dir(*local)
+        fs = vfs.Local(*local)
     } else {
         var client = moosefs.NewClient(*mfsmaster, "/", *enable_cache)
-        fs = &mooseFS{client}
+        if *verbose {
+            client.SetLogger(slog.Default())
+        }
+        if *blockcache != "" {
+            bc, err := moosefs.NewBlockCache(*blockcache, *blockcache_size<<20)
+            if err != nil {
+                log.Fatal(err)
+            }
+            client.SetBlockCache(bc)
+        }
+        if *record != "" {
+            f, err := os.Create(*record)
+            if err != nil {
+                log.Fatal(err)
+            }
+            rec := moosefs.NewRecorder(f)
+            client.SetRecorder(rec)
+            go func() {
+                for {
+                    time.Sleep(1e9)
+                    rec.Flush()
+                }
+            }()
+        }
+        if *replay != "" {
+            f, err := os.Open(*replay)
+            if err != nil {
+                log.Fatal(err)
+            }
+            recs, err := moosefs.ReadRecords(f)
+            f.Close()
+            if err != nil {
+                log.Fatal(err)
+            }
+            client.SetReplayer(moosefs.NewReplayer(recs))
+        }
+        fs = vfs.MooseFS(client)
         mfsserver_ctrl := mfsServerController{client}
         http.Handle("/.mfsserver-ctrl/", &mfsserver_ctrl)
     }
-    http.Handle("/", http.FileServer(fs))
+    http.Handle("/", http.FileServer(vfs.HTTP(fs)))
 
     log.Println("Listen on", *listen)
     err := http.ListenAndServe(*listen, nil)
@@ -0,0 +1,131 @@
+package moosefs
+
+import (
+    "bytes"
+    "errors"
+    "io"
+    "math/rand"
+    "os"
+    "path"
+    "strconv"
+    "time"
+)
+
+// An AtomicFile is written to a hidden temporary file next to its target,
+// which replaces the target only when the file is closed. Readers see the
+// old content or the new one, never a part of it.
+//
+//	af, err := c.CreateAtomic(name, 0644)
+//	...
+//	defer af.Abort() // does nothing after Close
+//	... af.Write(data) ...
+//	return af.Close()
+type AtomicFile struct {
+    *File
+    name    string
+    perm    os.FileMode
+    modTime time.Time
+    done    bool
+}
+
+// CreateAtomic starts writing name with mode perm, see AtomicFile.
+func (c *Client) CreateAtomic(name string, perm os.FileMode) (*AtomicFile, error) {
+    dir, base := path.Split(name)
+    if base == "" {
+        return nil, Error(ERROR_EINVAL)
+    }
+    parent, _, err := c.getParent(name)
+    if err != nil {
+        return nil, err
+    }
+    for try := 0; ; try++ {
+        suffix := "." + strconv.FormatUint(uint64(rand.Uint32()), 36) + ".tmp"
+        prefix := base
+        if len(prefix) > MFS_NAME_MAX-1-len(suffix) {
+            prefix = prefix[:MFS_NAME_MAX-1-len(suffix)]
+        }
+        tmp := "." + prefix + suffix
+        fi, err := c.getMasterConn().Mknod(parent, tmp, TYPE_FILE, unixMode(perm), 0)
+        c.forget(parent, tmp)
+        if err == Error(ERROR_EEXIST) && try < 10 {
+            continue
+        }
+        if err != nil {
+            return nil, errors.New("create temporary file: " + err.Error())
+        }
+        fi.name = tmp
+        return &AtomicFile{File: c.newFile(dir+tmp, fi, os.O_RDWR), name: name, perm: perm}, nil
+    }
+}
+
+// SetModTime sets the modification time the file gets when it replaces
+// its target, the time of Close by default.
+func (af *AtomicFile) SetModTime(t time.Time) {
+    af.modTime = t
+}
+
+// Name returns the target of the file.
+func (af *AtomicFile) Name() string {
+    return af.name
+}
+
+// Close syncs the data, sets the mode and the modification time and puts
+// the file in place of its target, the access time is left alone. The
+// temporary file is removed if any of this fails.
+func (af *AtomicFile) Close() error {
+    if af.done {
+        return errors.New("atomic file already closed")
+    }
+    af.done = true
+    c := af.client
+    err := af.File.Close()
+    if err == nil {
+        mtime := af.modTime
+        if mtime.IsZero() {
+            mtime = time.Now()
+        }
+        err = c.setInodeAttr(af.inode, SET_MODE_FLAG|SET_MTIME_FLAG, unixMode(af.perm), 0, 0, 0, uint32(mtime.Unix()))
+    }
+    if err == nil {
+        err = c.Rename(af.path, af.name)
+    }
+    if err != nil {
+        c.Remove(af.path)
+        return err
+    }
+    return nil
+}
+
+// Abort drops the data written so far and leaves the target alone.
+func (af *AtomicFile) Abort() error {
+    if af.done {
+        return nil
+    }
+    af.done = true
+    af.File.mutex.Lock()
+    af.File.dirty = dirtyChunks{}
+    af.File.mutex.Unlock()
+    af.File.Close()
+    return af.client.Remove(af.path)
+}
+
+// WriteFileAtomic replaces name with data as a whole, see AtomicFile.
+func (c *Client) WriteFileAtomic(name string, data []byte, perm os.FileMode) error {
+    _, err := c.WriteFileAtomicFrom(name, bytes.NewReader(data), perm)
+    return err
+}
+
+// WriteFileAtomicFrom replaces name with what is read from r, see
+// AtomicFile.
+func (c *Client) WriteFileAtomicFrom(name string, r io.Reader, perm os.FileMode) (int64, error) {
+    af, err := c.CreateAtomic(name, perm)
+    if err != nil {
+        return 0, err
+    }
+    defer af.Abort()
+    n, err := io.Copy(af, r)
+    if err != nil {
+        return n, err
+    }
+    return n, af.Close()
+}
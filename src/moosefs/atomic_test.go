@@ -0,0 +1,149 @@
+package moosefs
+
+import (
+    "bytes"
+    "moosefstest"
+    "path"
+    "strings"
+    "testing"
+    "time"
+)
+
+// tempFiles returns the temporary files left in dir
+func tempFiles(t *testing.T, c *Client, dir string) []string {
+    f, err := c.Open(dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer f.Close()
+    names, _ := f.Readdirnames(-1)
+    var tmps []string
+    for _, name := range names {
+        if strings.HasSuffix(name, ".tmp") {
+            tmps = append(tmps, name)
+        }
+    }
+    return tmps
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+    c := NewClient(testMaster.Addr(), "/", false)
+    defer c.Close()
+    c.MkdirAll("atomic", 0755)
+    defer c.RemoveAll("atomic")
+
+    writeTestFile(t, c, "atomic/config", []byte("old"))
+    data := testData(MFS_BLOCK_SIZE + 3)
+    if err := c.WriteFileAtomic("atomic/config", data, 0640); err != nil {
+        t.Fatal(err)
+    }
+    if got, err := c.ReadFile("atomic/config"); err != nil || !bytes.Equal(got, data) {
+        t.Error("read back", len(got), err)
+    }
+    fi, err := c.Stat("atomic/config")
+    if err != nil || fi.Mode().Perm() != 0640 || time.Since(fi.ModTime()) > time.Minute {
+        t.Error("stat", fi.Mode(), fi.ModTime(), err)
+    }
+
+    af, err := c.CreateAtomic("atomic/config", 0644)
+    if err != nil {
+        t.Fatal(err)
+    }
+    af.Write([]byte("half written"))
+    if err := af.Abort(); err != nil {
+        t.Error("abort", err)
+    }
+    if got, _ := c.ReadFile("atomic/config"); !bytes.Equal(got, data) {
+        t.Error("aborted write replaced the file")
+    }
+
+    mtime := time.Unix(1234567890, 0)
+    af, _ = c.CreateAtomic("atomic/config", 0644)
+    af.Write([]byte("new"))
+    af.SetModTime(mtime)
+    if err := af.Close(); err != nil {
+        t.Fatal(err)
+    }
+    if fi, _ := c.Stat("atomic/config"); !fi.ModTime().Equal(mtime) || fi.Size() != 3 {
+        t.Error("mtime", fi.ModTime(), fi.Size())
+    } else if st := fi.Sys().(*Stat_t); st.Atime.Equal(mtime) {
+        t.Error("atime set to mtime", st.Atime)
+    }
+
+    long := "atomic/" + strings.Repeat("x", MFS_NAME_MAX)
+    af, err = c.CreateAtomic(long, 0644)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if base := path.Base(af.File.path); len(base) > MFS_NAME_MAX || !strings.HasPrefix(base, ".x") || !strings.HasSuffix(base, ".tmp") {
+        t.Error("temporary name", base)
+    }
+    if err := af.Close(); err != nil {
+        t.Error(err)
+    }
+    if _, err := c.Stat(long); err != nil {
+        t.Error("long name", err)
+    }
+
+    testMaster.SetFault(moosefstest.FailCommand(CUTOMA_FUSE_RENAME, ERROR_EACCES, 1))
+    err = c.WriteFileAtomic("atomic/config", []byte("failed"), 0644)
+    testMaster.SetFault(nil)
+    if err == nil {
+        t.Error("failed rename not reported")
+    }
+    if got, _ := c.ReadFile("atomic/config"); string(got) != "new" {
+        t.Error("failed write replaced the file", string(got))
+    }
+    if tmps := tempFiles(t, c, "atomic"); len(tmps) > 0 {
+        t.Error("temporary files left", tmps)
+    }
+}
+
+func TestChmodChownChtimes(t *testing.T) {
+    writeTestFile(t, client, "chmod", []byte("x"))
+    defer Remove("chmod")
+    if err := Chmod("chmod", 0600); err != nil {
+        t.Error(err)
+    }
+    mtime := time.Unix(1000000000, 0)
+    if err := Chtimes("chmod", mtime, mtime); err != nil {
+        t.Error(err)
+    }
+    atime := time.Unix(1100000000, 0)
+    if err := Chtimes("chmod", atime, mtime); err != nil {
+        t.Error(err)
+    }
+    fi, err := Stat("chmod")
+    if err != nil || fi.Mode().Perm() != 0600 || !fi.ModTime().Equal(mtime) || !fi.Sys().(*Stat_t).Atime.Equal(atime) {
+        t.Error("stat", fi.Mode(), fi.ModTime(), err)
+    }
+
+    gid := fi.Sys().(*Stat_t).Gid
+    if err := Chown("chmod", 1000, -1); err != nil {
+        t.Error(err)
+    }
+    if st := statT(t, "chmod"); st.Uid != 1000 || st.Gid != gid {
+        t.Error("chown uid", st.Uid, st.Gid)
+    }
+    if err := Chown("chmod", -1, 2000); err != nil {
+        t.Error(err)
+    }
+    if st := statT(t, "chmod"); st.Uid != 1000 || st.Gid != 2000 {
+        t.Error("chown gid", st.Uid, st.Gid)
+    }
+    if err := Chown("chmod", -1, -1); err != nil {
+        t.Error(err)
+    }
+    if err := Chown("missing", 1000, 1000); err == nil {
+        t.Error("chown of a missing file")
+    }
+}
+
+// statT returns the Stat_t of name
+func statT(t *testing.T, name string) *Stat_t {
+    fi, err := Stat(name)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return fi.Sys().(*Stat_t)
+}
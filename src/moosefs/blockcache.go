@@ -0,0 +1,224 @@
+package moosefs
+
+import (
+    "container/list"
+    "encoding/binary"
+    "fmt"
+    "hash/crc32"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "sort"
+    "sync"
+)
+
+type blockKey struct {
+    chunkid uint64
+    version uint32
+    block   uint16
+}
+
+func (k blockKey) name() string {
+    return fmt.Sprintf("%016x_%08x_%04x", k.chunkid, k.version, k.block)
+}
+
+type cachedBlock struct {
+    key  blockKey
+    size int64
+}
+
+// BlockCache keeps blocks of chunks in a local directory, so that hot files
+// are read from local disk instead of the chunkservers. Every block is
+// stored in its own file together with its CRC, and the least recently used
+// blocks are removed once the cache grows beyond its capacity. A new
+// version of a chunk makes its old blocks go away.
+type BlockCache struct {
+    dir      string
+    capacity int64
+
+    mutex    sync.Mutex
+    size     int64
+    lru      *list.List // of *cachedBlock, most recent first
+    blocks   map[blockKey]*list.Element
+    chunks   map[uint64]map[*list.Element]bool // cached blocks of a chunk
+    versions map[uint64]uint32                 // cached version of a chunk
+}
+
+// NewBlockCache opens a cache of at most capacity bytes in dir. Blocks left
+// in dir by an earlier process are used again.
+func NewBlockCache(dir string, capacity int64) (*BlockCache, error) {
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return nil, err
+    }
+    bc := new(BlockCache)
+    bc.dir = dir
+    bc.capacity = capacity
+    bc.lru = list.New()
+    bc.blocks = make(map[blockKey]*list.Element)
+    bc.chunks = make(map[uint64]map[*list.Element]bool)
+    bc.versions = make(map[uint64]uint32)
+
+    fis, err := ioutil.ReadDir(dir)
+    if err != nil {
+        return nil, err
+    }
+    sort.Slice(fis, func(i, j int) bool { return fis[i].ModTime().After(fis[j].ModTime()) })
+    for _, fi := range fis {
+        var k blockKey
+        if _, err := fmt.Sscanf(fi.Name(), "%016x_%08x_%04x", &k.chunkid, &k.version, &k.block); err != nil ||
+            k.name() != fi.Name() || fi.Size() < 4 {
+            continue
+        }
+        if v, ok := bc.versions[k.chunkid]; ok && v != k.version {
+            os.Remove(filepath.Join(dir, fi.Name()))
+            continue
+        }
+        bc.insert(bc.lru.PushBack(&cachedBlock{k, fi.Size()}))
+    }
+    bc.mutex.Lock()
+    bc.evict()
+    bc.mutex.Unlock()
+    return bc, nil
+}
+
+// Size returns the bytes used by the cache.
+func (bc *BlockCache) Size() int64 {
+    bc.mutex.Lock()
+    defer bc.mutex.Unlock()
+    return bc.size
+}
+
+func (bc *BlockCache) path(k blockKey) string {
+    return filepath.Join(bc.dir, k.name())
+}
+
+// get returns a cached block, or nil if it is not cached or damaged.
+func (bc *BlockCache) get(k blockKey) []byte {
+    bc.mutex.Lock()
+    e, ok := bc.blocks[k]
+    if !ok {
+        if v, ok := bc.versions[k.chunkid]; ok && v != k.version {
+            bc.removeChunk(k.chunkid)
+        }
+        bc.mutex.Unlock()
+        return nil
+    }
+    bc.lru.MoveToFront(e)
+    bc.mutex.Unlock()
+
+    data, err := ioutil.ReadFile(bc.path(k))
+    if err != nil || len(data) < 4 || binary.BigEndian.Uint32(data) != crc32.ChecksumIEEE(data[4:]) {
+        bc.mutex.Lock()
+        if e, ok := bc.blocks[k]; ok {
+            bc.remove(e)
+        }
+        bc.mutex.Unlock()
+        return nil
+    }
+    return data[4:]
+}
+
+func (bc *BlockCache) put(k blockKey, data []byte) {
+    buf := make([]byte, 4+len(data))
+    binary.BigEndian.PutUint32(buf, crc32.ChecksumIEEE(data))
+    copy(buf[4:], data)
+
+    // write to a temporary file first, so no one sees half a block
+    tmp := bc.path(k) + ".tmp"
+    if err := ioutil.WriteFile(tmp, buf, 0644); err != nil {
+        os.Remove(tmp)
+        return
+    }
+
+    bc.mutex.Lock()
+    defer bc.mutex.Unlock()
+    if v, ok := bc.versions[k.chunkid]; ok && v != k.version {
+        if v > k.version {
+            // someone already cached a newer version
+            os.Remove(tmp)
+            return
+        }
+        bc.removeChunk(k.chunkid)
+    }
+    if e, ok := bc.blocks[k]; ok {
+        bc.remove(e)
+    }
+    if err := os.Rename(tmp, bc.path(k)); err != nil {
+        os.Remove(tmp)
+        return
+    }
+    bc.insert(bc.lru.PushFront(&cachedBlock{k, int64(len(buf))}))
+    bc.evict()
+}
+
+func (bc *BlockCache) evict() {
+    for bc.size > bc.capacity && bc.lru.Len() > 0 {
+        bc.remove(bc.lru.Back())
+    }
+}
+
+// insert indexes the block of e, which was just added to the lru list.
+func (bc *BlockCache) insert(e *list.Element) {
+    b := e.Value.(*cachedBlock)
+    bc.blocks[b.key] = e
+    if bc.chunks[b.key.chunkid] == nil {
+        bc.chunks[b.key.chunkid] = make(map[*list.Element]bool)
+    }
+    bc.chunks[b.key.chunkid][e] = true
+    bc.versions[b.key.chunkid] = b.key.version
+    bc.size += b.size
+}
+
+func (bc *BlockCache) remove(e *list.Element) {
+    b := bc.lru.Remove(e).(*cachedBlock)
+    delete(bc.blocks, b.key)
+    bc.size -= b.size
+    os.Remove(bc.path(b.key))
+
+    delete(bc.chunks[b.key.chunkid], e)
+    if len(bc.chunks[b.key.chunkid]) == 0 {
+        delete(bc.chunks, b.key.chunkid)
+        delete(bc.versions, b.key.chunkid)
+    }
+}
+
+// removeChunk drops all the cached blocks of a chunk.
+func (bc *BlockCache) removeChunk(chunkid uint64) {
+    for e := range bc.chunks[chunkid] {
+        bc.remove(e)
+    }
+    delete(bc.versions, chunkid)
+}
+
+// read reads from chunk ck, one block at a time, from the cache if possible.
+func (bc *BlockCache) read(ck *Chunk, buf []byte, offset uint32) (int, error) {
+    // the part of the chunk inside the file
+    var valid int64 = int64(ck.length) - int64(ck.indx)*CHUNK_SIZE
+    got := 0
+    for got < len(buf) {
+        block := offset / MFS_BLOCK_SIZE
+        from := int(offset % MFS_BLOCK_SIZE)
+        to := min(MFS_BLOCK_SIZE, from+len(buf)-got)
+
+        k := blockKey{ck.id, ck.version, uint16(block)}
+        data := bc.get(k)
+        if len(data) < to {
+            size := valid - int64(block)*MFS_BLOCK_SIZE
+            if size > MFS_BLOCK_SIZE {
+                size = MFS_BLOCK_SIZE
+            }
+            if size < int64(to) {
+                size = int64(to)
+            }
+            data = make([]byte, size)
+            if _, err := ck.read(data, block*MFS_BLOCK_SIZE); err != nil {
+                return got, err
+            }
+            bc.put(k, data)
+        }
+        copy(buf[got:], data[from:to])
+        got += to - from
+        offset += uint32(to - from)
+    }
+    return got, nil
+}
@@ -0,0 +1,65 @@
+package moosefs
+
+import (
+    "bytes"
+    "io/ioutil"
+    "os"
+    "testing"
+)
+
+func TestBlockCache(t *testing.T) {
+    dir, err := ioutil.TempDir("", "mfsblockcache")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    bc, err := NewBlockCache(dir, 3*(4+100))
+    if err != nil {
+        t.Fatal("open cache", err)
+    }
+
+    data := bytes.Repeat([]byte("x"), 100)
+    k1 := blockKey{1, 1, 0}
+    k2 := blockKey{1, 1, 1}
+    k3 := blockKey{2, 5, 0}
+    bc.put(k1, data)
+    bc.put(k2, data)
+    bc.put(k3, data)
+    if b := bc.get(k1); !bytes.Equal(b, data) {
+        t.Error("get failed", b)
+    }
+
+    // k2 is the least recently used one
+    bc.put(blockKey{3, 1, 0}, data)
+    if bc.get(k2) != nil {
+        t.Error("block not evicted")
+    }
+    if bc.Size() != 3*(4+100) {
+        t.Error("wrong size", bc.Size())
+    }
+
+    // a new version drops the old blocks of the chunk
+    if bc.get(blockKey{1, 2, 0}) != nil || bc.get(k1) != nil {
+        t.Error("old version still cached")
+    }
+    if len(bc.chunks[1]) != 0 || len(bc.chunks[3]) != 1 || len(bc.chunks) != len(bc.versions) {
+        t.Error("chunk index", bc.chunks, bc.versions)
+    }
+
+    // damaged blocks are not returned
+    if err := ioutil.WriteFile(bc.path(k3), []byte("garbage"), 0644); err != nil {
+        t.Fatal(err)
+    }
+    if bc.get(k3) != nil {
+        t.Error("got a damaged block")
+    }
+
+    // blocks are found again after a restart
+    bc, err = NewBlockCache(dir, 1024)
+    if err != nil {
+        t.Fatal("reopen cache", err)
+    }
+    if b := bc.get(blockKey{3, 1, 0}); !bytes.Equal(b, data) {
+        t.Error("block lost after reopen", b)
+    }
+}
@@ -3,24 +3,72 @@ package moosefs
 import "errors"
 
 type Chunk struct {
+    inode   uint32
     id      uint64
+    indx    uint32
     length  uint64
     version uint32
     csdata  []byte
+
+    cache   *BlockCache
+    dial    dialFunc
+    metrics *metrics
+    hooks   *hooks
 }
 
+// Read reads from the block cache or any of the chunkservers holding the
+// chunk. A chunk with id 0 has never been written and reads as zeros.
 func (ck *Chunk) Read(buf []byte, offset uint32) (int, error) {
+    if ck.id == 0 {
+        // a hole in a sparse file
+        for i := range buf {
+            buf[i] = 0
+        }
+        return len(buf), nil
+    }
+    if ck.cache != nil {
+        return ck.cache.read(ck, buf, offset)
+    }
+    return ck.read(buf, offset)
+}
+
+// read tries the chunkservers in turn. When all of them fail, the error of
+// the last one is returned.
+func (ck *Chunk) read(buf []byte, offset uint32) (int, error) {
+    var lasterr error = errors.New("no chunk server avail")
     csdata := ck.csdata
+    failed := ""
     for len(csdata) > 0 {
+        addr := parseAddr(csdata)
         for try := 0; try < 2; try++ {
-            cs, err := newCSConn(csdata, false)
+            if failed != "" {
+                // once for every failure followed by another attempt
+                ck.metrics.retry(failed)
+                failed = ""
+            }
+            cs, err := newCSConn(csdata, false, ck.dial)
             if err != nil {
+                lasterr, failed = err, addr
                 break
             }
 
-            n, err := cs.ReadBlock(ck.id, ck.version, buf, offset)
+            var n int
+            op := &Op{Command: "READ", Addr: addr, Inode: ck.inode, ChunkID: ck.id, Offset: offset, Size: len(buf)}
+            err = ck.hooks.run(op, func() (err error) {
+                n, err = cs.ReadBlock(ck.id, ck.version, buf, offset)
+                return err
+            })
+            ck.metrics.blockOp(addr, false, offset, n, err)
             if err != nil {
+                ck.hooks.logger().Warn("read from chunkserver failed", "chunkserver", addr,
+                    "inode", ck.inode, "chunk", ck.id, "crc", err == errCRC, "err", err)
+                failed = addr
                 cs.Close()
+                lasterr = err
+                if _, ok := err.(Error); ok {
+                    // the chunkserver answered, asking it again won't help
+                    break
+                }
             } else {
                 freeCSConn(cs)
                 return n, err
@@ -28,22 +76,29 @@ func (ck *Chunk) Read(buf []byte, offset uint32) (int, error) {
         }
         csdata = csdata[6:]
     }
-    return 0, errors.New("no chunk server avail")
+    return 0, lasterr
 }
 
 func (ck *Chunk) Write(buf []byte, offset uint32) (int, error) {
-    cs, err := newCSConn(ck.csdata, true)
+    cs, err := newCSConn(ck.csdata, true, ck.dial)
     if err != nil {
         return 0, err
     }
+    defer cs.Close()
+    addr := parseAddr(ck.csdata)
 
-    msg := pack(CUTOCS_WRITE, ck.id, ck.version, ck.csdata)
-    _, err = cs.Write(msg)
+    msg := packet(CUTOCS_WRITE, newEncoder().u64(ck.id).u32(ck.version).bytes(ck.csdata))
+    if _, err = cs.Write(msg); err == nil {
+        err = cs.readWriteStatus(ck.id, 0)
+    }
     if err != nil {
+        ck.metrics.blockOp(addr, true, 0, 0, err)
+        ck.hooks.logger().Warn("write to chunkserver failed", "chunkserver", addr,
+            "inode", ck.inode, "chunk", ck.id, "err", err)
         return 0, err
     }
 
-    writeid := uint32(0)
+    writeid := uint32(1)
     pos := uint16(offset>>16) & 0x3FF
     from := int(offset & 0xFFFF)
     size := len(buf)
@@ -55,9 +110,18 @@ func (ck *Chunk) Write(buf []byte, offset uint32) (int, error) {
         } else {
             w = size
         }
-        if err := cs.WriteBlock(ck.id, writeid, pos, uint16(from), buf[start:start+w]); err != nil {
+        block := buf[start : start+w]
+        op := &Op{Command: "WRITE", Addr: addr, Inode: ck.inode, ChunkID: ck.id, Offset: uint32(pos)<<16 | uint32(from), Size: w}
+        err := ck.hooks.run(op, func() error {
+            return cs.WriteBlock(ck.id, writeid, pos, uint16(from), block)
+        })
+        if err != nil {
+            ck.metrics.blockOp(addr, true, 0, 0, err)
+            ck.hooks.logger().Warn("write to chunkserver failed", "chunkserver", addr,
+                "inode", ck.inode, "chunk", ck.id, "crc", err == Error(ERROR_CRC), "err", err)
             return start, err
         }
+        ck.metrics.blockOp(addr, true, uint32(pos)<<16|uint32(from), w, nil)
         size -= w
         start += w
         pos += 1
@@ -0,0 +1,130 @@
+package moosefs
+
+import (
+    "sync"
+    "time"
+)
+
+// defaults for the chunk location cache
+const (
+    CHUNK_CACHE_TTL  = 30 * time.Second
+    CHUNK_CACHE_SIZE = 10000
+)
+
+type cachedChunk struct {
+    chunk  *Chunk
+    expire time.Time
+}
+
+// chunkCache keeps the answers of ReadChunk for a while, so that files opened
+// by the same client share the chunk locations. Entries expire after ttl and
+// are dropped when a chunkserver tells us they are stale. An answer carries
+// the length of the file, so it is only used by opens that saw the same
+// length, other clients may have changed it meanwhile.
+type chunkCache struct {
+    sync.Mutex
+    ttl    time.Duration
+    size   int
+    count  int
+    chunks map[uint32]map[uint32]*cachedChunk
+}
+
+func newChunkCache(ttl time.Duration, size int) *chunkCache {
+    cc := new(chunkCache)
+    cc.ttl = ttl
+    cc.size = size
+    cc.chunks = make(map[uint32]map[uint32]*cachedChunk)
+    return cc
+}
+
+func (cc *chunkCache) get(inode, indx uint32, length uint64) *Chunk {
+    cc.Lock()
+    defer cc.Unlock()
+
+    e, ok := cc.chunks[inode][indx]
+    if !ok || e.chunk.length != length {
+        return nil
+    }
+    if time.Now().After(e.expire) {
+        cc.remove(inode, indx)
+        return nil
+    }
+    return e.chunk
+}
+
+func (cc *chunkCache) put(inode, indx uint32, ck *Chunk) {
+    if cc.ttl <= 0 || cc.size <= 0 {
+        return
+    }
+    cc.Lock()
+    defer cc.Unlock()
+
+    if cc.count >= cc.size {
+        cc.expire()
+    }
+    chunks, ok := cc.chunks[inode]
+    if !ok {
+        chunks = make(map[uint32]*cachedChunk)
+        cc.chunks[inode] = chunks
+    }
+    if _, ok := chunks[indx]; !ok {
+        cc.count++
+    }
+    chunks[indx] = &cachedChunk{ck, time.Now().Add(cc.ttl)}
+}
+
+// invalidate drops the location of one chunk.
+func (cc *chunkCache) invalidate(inode, indx uint32) {
+    cc.Lock()
+    cc.remove(inode, indx)
+    cc.Unlock()
+}
+
+// invalidateInode drops all chunks of a file, used when its length changes.
+func (cc *chunkCache) invalidateInode(inode uint32) {
+    cc.Lock()
+    cc.count -= len(cc.chunks[inode])
+    delete(cc.chunks, inode)
+    cc.Unlock()
+}
+
+func (cc *chunkCache) remove(inode, indx uint32) {
+    chunks, ok := cc.chunks[inode]
+    if !ok {
+        return
+    }
+    if _, ok := chunks[indx]; ok {
+        delete(chunks, indx)
+        cc.count--
+    }
+    if len(chunks) == 0 {
+        delete(cc.chunks, inode)
+    }
+}
+
+// expire removes outdated entries, or half of them if none is outdated.
+func (cc *chunkCache) expire() {
+    now := time.Now()
+    for inode, chunks := range cc.chunks {
+        for indx, e := range chunks {
+            if now.After(e.expire) {
+                cc.remove(inode, indx)
+            }
+        }
+    }
+    for inode, chunks := range cc.chunks {
+        if cc.count < cc.size/2 {
+            break
+        }
+        cc.count -= len(chunks)
+        delete(cc.chunks, inode)
+    }
+}
+
+// clear drops all chunks.
+func (cc *chunkCache) clear() {
+    cc.Lock()
+    cc.chunks = make(map[uint32]map[uint32]*cachedChunk)
+    cc.count = 0
+    cc.Unlock()
+}
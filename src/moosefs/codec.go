@@ -0,0 +1,172 @@
+package moosefs
+
+import (
+    "encoding/binary"
+    "errors"
+)
+
+// size of the attributes of an inode on the wire
+const ATTR_SIZE = 35
+
+// the default of MasterConn.MaxPacketSize, the answers of the master are
+// small but for directory listings
+const MAX_PACKET_SIZE = 4 << 20
+
+// the default of MasterConn.MaxDirPacketSize, and the largest packet taken
+// from a recording. GETDIR is not paged, so the answer for a directory
+// with millions of entries takes hundreds of megabytes.
+const MAX_DIR_PACKET_SIZE = 1 << 30
+
+var (
+    errShortPacket = errors.New("packet too short")
+    errLongPacket  = errors.New("packet too long")
+)
+
+// encoder builds the fields of a packet in big endian order.
+type encoder struct {
+    buf []byte
+    err error
+}
+
+func newEncoder() *encoder {
+    return &encoder{buf: make([]byte, 0, 64)}
+}
+
+func (e *encoder) u8(v uint8) *encoder {
+    e.buf = append(e.buf, v)
+    return e
+}
+
+func (e *encoder) u16(v uint16) *encoder {
+    e.buf = binary.BigEndian.AppendUint16(e.buf, v)
+    return e
+}
+
+func (e *encoder) u32(v uint32) *encoder {
+    e.buf = binary.BigEndian.AppendUint32(e.buf, v)
+    return e
+}
+
+func (e *encoder) u64(v uint64) *encoder {
+    e.buf = binary.BigEndian.AppendUint64(e.buf, v)
+    return e
+}
+
+func (e *encoder) bytes(b []byte) *encoder {
+    e.buf = append(e.buf, b...)
+    return e
+}
+
+func (e *encoder) str(s string) *encoder {
+    e.buf = append(e.buf, s...)
+    return e
+}
+
+// name adds a NAME: length:8 followed by the bytes
+func (e *encoder) name(s string) *encoder {
+    if len(s) > MFS_NAME_MAX {
+        e.err = Error(ERROR_EINVAL)
+    }
+    return e.u8(uint8(len(s))).str(s)
+}
+
+// path adds a string with its trailing \0, prefixed by length:32
+func (e *encoder) path(s string) *encoder {
+    return e.u32(uint32(len(s) + 1)).str(s).u8(0)
+}
+
+// packet returns cmd:32 length:32 followed by the fields of args, which
+// may be nil for a packet without fields
+func packet(cmd uint32, args *encoder) []byte {
+    var body []byte
+    if args != nil {
+        body = args.buf
+    }
+    buf := make([]byte, 8, 8+len(body))
+    binary.BigEndian.PutUint32(buf, cmd)
+    binary.BigEndian.PutUint32(buf[4:], uint32(len(body)))
+    return append(buf, body...)
+}
+
+// decoder reads big endian fields from a packet. After a read past the
+// end every read returns zeros, so that only finish has to be checked.
+type decoder struct {
+    buf []byte
+    err error
+}
+
+func newDecoder(b []byte) *decoder {
+    return &decoder{buf: b}
+}
+
+func (d *decoder) take(n int) []byte {
+    if d.err != nil || n < 0 || n > len(d.buf) {
+        d.err = errShortPacket
+        d.buf = nil
+        return nil
+    }
+    b := d.buf[:n:n]
+    d.buf = d.buf[n:]
+    return b
+}
+
+func (d *decoder) u8() uint8 {
+    if b := d.take(1); b != nil {
+        return b[0]
+    }
+    return 0
+}
+
+func (d *decoder) u16() uint16 {
+    if b := d.take(2); b != nil {
+        return binary.BigEndian.Uint16(b)
+    }
+    return 0
+}
+
+func (d *decoder) u32() uint32 {
+    if b := d.take(4); b != nil {
+        return binary.BigEndian.Uint32(b)
+    }
+    return 0
+}
+
+func (d *decoder) u64() uint64 {
+    if b := d.take(8); b != nil {
+        return binary.BigEndian.Uint64(b)
+    }
+    return 0
+}
+
+func (d *decoder) bytes(n int) []byte {
+    return d.take(n)
+}
+
+// name reads a NAME: length:8 followed by the bytes
+func (d *decoder) name() string {
+    return string(d.take(int(d.u8())))
+}
+
+// path reads length:32 followed by a string, which may end with \0
+func (d *decoder) path() string {
+    b := d.take(int(d.u32()))
+    if len(b) > 0 && b[len(b)-1] == 0 {
+        b = b[:len(b)-1]
+    }
+    return string(b)
+}
+
+func (d *decoder) left() int {
+    return len(d.buf)
+}
+
+// finish returns the first error, or errLongPacket if bytes are left over
+func (d *decoder) finish() error {
+    if d.err != nil {
+        return d.err
+    }
+    if len(d.buf) > 0 {
+        return errLongPacket
+    }
+    return nil
+}
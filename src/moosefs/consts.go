@@ -6,6 +6,7 @@ const (
     MFS_ROOT_ID       = 1
     MFS_NAME_MAX      = 255
     MFS_MAX_FILE_SIZE = 0x20000000000
+    MFS_BLOCK_SIZE    = 0x10000
 )
 
 // 1.6.20
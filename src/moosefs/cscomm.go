@@ -1,7 +1,6 @@
 package moosefs
 
 import (
-    "bytes"
     "errors"
     "fmt"
     "hash/crc32"
@@ -13,6 +12,7 @@ import (
 
 type csConn struct {
     net.Conn
+    private bool // dialed by a recorder or replayer, never pooled
 }
 
 func (cs *csConn) Read(b []byte) (int, error) {
@@ -20,21 +20,26 @@ func (cs *csConn) Read(b []byte) (int, error) {
     return n, err
 }
 
+var errCRC = errors.New("readblock; READ_DATA crc checksum error")
+
 var (
     pool  = map[string][]*csConn{}
     mutex sync.Mutex
 )
 
-func newCSConn(csdata []byte, write bool) (conn *csConn, err error) {
+func newCSConn(csdata []byte, write bool, dial dialFunc) (conn *csConn, err error) {
     if len(csdata) < 6 {
         return nil, errors.New("no chunk server avail")
     }
 
-    // parse chunk server ip and port
-    var ip uint32
-    var port uint16
-    read(bytes.NewBuffer(csdata), &ip, &port)
-    addr := fmt.Sprintf("%d.%d.%d.%d:%d", ip>>24, 0xff&(ip>>16), 0xff&(ip>>8), 0xff&ip, port)
+    addr := parseAddr(csdata)
+    if dial != nil {
+        conn = &csConn{private: true}
+        if conn.Conn, err = dial(addr, false); err != nil {
+            return nil, err
+        }
+        return conn, nil
+    }
 
     mutex.Lock()
     cs, ok := pool[addr]
@@ -54,10 +59,22 @@ func newCSConn(csdata []byte, write bool) (conn *csConn, err error) {
     return conn, nil
 }
 
+// parseAddr returns the address of the first ip:32 port:16 of csdata, which
+// has at least 6 bytes
+func parseAddr(csdata []byte) string {
+    d := newDecoder(csdata)
+    ip, port := d.u32(), d.u16()
+    return fmt.Sprintf("%d.%d.%d.%d:%d", ip>>24, 0xff&(ip>>16), 0xff&(ip>>8), 0xff&ip, port)
+}
+
 func freeCSConn(conn *csConn) {
     if conn == nil {
         return
     }
+    if conn.private {
+        conn.Close()
+        return
+    }
 
     mutex.Lock()
     defer mutex.Unlock()
@@ -72,7 +89,7 @@ func freeCSConn(conn *csConn) {
 
 func (cs *csConn) ReadBlock(chunkid uint64, version uint32, buf []byte, offset uint32) (n int, err error) {
     size := uint32(len(buf))
-    msg := pack(CUTOCS_READ, chunkid, version, offset, size)
+    msg := packet(CUTOCS_READ, newEncoder().u64(chunkid).u32(version).u32(offset).u32(size))
 
     if _, err = cs.Write(msg); err != nil {
         return
@@ -83,8 +100,8 @@ func (cs *csConn) ReadBlock(chunkid uint64, version uint32, buf []byte, offset u
         if _, err = cs.Read(b); err != nil {
             return
         }
-        var cmd, l uint32
-        read(bytes.NewBuffer(b), &cmd, &l)
+        d := newDecoder(b)
+        cmd, l := d.u32(), d.u32()
         switch cmd {
         case CSTOCU_READ_STATUS:
             if l != 9 {
@@ -94,15 +111,21 @@ func (cs *csConn) ReadBlock(chunkid uint64, version uint32, buf []byte, offset u
             if _, err = cs.Read(data); err != nil {
                 return n, err
             }
-            var cid uint64
-            read(bytes.NewBuffer(data), &cid)
+            cid, status, err := decodeReadStatus(data)
+            if err != nil {
+                return n, err
+            }
             if cid != chunkid {
                 return n, errors.New("readblock; READ_STATUS incorrect chunkid")
             }
-            if n != len(buf) {
-                return n, errors.New("readblock; READ_STATUS incorrect data size")
+            if status != STATUS_OK {
+                return n, Error(status)
             }
-            return n, nil
+            // the chunk is shorter than the file, the rest is a hole
+            for i := n; i < len(buf); i++ {
+                buf[i] = 0
+            }
+            return len(buf), nil
         case CSTOCU_READ_DATA:
             if l < 20 {
                 return n, errors.New("readblock; READ_DATA incorrect message size")
@@ -111,11 +134,10 @@ func (cs *csConn) ReadBlock(chunkid uint64, version uint32, buf []byte, offset u
             if _, err = cs.Read(data); err != nil {
                 return
             }
-            r := bytes.NewBuffer(data)
-            var cid uint64
-            var blockno, blockoffset uint16
-            var blocksize, blockcrc uint32
-            read(r, &cid, &blockno, &blockoffset, &blocksize, &blockcrc)
+            cid, blockno, blockoffset, blocksize, blockcrc, err := decodeReadData(data)
+            if err != nil {
+                return n, err
+            }
             if cid != chunkid {
                 return n, errors.New("readblock; READ_DATA incorrect chunkid ")
             }
@@ -135,7 +157,7 @@ func (cs *csConn) ReadBlock(chunkid uint64, version uint32, buf []byte, offset u
             if size < breq {
                 breq = size
             }
-            if blocksize != breq {
+            if blocksize != breq || n+int(blocksize) > len(buf) {
                 return n, errors.New("readblock; READ_DATA incorrect block size")
             }
             data = buf[n : n+int(blocksize)]
@@ -143,7 +165,7 @@ func (cs *csConn) ReadBlock(chunkid uint64, version uint32, buf []byte, offset u
                 return n, err
             }
             if blockcrc != crc32.ChecksumIEEE(data) {
-                return n, errors.New("readblock; READ_DATA crc checksum error")
+                return n, errCRC
             }
             n += int(blocksize)
             offset += blocksize
@@ -152,45 +174,82 @@ func (cs *csConn) ReadBlock(chunkid uint64, version uint32, buf []byte, offset u
             return n, errors.New("readblock; unknown message:" + strconv.Itoa(int(cmd)))
         }
     }
-    return n, nil
+}
+
+// decodeReadStatus decodes chunkid:64 status:8
+func decodeReadStatus(data []byte) (chunkid uint64, status uint8, err error) {
+    d := newDecoder(data)
+    chunkid, status = d.u64(), d.u8()
+    if err = d.finish(); err != nil {
+        return 0, 0, errors.New("readblock; READ_STATUS " + err.Error())
+    }
+    return
+}
+
+// decodeReadData decodes the header of READ_DATA, the data follows it
+func decodeReadData(data []byte) (chunkid uint64, blockno, blockoffset uint16, blocksize, crc uint32, err error) {
+    d := newDecoder(data)
+    chunkid, blockno, blockoffset, blocksize, crc = d.u64(), d.u16(), d.u16(), d.u32(), d.u32()
+    if err = d.finish(); err != nil {
+        return 0, 0, 0, 0, 0, errors.New("readblock; READ_DATA " + err.Error())
+    }
+    return
 }
 
 func (cs *csConn) WriteBlock(chunkid uint64, writeid uint32, blockno, offset uint16, buf []byte) error {
     size := uint32(len(buf))
     crc := crc32.ChecksumIEEE(buf)
-    msg := pack(CUTOCS_WRITE_DATA, chunkid, writeid, blockno, offset, size, crc, buf)
+    msg := packet(CUTOCS_WRITE_DATA, newEncoder().u64(chunkid).u32(writeid).u16(blockno).u16(offset).
+        u32(size).u32(crc).bytes(buf))
     if n, err := cs.Write(msg); err != nil || n < len(msg) {
+        if err == nil {
+            err = io.ErrShortWrite
+        }
         return errors.New("write block " + err.Error())
     }
-    rbuf := make([]byte, 21)
-    n, err := cs.Read(rbuf)
-    if err != nil || n < 21 {
-        return err
-    }
-    var cmd, leng, wid uint32
-    var cid uint64
-    var status uint8
-    r := bytes.NewBuffer(rbuf)
-    read(r, &cmd, &leng)
-    if cmd == 0 && leng == 0 {
-        // skip anon cmd
-        copy(rbuf, rbuf[8:])
-        if _, err := cs.Read(rbuf[n-8:]); err != nil {
+    return cs.readWriteStatus(chunkid, writeid)
+}
+
+// readWriteStatus waits for the WRITE_STATUS of writeid, writeid 0 is the
+// answer to CUTOCS_WRITE once the chain of chunkservers is ready.
+func (cs *csConn) readWriteStatus(chunkid uint64, writeid uint32) error {
+    hdr := make([]byte, 8)
+    for {
+        if _, err := cs.Read(hdr); err != nil {
             return err
         }
-        r = bytes.NewBuffer(rbuf)
-        read(r, &cmd, &leng)
-    }
-    read(r, &cid, &writeid, &status)
-    if cmd != CSTOCU_WRITE_STATUS || leng != 13 {
-        return errors.New("write block: got unrecognized packet from chunkserver ")
-    }
-    if cid != chunkid || wid != writeid {
-        return errors.New("write block: got unexpected packet")
-    }
-    if status != STATUS_OK {
-        return Error(status)
+        d := newDecoder(hdr)
+        cmd, leng := d.u32(), d.u32()
+        if cmd == ANTOAN_NOP && leng == 0 {
+            continue
+        }
+        if cmd != CSTOCU_WRITE_STATUS || leng != 13 {
+            return errors.New("write block: got unrecognized packet from chunkserver ")
+        }
+        data := make([]byte, leng)
+        if _, err := cs.Read(data); err != nil {
+            return err
+        }
+        cid, wid, status, err := decodeWriteStatus(data)
+        if err != nil {
+            return err
+        }
+        if cid != chunkid || wid != writeid {
+            return errors.New("write block: got unexpected packet")
+        }
+        if status != STATUS_OK {
+            return Error(status)
+        }
+        return nil
     }
+}
 
-    return nil
+// decodeWriteStatus decodes chunkid:64 writeid:32 status:8
+func decodeWriteStatus(data []byte) (chunkid uint64, writeid uint32, status uint8, err error) {
+    d := newDecoder(data)
+    chunkid, writeid, status = d.u64(), d.u32(), d.u8()
+    if err = d.finish(); err != nil {
+        return 0, 0, 0, errors.New("write block: WRITE_STATUS " + err.Error())
+    }
+    return
 }
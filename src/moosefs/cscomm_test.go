@@ -0,0 +1,121 @@
+package moosefs
+
+import (
+    "bytes"
+    "hash/crc32"
+    "io"
+    "net"
+    "testing"
+)
+
+// streamConn answers reads from r and swallows writes
+type streamConn struct {
+    net.Conn
+    r io.Reader
+}
+
+func (c *streamConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c *streamConn) Write(b []byte) (int, error) { return len(b), nil }
+
+func FuzzParseAddr(f *testing.F) {
+    f.Add(newEncoder().u32(0x7f000001).u16(9422).buf)
+    f.Add([]byte{1, 2})
+    f.Fuzz(func(t *testing.T, csdata []byte) {
+        parseAddr(csdata)
+    })
+}
+
+func FuzzDecodeReadStatus(f *testing.F) {
+    f.Add(newEncoder().u64(1).u8(0).buf)
+    f.Fuzz(func(t *testing.T, data []byte) {
+        if _, _, err := decodeReadStatus(data); (err == nil) != (len(data) == 9) {
+            t.Error("length check", len(data), err)
+        }
+    })
+}
+
+func FuzzDecodeReadData(f *testing.F) {
+    f.Add(newEncoder().u64(1).u16(0).u16(0).u32(10).u32(0).buf)
+    f.Fuzz(func(t *testing.T, data []byte) {
+        if _, _, _, _, _, err := decodeReadData(data); (err == nil) != (len(data) == 20) {
+            t.Error("length check", len(data), err)
+        }
+    })
+}
+
+func FuzzDecodeWriteStatus(f *testing.F) {
+    f.Add(newEncoder().u64(1).u32(2).u8(0).buf)
+    f.Fuzz(func(t *testing.T, data []byte) {
+        if _, _, _, err := decodeWriteStatus(data); (err == nil) != (len(data) == 13) {
+            t.Error("length check", len(data), err)
+        }
+    })
+}
+
+// FuzzReadBlock feeds arbitrary chunkserver answers to ReadBlock
+func FuzzReadBlock(f *testing.F) {
+    data := []byte("hello")
+    block := newEncoder().u64(1).u16(0).u16(10).u32(uint32(len(data))).u32(crc32.ChecksumIEEE(data)).bytes(data).buf
+    good := append(packet(CSTOCU_READ_DATA, newEncoder().bytes(block)),
+        packet(CSTOCU_READ_STATUS, newEncoder().u64(1).u8(0))...)
+    f.Add(good, uint32(10), uint16(5))
+    f.Add(good[:20], uint32(10), uint16(5))
+    f.Add(packet(CSTOCU_READ_STATUS, newEncoder().u64(1).u8(ERROR_NOCHUNK)), uint32(0), uint16(100))
+    f.Add(packet(CSTOCU_READ_DATA, newEncoder().u64(1).u32(0xffffffff)), uint32(0), uint16(1))
+    f.Fuzz(func(t *testing.T, stream []byte, offset uint32, size uint16) {
+        cs := &csConn{Conn: &streamConn{r: bytes.NewReader(stream)}}
+        buf := make([]byte, int(size)+1)
+        n, err := cs.ReadBlock(1, 1, buf, offset%CHUNK_SIZE)
+        if n < 0 || n > len(buf) {
+            t.Error("read", n, err)
+        }
+    })
+}
+
+func TestReadBlock(t *testing.T) {
+    data := []byte("hello")
+    block := newEncoder().u64(1).u16(0).u16(10).u32(uint32(len(data))).u32(crc32.ChecksumIEEE(data)).bytes(data).buf
+    stream := append(packet(CSTOCU_READ_DATA, newEncoder().bytes(block)),
+        packet(CSTOCU_READ_STATUS, newEncoder().u64(1).u8(0))...)
+    cs := &csConn{Conn: &streamConn{r: bytes.NewReader(stream)}}
+    buf := make([]byte, 5)
+    if n, err := cs.ReadBlock(1, 1, buf, 10); n != 5 || err != nil || string(buf) != "hello" {
+        t.Error("read block", n, err, buf)
+    }
+
+    // a bad crc is an error
+    block[len(block)-1] = 'x'
+    stream = packet(CSTOCU_READ_DATA, newEncoder().bytes(block))
+    cs = &csConn{Conn: &streamConn{r: bytes.NewReader(stream)}}
+    if _, err := cs.ReadBlock(1, 1, buf, 10); err == nil {
+        t.Error("crc error not detected")
+    }
+}
+
+func TestReadWriteStatus(t *testing.T) {
+    status := func(writeid uint32, st uint8) []byte {
+        return packet(CSTOCU_WRITE_STATUS, newEncoder().u64(1).u32(writeid).u8(st))
+    }
+    tests := []struct {
+        stream  []byte
+        writeid uint32
+        ok      bool
+    }{
+        {append(packet(ANTOAN_NOP, nil), status(0, STATUS_OK)...), 0, true},
+        {status(3, STATUS_OK), 3, true},
+        {status(1, STATUS_OK), 0, false},
+        {status(0, ERROR_NOCHUNK), 0, false},
+        {packet(CSTOCU_READ_STATUS, newEncoder().u64(1).u8(0)), 0, false},
+        {status(0, STATUS_OK)[:10], 0, false},
+    }
+    for i, tt := range tests {
+        cs := &csConn{Conn: &streamConn{r: bytes.NewReader(tt.stream)}}
+        if err := cs.readWriteStatus(1, tt.writeid); (err == nil) != tt.ok {
+            t.Error(i, err)
+        }
+    }
+    cs := &csConn{Conn: &streamConn{r: bytes.NewReader(status(0, ERROR_NOCHUNK))}}
+    if err := cs.readWriteStatus(1, 0); err != Error(ERROR_NOCHUNK) {
+        t.Error("status", err)
+    }
+}
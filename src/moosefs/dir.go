@@ -0,0 +1,157 @@
+package moosefs
+
+import (
+    "io"
+    "os"
+)
+
+// DirIter returns the entries of a directory one at a time. They are
+// decoded from the answer of the master as they are asked for, so that a
+// huge directory doesn't have to be held as a slice of FileInfo. The "."
+// and ".." entries are skipped.
+type DirIter struct {
+    mc       *MasterConn
+    dir      uint32
+    withattr bool
+    started  bool
+    ans      []byte
+    err      error
+
+    name  string
+    inode uint32
+    attr  []byte
+    fi    *fileStat
+}
+
+// ReadDirIter starts listing the directory f with the attributes of the
+// entries.
+func (f *File) ReadDirIter() *DirIter {
+    return f.client.newDirIter(f.inode, true)
+}
+
+func (c *Client) newDirIter(inode uint32, withattr bool) *DirIter {
+    return &DirIter{mc: c.getMasterConn(), dir: inode, withattr: withattr}
+}
+
+// Next moves to the next entry, it returns false at the end of the
+// directory or on error.
+func (it *DirIter) Next() bool {
+    if it.err != nil {
+        return false
+    }
+    if !it.started {
+        it.started = true
+        var flags uint8
+        if it.withattr {
+            flags = GETDIR_FLAG_WITHATTR
+        }
+        if it.ans, it.err = it.mc.getDir(it.dir, flags); it.err != nil {
+            return false
+        }
+    }
+    for len(it.ans) > 0 {
+        it.name, it.inode, it.attr, it.ans, it.err = nextDirEntry(it.ans, it.withattr)
+        if it.err != nil {
+            return false
+        }
+        if it.name == "." || it.name == ".." {
+            continue
+        }
+        if it.withattr {
+            if it.fi, it.err = newFileInfo(it.name, it.inode, it.attr); it.err != nil {
+                return false
+            }
+        }
+        return true
+    }
+    return false
+}
+
+// Name returns the name of the current entry.
+func (it *DirIter) Name() string {
+    return it.name
+}
+
+// Inode returns the inode of the current entry.
+func (it *DirIter) Inode() uint32 {
+    return it.inode
+}
+
+// Type returns the type of the current entry, TYPE_FILE, TYPE_DIRECTORY ...
+func (it *DirIter) Type() uint8 {
+    return it.attr[0]
+}
+
+// Info returns the attributes of the current entry, or nil if the
+// directory is listed without them.
+func (it *DirIter) Info() os.FileInfo {
+    if !it.withattr {
+        return nil
+    }
+    return it.fi
+}
+
+// Err returns the error which stopped the iteration, if any.
+func (it *DirIter) Err() error {
+    return it.err
+}
+
+// dirIterator returns the iterator shared by Readdir and Readdirnames, so
+// that they continue where the other one stopped like with an os.File. It
+// is started again with the attributes, and skips the entries already
+// returned, when Readdir follows Readdirnames.
+func (f *File) dirIterator(withattr bool) *DirIter {
+    if f.dirIter == nil || withattr && !f.dirIter.withattr {
+        it := f.client.newDirIter(f.inode, withattr)
+        for i := 0; i < f.dirPos && it.Next(); i++ {
+        }
+        f.dirIter = it
+    }
+    return f.dirIter
+}
+
+// Readdir reads the next count entries of the directory like os.File does:
+// with count > 0 it returns io.EOF at the end of the directory, otherwise
+// it returns all the remaining entries.
+func (f *File) Readdir(count int) (fis []os.FileInfo, err error) {
+    f.rmutex.Lock()
+    defer f.rmutex.Unlock()
+
+    it := f.dirIterator(true)
+    for count <= 0 || len(fis) < count {
+        if !it.Next() {
+            break
+        }
+        fis = append(fis, it.Info())
+        f.dirPos++
+    }
+    if err = it.Err(); err != nil {
+        return fis, err
+    }
+    if count > 0 && len(fis) == 0 {
+        return nil, io.EOF
+    }
+    return fis, nil
+}
+
+// Readdirnames is like Readdir, but returns only the names of the entries.
+func (f *File) Readdirnames(count int) (names []string, err error) {
+    f.rmutex.Lock()
+    defer f.rmutex.Unlock()
+
+    it := f.dirIterator(false)
+    for count <= 0 || len(names) < count {
+        if !it.Next() {
+            break
+        }
+        names = append(names, it.Name())
+        f.dirPos++
+    }
+    if err = it.Err(); err != nil {
+        return names, err
+    }
+    if count > 0 && len(names) == 0 {
+        return nil, io.EOF
+    }
+    return names, nil
+}
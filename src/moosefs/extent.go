@@ -0,0 +1,158 @@
+package moosefs
+
+import "sort"
+
+// extent is a range of a file written by the client but not yet sent to
+// the chunkservers.
+type extent struct {
+    off  int64
+    data []byte
+}
+
+func (e *extent) end() int64 {
+    return e.off + int64(len(e.data))
+}
+
+// dirtyChunks buffers the writes to a file. The extents of every chunk are
+// kept sorted by offset, and never overlap or touch each other, so that a
+// chunk can be flushed with as few writes as possible.
+type dirtyChunks struct {
+    chunks map[uint32][]*extent
+    size   int // bytes buffered
+}
+
+// write buffers b to be written at off, replacing older data in that range.
+func (d *dirtyChunks) write(b []byte, off int64) {
+    for len(b) > 0 {
+        n := min(len(b), int(CHUNK_SIZE-off%CHUNK_SIZE))
+        d.insert(uint32(off/CHUNK_SIZE), off, b[:n])
+        b = b[n:]
+        off += int64(n)
+    }
+}
+
+func (d *dirtyChunks) insert(indx uint32, off int64, b []byte) {
+    if d.chunks == nil {
+        d.chunks = make(map[uint32][]*extent)
+    }
+    exts := d.chunks[indx]
+    end := off + int64(len(b))
+
+    // exts[i:j] are the extents overlapping or touching [off, end)
+    i := sort.Search(len(exts), func(k int) bool { return exts[k].end() >= off })
+    j := i
+    for j < len(exts) && exts[j].off <= end {
+        j++
+    }
+
+    if i == j {
+        exts = append(exts, nil)
+        copy(exts[i+1:], exts[i:])
+        exts[i] = &extent{off, append([]byte(nil), b...)}
+        d.chunks[indx] = exts
+        d.size += len(b)
+        return
+    }
+
+    first, last := exts[i], exts[j-1]
+    var data []byte
+    start := first.off
+    if j-i == 1 && first.off <= off {
+        // overwrite or append to one extent, the usual case
+        data = first.data
+        if end <= first.end() {
+            copy(data[off-first.off:], b)
+        } else {
+            data = append(data[:off-first.off], b...)
+        }
+    } else {
+        if off < start {
+            start = off
+        }
+        stop := last.end()
+        if end > stop {
+            stop = end
+        }
+        data = make([]byte, stop-start)
+        for _, e := range exts[i:j] {
+            copy(data[e.off-start:], e.data)
+        }
+        copy(data[off-start:], b)
+    }
+
+    for _, e := range exts[i:j] {
+        d.size -= len(e.data)
+    }
+    d.size += len(data)
+    exts[i] = &extent{start, data}
+    d.chunks[indx] = append(exts[:i+1], exts[j:]...)
+}
+
+// read copies the buffered data in [off, off+len(b)) over b.
+func (d *dirtyChunks) read(b []byte, off int64) {
+    end := off + int64(len(b))
+    for indx := off / CHUNK_SIZE; indx*CHUNK_SIZE < end; indx++ {
+        for _, e := range d.chunks[uint32(indx)] {
+            lo, hi := e.off, e.end()
+            if lo < off {
+                lo = off
+            }
+            if hi > end {
+                hi = end
+            }
+            if lo < hi {
+                copy(b[lo-off:hi-off], e.data[lo-e.off:hi-e.off])
+            }
+        }
+    }
+}
+
+// end returns the end of the last buffered extent.
+func (d *dirtyChunks) end() int64 {
+    var end int64
+    for _, exts := range d.chunks {
+        if e := exts[len(exts)-1]; e.end() > end {
+            end = e.end()
+        }
+    }
+    return end
+}
+
+// truncate drops the buffered data at or after size.
+func (d *dirtyChunks) truncate(size int64) {
+    for indx, exts := range d.chunks {
+        for len(exts) > 0 && exts[len(exts)-1].end() > size {
+            e := exts[len(exts)-1]
+            if e.off >= size {
+                d.size -= len(e.data)
+                exts = exts[:len(exts)-1]
+            } else {
+                d.size -= int(e.end() - size)
+                e.data = e.data[:size-e.off]
+            }
+        }
+        if len(exts) == 0 {
+            delete(d.chunks, indx)
+        } else {
+            d.chunks[indx] = exts
+        }
+    }
+}
+
+// indexes returns the dirty chunks in ascending order.
+func (d *dirtyChunks) indexes() []uint32 {
+    indexes := make([]uint32, 0, len(d.chunks))
+    for indx := range d.chunks {
+        indexes = append(indexes, indx)
+    }
+    sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+    return indexes
+}
+
+// remove forgets the extents of a chunk once they are written.
+func (d *dirtyChunks) remove(indx uint32) {
+    for _, e := range d.chunks[indx] {
+        d.size -= len(e.data)
+    }
+    delete(d.chunks, indx)
+}
@@ -0,0 +1,67 @@
+package moosefs
+
+import (
+    "bytes"
+    "testing"
+)
+
+func TestDirtyChunks(t *testing.T) {
+    var d dirtyChunks
+    file := make([]byte, 64)
+    write := func(s string, off int64) {
+        d.write([]byte(s), off)
+        copy(file[off:], s)
+    }
+
+    write("hello", 10)
+    write("world", 30)
+    write("XX", 14) // touches the first extent
+    write("abc", 20)
+    write("0123456789abcd", 16) // joins three extents
+    write("zz", 2)
+
+    if n := len(d.chunks[0]); n != 2 {
+        t.Error("extents not merged", n)
+    }
+    if d.size != 2+(35-10) {
+        t.Error("wrong size", d.size)
+    }
+    if d.end() != 35 {
+        t.Error("wrong end", d.end())
+    }
+    b := make([]byte, 64)
+    d.read(b, 0)
+    if !bytes.Equal(b, file) {
+        t.Errorf("read %q, want %q", b, file)
+    }
+    b = make([]byte, 8)
+    d.read(b, 12)
+    if !bytes.Equal(b, file[12:20]) {
+        t.Errorf("read %q, want %q", b, file[12:20])
+    }
+
+    d.truncate(20)
+    if d.end() != 20 || d.size != 2+10 {
+        t.Error("truncate failed", d.end(), d.size)
+    }
+}
+
+func TestDirtyChunksAcrossChunks(t *testing.T) {
+    var d dirtyChunks
+    d.write([]byte("abcd"), CHUNK_SIZE-2)
+    if len(d.chunks) != 2 || d.chunks[0][0].end() != CHUNK_SIZE || d.chunks[1][0].off != CHUNK_SIZE {
+        t.Error("write not split at chunk boundary")
+    }
+    if idx := d.indexes(); len(idx) != 2 || idx[0] != 0 || idx[1] != 1 {
+        t.Error("wrong indexes", idx)
+    }
+    b := make([]byte, 4)
+    d.read(b, CHUNK_SIZE-2)
+    if string(b) != "abcd" {
+        t.Error("read across chunks", string(b))
+    }
+    d.remove(0)
+    if d.size != 2 {
+        t.Error("remove failed", d.size)
+    }
+}
@@ -0,0 +1,172 @@
+package moosefs
+
+import (
+    "io"
+    "io/fs"
+    "path"
+)
+
+// FS is a subtree of a Client seen as an fs.FS, so that it can be used
+// with http.FS, template.ParseFS, fs.WalkDir and the like. The Client can't
+// be one itself, since its Open returns a *File like os.Open does.
+type FS struct {
+    c    *Client
+    root string
+}
+
+var (
+    _ fs.FS         = (*FS)(nil)
+    _ fs.StatFS     = (*FS)(nil)
+    _ fs.ReadDirFS  = (*FS)(nil)
+    _ fs.ReadFileFS = (*FS)(nil)
+    _ fs.SubFS      = (*FS)(nil)
+
+    _ fs.ReadDirFile = (*File)(nil)
+    _ fs.DirEntry    = dirEntry{}
+)
+
+// FS returns the whole file system of the client as an fs.FS.
+func (c *Client) FS() *FS {
+    return &FS{c, "/"}
+}
+
+// Sub returns the subtree below dir as an fs.FS.
+func (c *Client) Sub(dir string) (fs.FS, error) {
+    fi, err := c.Stat(dir)
+    if err != nil {
+        return nil, &fs.PathError{Op: "sub", Path: dir, Err: err}
+    }
+    if !fi.IsDir() {
+        return nil, &fs.PathError{Op: "sub", Path: dir, Err: Error(ERROR_ENOTDIR)}
+    }
+    if !path.IsAbs(dir) {
+        dir = path.Join(c.cwd, dir)
+    }
+    return &FS{c, path.Clean(dir)}, nil
+}
+
+// ReadDir reads the directory name and returns its entries sorted by name,
+// like os.ReadDir.
+func (c *Client) ReadDir(name string) ([]fs.DirEntry, error) {
+    fi, _, err := c.lookup(name, true)
+    if err != nil {
+        return nil, err
+    }
+    fis, err := c.readDir(uint32(fi.inode))
+    if err != nil {
+        return nil, err
+    }
+    entries := make([]fs.DirEntry, len(fis))
+    for i, fi := range fis {
+        entries[i] = dirEntry{fi}
+    }
+    return entries, nil
+}
+
+// ReadFile returns the content of the file name, like os.ReadFile.
+func (c *Client) ReadFile(name string) ([]byte, error) {
+    f, err := c.Open(name)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+
+    data := make([]byte, 0, f.Len())
+    for {
+        if len(data) == cap(data) {
+            data = append(data, 0)[:len(data)]
+        }
+        n, err := f.Read(data[len(data):cap(data)])
+        data = data[:len(data)+n]
+        if err == io.EOF {
+            return data, nil
+        }
+        if err != nil {
+            return nil, err
+        }
+    }
+}
+
+// ReadDir reads the next n entries of the directory like os.File.ReadDir.
+func (f *File) ReadDir(n int) ([]fs.DirEntry, error) {
+    fis, err := f.Readdir(n)
+    entries := make([]fs.DirEntry, len(fis))
+    for i, fi := range fis {
+        entries[i] = dirEntry{fi.(*fileStat)}
+    }
+    return entries, err
+}
+
+// path returns the name in the client for name in fsys.
+func (fsys *FS) path(op, name string) (string, error) {
+    if !fs.ValidPath(name) {
+        return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+    }
+    return path.Join(fsys.root, name), nil
+}
+
+func (fsys *FS) Open(name string) (fs.File, error) {
+    full, err := fsys.path("open", name)
+    if err != nil {
+        return nil, err
+    }
+    f, err := fsys.c.Open(full)
+    if err != nil {
+        return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+    }
+    if name == "." {
+        info := *f.info
+        info.name = "."
+        f.info = &info
+    }
+    return f, nil
+}
+
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+    full, err := fsys.path("stat", name)
+    if err != nil {
+        return nil, err
+    }
+    fi, err := fsys.c.Stat(full)
+    if err != nil {
+        return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+    }
+    if name == "." {
+        info := *fi.(*fileStat)
+        info.name = "."
+        return &info, nil
+    }
+    return fi, nil
+}
+
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+    full, err := fsys.path("readdir", name)
+    if err != nil {
+        return nil, err
+    }
+    entries, err := fsys.c.ReadDir(full)
+    if err != nil {
+        return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+    }
+    return entries, nil
+}
+
+func (fsys *FS) ReadFile(name string) ([]byte, error) {
+    full, err := fsys.path("readfile", name)
+    if err != nil {
+        return nil, err
+    }
+    data, err := fsys.c.ReadFile(full)
+    if err != nil {
+        return nil, &fs.PathError{Op: "readfile", Path: name, Err: err}
+    }
+    return data, nil
+}
+
+func (fsys *FS) Sub(dir string) (fs.FS, error) {
+    full, err := fsys.path("sub", dir)
+    if err != nil {
+        return nil, err
+    }
+    return fsys.c.Sub(full)
+}
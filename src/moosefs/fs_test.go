@@ -0,0 +1,30 @@
+package moosefs
+
+import (
+    "testing"
+    "testing/fstest"
+)
+
+func TestFS(t *testing.T) {
+    c := NewClient(testMaster.Addr(), "/", false)
+    defer c.Close()
+    c.MkdirAll("/fstest/dir/sub", 0755)
+    defer c.RemoveAll("/fstest")
+    writeTestFile(t, c, "/fstest/hello.txt", []byte("hello"))
+    writeTestFile(t, c, "/fstest/dir/data", testData(1000))
+    writeTestFile(t, c, "/fstest/dir/sub/empty", nil)
+
+    fsys, err := c.Sub("/fstest")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := fstest.TestFS(fsys, "hello.txt", "dir/data", "dir/sub/empty"); err != nil {
+        t.Error(err)
+    }
+    for i := 0; i < 5; i++ {
+        fsys.(*FS).Stat("hello.txt")
+    }
+    if n := c.Metrics().OpenFiles; n != 0 {
+        t.Error("files left open", n)
+    }
+}
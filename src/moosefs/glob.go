@@ -0,0 +1,152 @@
+package moosefs
+
+import (
+    "os"
+    "path"
+    "sort"
+    "strings"
+)
+
+type globMatch struct {
+    name string
+    fi   *fileStat
+}
+
+// Glob returns the names of the files matching pattern, which has the
+// syntax of path.Match, plus "**" matching zero or more directories. Only
+// the directories where a wildcard has to be matched are listed, literal
+// names are looked up directly. Like filepath.Glob it ignores missing
+// files and directories it is not allowed to read, and the matches are
+// relative if the pattern is.
+func (c *Client) Glob(pattern string) ([]string, error) {
+    if _, err := path.Match(pattern, ""); err != nil {
+        return nil, err
+    }
+
+    var cur []globMatch
+    pattern = path.Clean(pattern)
+    if strings.HasPrefix(pattern, "/") {
+        fi, err := c.getMasterConn().GetAttr(MFS_ROOT_ID)
+        if err != nil {
+            return nil, err
+        }
+        cur = append(cur, globMatch{"/", fi})
+        pattern = pattern[1:]
+        if pattern == "" {
+            return []string{"/"}, nil
+        }
+    } else {
+        cur = append(cur, globMatch{"", &fileStat{inode: uint64(c.curr_inode), mode: os.ModeDir}})
+    }
+
+    segs := strings.Split(pattern, "/")
+    for i, seg := range segs {
+        last := i == len(segs)-1
+        var next []globMatch
+        for _, m := range cur {
+            dir, err := c.globDir(m)
+            if err != nil {
+                return nil, err
+            }
+            if dir == nil {
+                continue
+            }
+            switch {
+            case seg == "**":
+                next, err = c.globAll(next, m.name, dir, last)
+            case !strings.ContainsAny(seg, `*?[\`):
+                var fi *fileStat
+                fi, err = c.lookup_inode(uint32(dir.inode), seg)
+                if err == nil {
+                    next = append(next, globMatch{globJoin(m.name, seg), fi})
+                }
+            default:
+                var fis []*fileStat
+                fis, err = c.readDir(uint32(dir.inode))
+                for _, fi := range fis {
+                    if ok, _ := path.Match(seg, fi.name); ok {
+                        next = append(next, globMatch{globJoin(m.name, fi.name), fi})
+                    }
+                }
+            }
+            if err != nil && !globIgnored(err) {
+                return nil, err
+            }
+        }
+        cur = next
+    }
+
+    matches := make([]string, 0, len(cur))
+    for _, m := range cur {
+        // the working directory a relative "**" starts from has no name
+        if m.name != "" {
+            matches = append(matches, m.name)
+        }
+    }
+    sort.Strings(matches)
+    // "**" may find a name more than once
+    n := 0
+    for i, m := range matches {
+        if i == 0 || m != matches[n-1] {
+            matches[n] = m
+            n++
+        }
+    }
+    return matches[:n], nil
+}
+
+// globDir returns the directory m points to, or nil if it isn't one.
+func (c *Client) globDir(m globMatch) (*fileStat, error) {
+    fi := m.fi
+    if fi.IsSymlink() {
+        target, err := c.Stat(m.name)
+        if err != nil {
+            if globIgnored(err) {
+                return nil, nil
+            }
+            return nil, err
+        }
+        fi = target.(*fileStat)
+    }
+    if !fi.IsDir() {
+        return nil, nil
+    }
+    return fi, nil
+}
+
+// globAll adds dir and everything below it to matches, only directories
+// unless "**" is the last element of the pattern. Symbolic links are not
+// followed.
+func (c *Client) globAll(matches []globMatch, name string, dir *fileStat, files bool) ([]globMatch, error) {
+    matches = append(matches, globMatch{name, dir})
+    fis, err := c.readDir(uint32(dir.inode))
+    if err != nil {
+        return matches, err
+    }
+    for _, fi := range fis {
+        if fi.IsDir() {
+            matches, err = c.globAll(matches, globJoin(name, fi.name), fi, files)
+            if err != nil && !globIgnored(err) {
+                return matches, err
+            }
+        } else if files {
+            matches = append(matches, globMatch{globJoin(name, fi.name), fi})
+        }
+    }
+    return matches, nil
+}
+
+func globJoin(dir, name string) string {
+    if dir == "" {
+        return name
+    }
+    return path.Join(dir, name)
+}
+
+// globIgnored reports whether Glob skips a file because of err.
+func globIgnored(err error) bool {
+    if e, ok := err.(Error); ok {
+        return e == ERROR_ENOENT || e == ERROR_ENOTDIR || e == ERROR_EACCES
+    }
+    return false
+}
@@ -0,0 +1,62 @@
+package moosefs
+
+import (
+    "path"
+    "reflect"
+    "testing"
+)
+
+func TestGlob(t *testing.T) {
+    c := NewClient(testMaster.Addr(), "/", false)
+    defer c.Close()
+    c.MkdirAll("/glob/sub/deep", 0755)
+    defer c.RemoveAll("/glob")
+    for _, name := range []string{"a1.txt", "a2.txt", "b.txt", "c.log", "x*y", "sub/d.txt", "sub/deep/e.txt"} {
+        writeTestFile(t, c, "/glob/"+name, nil)
+    }
+
+    tests := []struct {
+        pattern string
+        want    []string
+    }{
+        {"/glob/*.txt", []string{"/glob/a1.txt", "/glob/a2.txt", "/glob/b.txt"}},
+        {"/glob/a?.txt", []string{"/glob/a1.txt", "/glob/a2.txt"}},
+        {"/glob/[ab]*.txt", []string{"/glob/a1.txt", "/glob/a2.txt", "/glob/b.txt"}},
+        {"/glob/[^a]*.txt", []string{"/glob/b.txt"}},
+        {"/glob/[a-b]2.txt", []string{"/glob/a2.txt"}},
+        {`/glob/x\*y`, []string{"/glob/x*y"}},
+        {`/glob/a\*`, []string{}},
+        {"/glob/*/*.txt", []string{"/glob/sub/d.txt"}},
+        {"/glob/**/*.txt", []string{"/glob/a1.txt", "/glob/a2.txt", "/glob/b.txt", "/glob/sub/d.txt", "/glob/sub/deep/e.txt"}},
+        {"/glob/missing/*", []string{}},
+        {"glob/c.log", []string{"glob/c.log"}},
+    }
+    for _, tt := range tests {
+        got, err := c.Glob(tt.pattern)
+        if err != nil || !reflect.DeepEqual(got, tt.want) {
+            t.Error(tt.pattern, got, err)
+        }
+    }
+
+    if err := c.Chdir("/glob"); err != nil {
+        t.Fatal(err)
+    }
+    for _, tt := range []struct {
+        pattern string
+        want    []string
+    }{
+        {"**/*.txt", []string{"a1.txt", "a2.txt", "b.txt", "sub/d.txt", "sub/deep/e.txt"}},
+        {"**/deep", []string{"sub/deep"}},
+        {"**", []string{"a1.txt", "a2.txt", "b.txt", "c.log", "sub", "sub/d.txt", "sub/deep", "sub/deep/e.txt", "x*y"}},
+    } {
+        got, err := c.Glob(tt.pattern)
+        if err != nil || !reflect.DeepEqual(got, tt.want) {
+            t.Error(tt.pattern, got, err)
+        }
+    }
+    c.Chdir("/")
+
+    if _, err := c.Glob("/glob/[a"); err != path.ErrBadPattern {
+        t.Error("bad pattern", err)
+    }
+}
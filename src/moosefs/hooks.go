@@ -0,0 +1,119 @@
+package moosefs
+
+import (
+    "encoding/binary"
+    "sync"
+)
+
+// Logger is what the client logs with, *slog.Logger satisfies it. args are
+// pairs of keys and values.
+type Logger interface {
+    Debug(msg string, args ...interface{})
+    Info(msg string, args ...interface{})
+    Warn(msg string, args ...interface{})
+    Error(msg string, args ...interface{})
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, args ...interface{}) {}
+func (nopLogger) Info(msg string, args ...interface{})  {}
+func (nopLogger) Warn(msg string, args ...interface{})  {}
+func (nopLogger) Error(msg string, args ...interface{}) {}
+
+// An Op is a request to the master or a block operation with a chunkserver.
+type Op struct {
+    Command string // the request to the master like "LOOKUP", or "READ" and "WRITE" of blocks
+    Addr    string // of the master or the chunkserver
+    Inode   uint32 // 0 when the request is not about an inode
+    ChunkID uint64 // of block operations, and of READ_CHUNK and WRITE_CHUNK once answered
+    Offset  uint32 // in the chunk, of block operations
+    Size    int    // of block operations
+}
+
+// An Interceptor is called around every Op, it must call next once and
+// should return its error.
+type Interceptor func(op *Op, next func() error) error
+
+// hooks are the logger and the interceptors of a client, shared by its
+// connections. A nil *hooks logs nothing.
+type hooks struct {
+    mutex        sync.RWMutex
+    log          Logger
+    interceptors []Interceptor
+}
+
+func (h *hooks) logger() Logger {
+    if h == nil {
+        return nopLogger{}
+    }
+    h.mutex.RLock()
+    defer h.mutex.RUnlock()
+    if h.log == nil {
+        return nopLogger{}
+    }
+    return h.log
+}
+
+// run calls f through the interceptors, the first one is the outermost
+func (h *hooks) run(op *Op, f func() error) error {
+    if h == nil {
+        return f()
+    }
+    h.mutex.RLock()
+    interceptors := h.interceptors
+    h.mutex.RUnlock()
+    for i := len(interceptors) - 1; i >= 0; i-- {
+        intercept, next := interceptors[i], f
+        f = func() error {
+            return intercept(op, next)
+        }
+    }
+    return f()
+}
+
+// SetLogger makes the client log reconnections, retries and errors to l,
+// nil turns logging off.
+func (c *Client) SetLogger(l Logger) {
+    c.hooks.mutex.Lock()
+    c.hooks.log = l
+    c.hooks.mutex.Unlock()
+}
+
+// AddInterceptor adds i around the requests to the master and the block
+// operations of the client. Interceptors added first run outermost.
+func (c *Client) AddInterceptor(i Interceptor) {
+    c.hooks.mutex.Lock()
+    c.hooks.interceptors = append(c.hooks.interceptors[:len(c.hooks.interceptors):len(c.hooks.interceptors)], i)
+    c.hooks.mutex.Unlock()
+}
+
+// requestInode returns the inode a request to the master is about
+func requestInode(cmd uint32, args []byte) uint32 {
+    switch cmd {
+    case CUTOMA_FUSE_STATFS, CUTOMA_FUSE_GETTRASH, CUTOMA_FUSE_GETRESERVED:
+        return 0
+    case CUTOMA_FUSE_WRITE_CHUNK_END:
+        // chunkid:64 inode:32
+        if len(args) >= 12 {
+            return binary.BigEndian.Uint32(args[8:])
+        }
+        return 0
+    }
+    if len(args) >= 4 {
+        return binary.BigEndian.Uint32(args)
+    }
+    return 0
+}
+
+// replyChunkID returns the chunk a READ_CHUNK or WRITE_CHUNK answer is about
+func replyChunkID(cmd uint32, ans []byte) uint64 {
+    switch cmd {
+    case CUTOMA_FUSE_READ_CHUNK, CUTOMA_FUSE_WRITE_CHUNK:
+        // length:64 chunkid:64 ...
+        if len(ans) >= 16 {
+            return binary.BigEndian.Uint64(ans[8:])
+        }
+    }
+    return 0
+}
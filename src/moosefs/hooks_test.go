@@ -0,0 +1,89 @@
+package moosefs
+
+import (
+    "bytes"
+    "log/slog"
+    "moosefstest"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+func TestHooks(t *testing.T) {
+    c := NewClient(testMaster.Addr(), "/", false)
+    defer c.Close()
+    c.WriteRetryDelay = time.Millisecond
+
+    var logs bytes.Buffer
+    c.SetLogger(slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+    var mutex sync.Mutex
+    var ops []Op
+    var order []string
+    c.AddInterceptor(func(op *Op, next func() error) error {
+        mutex.Lock()
+        order = append(order, "outer")
+        mutex.Unlock()
+        err := next()
+        mutex.Lock()
+        ops = append(ops, *op)
+        mutex.Unlock()
+        return err
+    })
+    c.AddInterceptor(func(op *Op, next func() error) error {
+        mutex.Lock()
+        order = append(order, "inner")
+        mutex.Unlock()
+        return next()
+    })
+
+    testMaster.SetFault(moosefstest.FailCommand(CUTOMA_FUSE_WRITE_CHUNK, ERROR_LOCKED, 1))
+    defer testMaster.SetFault(nil)
+    data := testData(MFS_BLOCK_SIZE + 1)
+    writeTestFile(t, c, "hooked", data)
+    defer c.Remove("hooked")
+    if got, err := c.ReadFile("hooked"); err != nil || !bytes.Equal(got, data) {
+        t.Fatal("read back", len(got), err)
+    }
+
+    mutex.Lock()
+    defer mutex.Unlock()
+    if len(order) < 2 || order[0] != "outer" || order[1] != "inner" {
+        t.Error("order of interceptors", order)
+    }
+    var lookup, reads, writes int
+    chunks := make(map[string]int)
+    for _, op := range ops {
+        switch op.Command {
+        case "LOOKUP":
+            if op.Inode == MFS_ROOT_ID && op.Addr == testMaster.Addr() {
+                lookup++
+            }
+        case "READ_CHUNK", "WRITE_CHUNK":
+            if op.ChunkID != 0 {
+                chunks[op.Command]++
+            }
+        case "READ", "WRITE":
+            if op.ChunkID == 0 || op.Inode == 0 || op.Addr == "" {
+                t.Error("block op", op)
+            }
+            if op.Command == "READ" {
+                reads++
+            } else {
+                writes++
+            }
+        }
+    }
+    if lookup == 0 || reads == 0 || writes != 2 {
+        t.Error("ops", lookup, reads, writes)
+    }
+    if chunks["READ_CHUNK"] == 0 || chunks["WRITE_CHUNK"] == 0 {
+        t.Error("chunk ids of master ops", chunks)
+    }
+    for _, msg := range []string{"registered to master", "write chunk failed, retrying"} {
+        if !strings.Contains(logs.String(), msg) {
+            t.Error("not logged:", msg)
+        }
+    }
+}
@@ -0,0 +1,268 @@
+package moosefs
+
+import (
+    "container/list"
+    "sync"
+    "time"
+)
+
+// defaults of the inode cache
+const (
+    INODE_CACHE_ENTRY_TTL = 10 * time.Second
+    INODE_CACHE_ATTR_TTL  = 1 * time.Second
+    INODE_CACHE_NEG_TTL   = 0
+    INODE_CACHE_MAX_BYTES = 64 * 1024 * 1024
+)
+
+// rough memory used by a cache entry besides its name
+const inodeEntryOverhead = 256
+
+// CacheOptions tune the inode cache of a Client.
+type CacheOptions struct {
+    EntryTTL    time.Duration // how long a name is trusted to point to the same inode
+    AttrTTL     time.Duration // how long the size, mode and times are trusted
+    NegativeTTL time.Duration // how long a missing name is remembered, 0 to not cache them
+    MaxBytes    int64         // memory bound, the least recently used entries go first
+}
+
+// CacheStats are the counters of the inode cache.
+type CacheStats struct {
+    Hits         uint64 // lookups answered from the cache
+    Misses       uint64 // lookups sent to the master
+    NegativeHits uint64 // lookups answered with ENOENT from the cache
+    AttrRefresh  uint64 // entries whose attributes were fetched again
+    Evictions    uint64 // entries dropped to stay under MaxBytes
+    Entries      int
+    Bytes        int64
+}
+
+type inodeEntry struct {
+    parent      uint32
+    name        string
+    fi          *fileStat // nil for a missing name
+    entryExpire time.Time
+    attrExpire  time.Time
+}
+
+func (e *inodeEntry) size() int64 {
+    return int64(inodeEntryOverhead + len(e.name))
+}
+
+// results of inodeCache.get
+const (
+    cacheMiss = iota
+    cacheHit
+    cacheNegative
+    cacheStaleAttr
+)
+
+// inodeCache maps (parent, name) to the attributes of the entry, bounded in
+// time and memory.
+type inodeCache struct {
+    sync.Mutex
+    opts    CacheOptions
+    stats   CacheStats
+    lru     *list.List // of *inodeEntry, most recent first
+    entries map[uint32]map[string]*list.Element
+    inodes  map[uint32]map[*list.Element]bool // names of an inode
+}
+
+func newInodeCache(opts CacheOptions) *inodeCache {
+    ic := new(inodeCache)
+    ic.init(opts)
+    return ic
+}
+
+func (ic *inodeCache) init(opts CacheOptions) {
+    ic.opts = opts
+    ic.stats = CacheStats{}
+    ic.lru = list.New()
+    ic.entries = make(map[uint32]map[string]*list.Element)
+    ic.inodes = make(map[uint32]map[*list.Element]bool)
+}
+
+// reset empties the cache and makes it use opts from now on.
+func (ic *inodeCache) reset(opts CacheOptions) {
+    ic.Lock()
+    ic.init(opts)
+    ic.Unlock()
+}
+
+// get looks up a name. For cacheStaleAttr the inode is still valid but its
+// attributes have to be fetched again.
+func (ic *inodeCache) get(parent uint32, name string) (*fileStat, int) {
+    ic.Lock()
+    defer ic.Unlock()
+
+    el, ok := ic.entries[parent][name]
+    if !ok {
+        ic.stats.Misses++
+        return nil, cacheMiss
+    }
+    e := el.Value.(*inodeEntry)
+    now := time.Now()
+    if now.After(e.entryExpire) {
+        ic.remove(el)
+        ic.stats.Misses++
+        return nil, cacheMiss
+    }
+    ic.lru.MoveToFront(el)
+    if e.fi == nil {
+        ic.stats.NegativeHits++
+        return nil, cacheNegative
+    }
+    if now.After(e.attrExpire) {
+        ic.stats.AttrRefresh++
+        return e.fi, cacheStaleAttr
+    }
+    ic.stats.Hits++
+    return e.fi, cacheHit
+}
+
+// put caches the entry of a name, keeping the time its inode was looked
+// up when only the attributes are refreshed.
+func (ic *inodeCache) put(parent uint32, name string, fi *fileStat) {
+    ic.Lock()
+    defer ic.Unlock()
+
+    now := time.Now()
+    if el, ok := ic.entries[parent][name]; ok {
+        e := el.Value.(*inodeEntry)
+        if e.fi != nil && e.fi.inode == fi.inode {
+            e.fi = fi
+            e.attrExpire = now.Add(ic.opts.AttrTTL)
+            ic.lru.MoveToFront(el)
+            return
+        }
+        ic.remove(el)
+    }
+    if ic.opts.EntryTTL <= 0 {
+        return
+    }
+    ic.add(&inodeEntry{parent, name, fi, now.Add(ic.opts.EntryTTL), now.Add(ic.opts.AttrTTL)})
+}
+
+// putNegative remembers that a name does not exist.
+func (ic *inodeCache) putNegative(parent uint32, name string) {
+    ic.Lock()
+    defer ic.Unlock()
+
+    ttl := ic.opts.NegativeTTL
+    if ttl <= 0 {
+        return
+    }
+    if el, ok := ic.entries[parent][name]; ok {
+        ic.remove(el)
+    }
+    ic.add(&inodeEntry{parent, name, nil, time.Now().Add(ttl), time.Time{}})
+}
+
+func (ic *inodeCache) add(e *inodeEntry) {
+    names, ok := ic.entries[e.parent]
+    if !ok {
+        names = make(map[string]*list.Element)
+        ic.entries[e.parent] = names
+    }
+    el := ic.lru.PushFront(e)
+    names[e.name] = el
+    if e.fi != nil {
+        inode := uint32(e.fi.inode)
+        if ic.inodes[inode] == nil {
+            ic.inodes[inode] = make(map[*list.Element]bool)
+        }
+        ic.inodes[inode][el] = true
+    }
+    ic.stats.Entries++
+    ic.stats.Bytes += e.size()
+    for ic.stats.Bytes > ic.opts.MaxBytes && ic.lru.Len() > 0 {
+        ic.remove(ic.lru.Back())
+        ic.stats.Evictions++
+    }
+}
+
+func (ic *inodeCache) remove(el *list.Element) {
+    e := ic.lru.Remove(el).(*inodeEntry)
+    names := ic.entries[e.parent]
+    delete(names, e.name)
+    if len(names) == 0 {
+        delete(ic.entries, e.parent)
+    }
+    if e.fi != nil {
+        inode := uint32(e.fi.inode)
+        delete(ic.inodes[inode], el)
+        if len(ic.inodes[inode]) == 0 {
+            delete(ic.inodes, inode)
+        }
+    }
+    ic.stats.Entries--
+    ic.stats.Bytes -= e.size()
+}
+
+// purge drops the entry of a name and, if it is a directory, everything
+// cached below it. It returns the number of entries removed.
+func (ic *inodeCache) purge(parent uint32, name string) int {
+    ic.Lock()
+    defer ic.Unlock()
+
+    el, ok := ic.entries[parent][name]
+    if !ok {
+        return 0
+    }
+    e := el.Value.(*inodeEntry)
+    ic.remove(el)
+    n := 1
+    if e.fi != nil && e.fi.IsDir() {
+        n += ic.purgeDir(uint32(e.fi.inode))
+    }
+    return n
+}
+
+// purgeDir drops everything cached below the directory inode.
+func (ic *inodeCache) purgeDir(inode uint32) int {
+    n := 0
+    for _, el := range ic.entries[inode] {
+        e := el.Value.(*inodeEntry)
+        ic.remove(el)
+        n++
+        if e.fi != nil && e.fi.IsDir() {
+            n += ic.purgeDir(uint32(e.fi.inode))
+        }
+    }
+    return n
+}
+
+// forget is called after a name was changed on the master. It purges the
+// name and makes the attributes of its parent, and of other names of the
+// same inode, stale.
+func (ic *inodeCache) forget(parent uint32, name string) {
+    ic.Lock()
+    el, ok := ic.entries[parent][name]
+    var inode uint32
+    if ok && el.Value.(*inodeEntry).fi != nil {
+        inode = uint32(el.Value.(*inodeEntry).fi.inode)
+    }
+    ic.Unlock()
+
+    ic.purge(parent, name)
+    ic.stale(parent)
+    if inode != 0 {
+        ic.stale(inode)
+    }
+}
+
+// stale makes the cached attributes of an inode outdated, so that they are
+// fetched again on the next lookup.
+func (ic *inodeCache) stale(inode uint32) {
+    ic.Lock()
+    defer ic.Unlock()
+
+    for el := range ic.inodes[inode] {
+        el.Value.(*inodeEntry).attrExpire = time.Time{}
+    }
+}
+
+func (ic *inodeCache) getStats() CacheStats {
+    ic.Lock()
+    defer ic.Unlock()
+    return ic.stats
+}
@@ -0,0 +1,128 @@
+package moosefs
+
+import (
+    "os"
+    "sync"
+    "testing"
+    "time"
+)
+
+func TestInodeCache(t *testing.T) {
+    ic := newInodeCache(CacheOptions{
+        EntryTTL:    time.Hour,
+        AttrTTL:     time.Hour,
+        NegativeTTL: time.Hour,
+        MaxBytes:    3 * (inodeEntryOverhead + 1),
+    })
+    dir := &fileStat{inode: 2, name: "d", mode: os.ModeDir}
+    ic.put(MFS_ROOT_ID, "d", dir)
+    ic.put(2, "a", &fileStat{inode: 3, name: "a"})
+    ic.putNegative(2, "b")
+
+    if fi, state := ic.get(2, "a"); state != cacheHit || fi.inode != 3 {
+        t.Error("hit expected", state)
+    }
+    if _, state := ic.get(2, "b"); state != cacheNegative {
+        t.Error("negative hit expected", state)
+    }
+    if _, state := ic.get(2, "c"); state != cacheMiss {
+        t.Error("miss expected", state)
+    }
+
+    // "d" is the least recently used entry
+    ic.put(MFS_ROOT_ID, "e", &fileStat{inode: 4, name: "e"})
+    if _, state := ic.get(MFS_ROOT_ID, "d"); state != cacheMiss {
+        t.Error("entry not evicted", state)
+    }
+
+    // evicts "a", leaving "b" below "d"
+    ic.put(MFS_ROOT_ID, "d", dir)
+    if n := ic.purge(MFS_ROOT_ID, "d"); n != 2 {
+        t.Error("purge removed", n)
+    }
+    st := ic.getStats()
+    if st.Hits != 1 || st.NegativeHits != 1 || st.Misses != 2 || st.Evictions < 1 || st.Entries != 1 {
+        t.Errorf("wrong stats %+v", st)
+    }
+}
+
+func TestInodeCacheTTL(t *testing.T) {
+    ic := newInodeCache(CacheOptions{
+        EntryTTL: time.Hour,
+        MaxBytes: INODE_CACHE_MAX_BYTES,
+    })
+    ic.put(MFS_ROOT_ID, "a", &fileStat{inode: 3, name: "a"})
+    if _, state := ic.get(MFS_ROOT_ID, "a"); state != cacheStaleAttr {
+        t.Error("attributes should be stale", state)
+    }
+    ic.putNegative(MFS_ROOT_ID, "b")
+    if _, state := ic.get(MFS_ROOT_ID, "b"); state != cacheMiss {
+        t.Error("negative entries are off", state)
+    }
+}
+
+func TestInodeCacheForget(t *testing.T) {
+    ic := newInodeCache(CacheOptions{
+        EntryTTL: time.Hour,
+        AttrTTL:  time.Hour,
+        MaxBytes: INODE_CACHE_MAX_BYTES,
+    })
+    ic.put(MFS_ROOT_ID, "d", &fileStat{inode: 2, name: "d", mode: os.ModeDir})
+    ic.put(2, "a", &fileStat{inode: 3, name: "a"})
+    ic.put(2, "b", &fileStat{inode: 3, name: "b"}) // a hard link of "a"
+
+    ic.forget(2, "a")
+    if _, state := ic.get(2, "a"); state != cacheMiss {
+        t.Error("entry not forgotten", state)
+    }
+    if _, state := ic.get(2, "b"); state != cacheStaleAttr {
+        t.Error("other link should be stale", state)
+    }
+    if _, state := ic.get(MFS_ROOT_ID, "d"); state != cacheStaleAttr {
+        t.Error("parent should be stale", state)
+    }
+
+    ic.forget(MFS_ROOT_ID, "d")
+    if st := ic.getStats(); st.Entries != 0 || st.Bytes != 0 {
+        t.Errorf("subtree not purged %+v", st)
+    }
+}
+
+func TestSetCacheOptionsConcurrent(t *testing.T) {
+    c := NewClient(testMaster.Addr(), "/", true)
+    defer c.Close()
+    writeTestFile(t, c, "/cached", []byte("x"))
+    defer c.Remove("/cached")
+
+    var wg sync.WaitGroup
+    for i := 0; i < 4; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for j := 0; j < 50; j++ {
+                if _, err := c.Stat("/cached"); err != nil {
+                    t.Error("stat", err)
+                    return
+                }
+                if _, err := c.Stat("/missing"); err == nil {
+                    t.Error("stat of a missing file")
+                    return
+                }
+            }
+        }()
+    }
+    done := make(chan bool)
+    go func() {
+        wg.Wait()
+        close(done)
+    }()
+    for j := 0; ; j++ {
+        select {
+        case <-done:
+            return
+        default:
+        }
+        c.SetCacheOptions(CacheOptions{EntryTTL: time.Duration(j%20) * time.Second, AttrTTL: time.Second, NegativeTTL: time.Duration(j%2) * time.Second, MaxBytes: INODE_CACHE_MAX_BYTES})
+        time.Sleep(100 * time.Microsecond)
+    }
+}
@@ -0,0 +1,166 @@
+package moosefs
+
+import (
+    "errors"
+    "path"
+    "strings"
+    "syscall"
+)
+
+// the most symlinks followed while resolving a path, as on Linux
+const MAX_SYMLINKS = 40
+
+// resolve follows name and returns the directory holding its last element
+// with the name and the attributes of it. When the last element is
+// missing, fi is nil and err is ERROR_ENOENT. When name ends with a
+// directory reached through "/", "." or "..", base is empty and dir is
+// that directory.
+func (c *Client) resolve(name string, follow bool) (dir uint32, base string, fi *fileStat, err error) {
+    w, base, fi, err := c.walkPath(name, follow)
+    if w != nil {
+        dir = w.dirs[len(w.dirs)-1]
+    }
+    return dir, base, fi, err
+}
+
+// pathWalk holds the directories walked through from the start of a path,
+// with their names. Relative paths start at the current directory, and
+// only resolve it from the root when ".." goes above it.
+type pathWalk struct {
+    dirs   []uint32
+    names  []string
+    rooted bool
+}
+
+// walkPath does the work of resolve, it returns the walk to the directory
+// holding the last element, or nil if it was not found.
+//
+// ".." goes to the real parent of a directory, after symlinks were
+// followed, and relative symlinks are resolved from the directory holding
+// them.
+func (c *Client) walkPath(name string, follow bool) (w *pathWalk, base string, fi *fileStat, err error) {
+    if name == "" {
+        return nil, "", nil, Error(ERROR_ENOENT)
+    }
+    if strings.HasSuffix(name, "/") {
+        // the last element must be a directory, through its symlink if any
+        follow = true
+    }
+    w = &pathWalk{dirs: []uint32{c.curr_inode}}
+    if strings.HasPrefix(name, "/") {
+        w.dirs[0], w.rooted = MFS_ROOT_ID, true
+    }
+    todo := strings.Split(name, "/")
+    hops := 0
+    for len(todo) > 0 {
+        n := todo[0]
+        todo = todo[1:]
+        last := len(todo) == 0
+        switch n {
+        case "", ".":
+            continue
+        case "..":
+            if len(w.dirs) == 1 && !w.rooted {
+                if w, err = c.cwdWalk(); err != nil {
+                    return nil, "", nil, err
+                }
+            }
+            if len(w.dirs) > 1 {
+                w.dirs = w.dirs[:len(w.dirs)-1]
+                w.names = w.names[:len(w.names)-1]
+            }
+            continue
+        }
+
+        cur := w.dirs[len(w.dirs)-1]
+        fi, err = c.lookup_inode(cur, n)
+        if err != nil {
+            if last {
+                return w, n, nil, err
+            }
+            return nil, "", nil, err
+        }
+        if fi.IsSymlink() && (!last || follow) {
+            if hops++; hops > MAX_SYMLINKS {
+                return nil, "", nil, syscall.ELOOP
+            }
+            target, err := c.getMasterConn().ReadLink(uint32(fi.inode))
+            if err != nil {
+                return nil, "", nil, errors.New("read link: " + err.Error())
+            }
+            if strings.HasPrefix(target, "/") {
+                w = &pathWalk{dirs: []uint32{MFS_ROOT_ID}, rooted: true}
+            }
+            todo = append(strings.Split(target, "/"), todo...)
+            continue
+        }
+        if last {
+            return w, n, fi, nil
+        }
+        if !fi.IsDir() {
+            return nil, "", nil, Error(ERROR_ENOTDIR)
+        }
+        w.dirs = append(w.dirs, uint32(fi.inode))
+        w.names = append(w.names, n)
+    }
+    return w, "", nil, nil
+}
+
+// path returns the path of the last directory of w
+func (w *pathWalk) path(cwd string) string {
+    p := path.Join(w.names...)
+    if w.rooted {
+        return "/" + p
+    }
+    return path.Join(cwd, p)
+}
+
+// cwdWalk returns the walk from the root to the current directory
+func (c *Client) cwdWalk() (*pathWalk, error) {
+    w := &pathWalk{dirs: []uint32{MFS_ROOT_ID}, rooted: true}
+    for _, n := range strings.Split(c.cwd, "/") {
+        if n == "" {
+            continue
+        }
+        fi, err := c.lookup_inode(w.dirs[len(w.dirs)-1], n)
+        if err != nil {
+            return nil, errors.New("current directory: " + err.Error())
+        }
+        w.dirs = append(w.dirs, uint32(fi.inode))
+        w.names = append(w.names, n)
+    }
+    if w.dirs[len(w.dirs)-1] != c.curr_inode {
+        return nil, errors.New("current directory " + c.cwd + " was moved")
+    }
+    return w, nil
+}
+
+// lookup returns the attributes of name and the directory holding it.
+func (c *Client) lookup(name string, followSymlink bool) (fi *fileStat, parent uint32, err error) {
+    parent, base, fi, err := c.resolve(name, followSymlink)
+    if err != nil {
+        return nil, parent, err
+    }
+    if base == "" {
+        // a directory reached through "/", "." or ".."
+        if fi, err = c.getMasterConn().GetAttr(parent); err != nil {
+            return nil, parent, err
+        }
+        fi.name = path.Base(path.Clean("/" + name))
+    }
+    return fi, parent, nil
+}
+
+// getParent returns the directory holding name and the last element of
+// it, which may not exist.
+func (c *Client) getParent(name string) (uint32, string, error) {
+    dir, base := path.Split(strings.TrimRight(name, "/"))
+    if base == "" || base == "." || base == ".." {
+        return 0, base, Error(ERROR_EINVAL)
+    }
+    inode, _, _, err := c.resolve(dir+".", true)
+    if err != nil {
+        return 0, base, err
+    }
+    return inode, base, nil
+}
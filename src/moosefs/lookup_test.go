@@ -0,0 +1,62 @@
+package moosefs
+
+import (
+    "errors"
+    "os"
+    "syscall"
+    "testing"
+)
+
+func TestResolve(t *testing.T) {
+    c := NewClient(testMaster.Addr(), "/", false)
+    defer c.Close()
+    c.MkdirAll("/resolve/a/b", 0755)
+    defer c.RemoveAll("/resolve")
+
+    // creating through an absolute path and a path with ".."
+    writeTestFile(t, c, "/resolve/a/b/file", []byte("abc"))
+    if got, err := c.ReadFile("/resolve/a/b/../b/./file"); err != nil || string(got) != "abc" {
+        t.Error("read through ..", string(got), err)
+    }
+    if err := c.Link("/resolve/a/b/file", "/resolve/a/hard"); err != nil {
+        t.Error("link", err)
+    }
+    if fi, err := c.Stat("/resolve/a/hard"); err != nil || fi.Size() != 3 {
+        t.Error("stat link", fi, err)
+    }
+
+    // relative targets are resolved from the directory of the link, and
+    // ".." after a symlink goes to the parent of its target
+    c.Symlink("a/b", "/resolve/lb")
+    c.Symlink("b/file", "/resolve/a/lf")
+    if got, err := c.ReadFile("/resolve/a/lf"); err != nil || string(got) != "abc" {
+        t.Error("read relative symlink", string(got), err)
+    }
+    if fi, err := c.Stat("/resolve/lb/../hard"); err != nil || fi.Size() != 3 {
+        t.Error("stat .. after symlink", err)
+    }
+
+    // relative paths with ".." above the working directory
+    if err := c.Chdir("/resolve/lb"); err != nil {
+        t.Fatal("chdir", err)
+    }
+    if cwd, _ := c.Getwd(); cwd != "/resolve/a/b" {
+        t.Error("cwd after chdir through symlink", cwd)
+    }
+    if got, err := c.ReadFile("../../a/hard"); err != nil || string(got) != "abc" {
+        t.Error("read relative to cwd", string(got), err)
+    }
+    c.Chdir("/")
+
+    c.Symlink("loop2", "/resolve/loop1")
+    c.Symlink("loop1", "/resolve/loop2")
+    if _, err := c.Stat("/resolve/loop1"); err != syscall.ELOOP {
+        t.Error("symlink loop", err)
+    }
+    if _, err := c.OpenFile("/resolve/loop1", os.O_RDWR|os.O_CREATE, 0644); !errors.Is(err, syscall.ELOOP) {
+        t.Error("create through symlink loop", err)
+    }
+    if _, err := c.Stat("/resolve/a/b/file/x"); err == nil {
+        t.Error("lookup below a file")
+    }
+}
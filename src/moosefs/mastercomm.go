@@ -1,15 +1,12 @@
 package moosefs
 
 import (
-    "bytes"
     "errors"
     "io"
     "net"
-    //	"os"
     "strconv"
     "strings"
     "sync"
-    //    "fmt"
     "time"
 )
 
@@ -19,7 +16,16 @@ type MasterConn struct {
 
     uid, gid uint32
 
+    // MaxPacketSize is the largest answer accepted from the master, bigger
+    // ones are treated as a broken connection. Directory listings may be
+    // up to MaxDirPacketSize.
+    MaxPacketSize    uint32
+    MaxDirPacketSize uint32
+
     sessionid uint32
+    dial      dialFunc
+    metrics   *metrics
+    hooks     *hooks
     net.Conn
     sync.Mutex
 }
@@ -31,20 +37,40 @@ func NewMasterConn(addr, subdir string) *MasterConn {
     mc := new(MasterConn)
     mc.addr = addr
     mc.subdir = subdir
+    mc.dial = dialTCP
+    mc.MaxPacketSize = MAX_PACKET_SIZE
+    mc.MaxDirPacketSize = MAX_DIR_PACKET_SIZE
     return mc
 }
 
-func (mc *MasterConn) Connect() (err error) {
+func (mc *MasterConn) Connect() error {
+    mc.Lock()
+    defer mc.Unlock()
+    return mc.connect()
+}
+
+// connect registers a new session or reconnects the old one, the caller
+// holds the lock
+func (mc *MasterConn) connect() (err error) {
     if mc.Conn != nil {
         return nil
     }
 
     // FIXME timeout
-    mc.Conn, err = net.Dial("tcp", mc.addr)
+    start := time.Now()
+    mc.Conn, err = mc.dial(mc.addr, true)
     if err != nil {
+        mc.hooks.logger().Warn("connect to master failed", "master", mc.addr, "err", err)
         return
     }
+    reconnect := mc.sessionid != 0
     defer func() {
+        mc.metrics.request(CUTOMA_FUSE_REGISTER, time.Since(start), err)
+        if err == nil {
+            mc.hooks.logger().Info("registered to master", "master", mc.addr, "session", mc.sessionid, "reconnect", reconnect)
+        } else {
+            mc.hooks.logger().Warn("register to master failed", "master", mc.addr, "session", mc.sessionid, "err", err)
+        }
         if err != nil {
             mc.Conn.Close()
             mc.Conn = nil
@@ -52,26 +78,23 @@ func (mc *MasterConn) Connect() (err error) {
         }
     }()
 
-    var regbuf []byte
+    args := newEncoder().str(FUSE_REGISTER_BLOB_ACL)
     if mc.sessionid == 0 {
-        regbuf = pack(CUTOMA_FUSE_REGISTER, FUSE_REGISTER_BLOB_ACL, REGISTER_NEWSESSION, VERSION,
-            uint32(2), "/\000", uint32(len(mc.subdir)+1), mc.subdir+"\000")
+        args.u8(REGISTER_NEWSESSION).u32(VERSION).path("/").path(mc.subdir)
     } else {
-        regbuf = pack(CUTOMA_FUSE_REGISTER, FUSE_REGISTER_BLOB_ACL, REGISTER_RECONNECT, mc.sessionid, VERSION)
+        args.u8(REGISTER_RECONNECT).u32(mc.sessionid).u32(VERSION)
     }
-
-    if _, err = mc.Write(regbuf); err != nil {
+    if _, err = mc.Write(packet(CUTOMA_FUSE_REGISTER, args)); err != nil {
         return
     }
 
-    recv := regbuf[:8]
+    recv := make([]byte, 8)
     if _, err = mc.Read(recv); err != nil {
         return
     }
 
-    var cmd, i uint32
-    r := bytes.NewBuffer(recv)
-    read(r, &cmd, &i)
+    d := newDecoder(recv)
+    cmd, i := d.u32(), d.u32()
     if cmd != MATOCU_FUSE_REGISTER {
         err = errors.New("got incorrect answer from mfsmaster")
         return
@@ -82,25 +105,15 @@ func (mc *MasterConn) Connect() (err error) {
     }
 
     buf := make([]byte, i)
-    if n, e := mc.Read(buf); e != nil || n != int(i) {
-        if e == nil {
-            e = errors.New("mfsmaster connect: unexpected end")
-        }
-        err = e
+    if _, err = mc.Read(buf); err != nil {
         return
     }
-    if i == 1 && buf[0] != 0 {
-        err = errors.New("mfsmaster register error: " + mfs_strerror(int(buf[0])))
+    sessionid, err := decodeRegister(buf)
+    if err != nil {
         return
     }
     if mc.sessionid == 0 {
-        r = bytes.NewBuffer(buf)
-        if i < 25 {
-            read(r, &mc.sessionid)
-        } else {
-            var _t uint32
-            read(r, &_t, &mc.sessionid)
-        }
+        mc.sessionid = sessionid
         // read sesflags and uid ...
     }
     go func() {
@@ -114,7 +127,46 @@ func (mc *MasterConn) Connect() (err error) {
     return
 }
 
+// decodeRegister decodes the answer to CUTOMA_FUSE_REGISTER, the session
+// id is 0 in the answer to a reconnection.
+func decodeRegister(ans []byte) (sessionid uint32, err error) {
+    d := newDecoder(ans)
+    switch len(ans) {
+    case 1:
+        if ans[0] != 0 {
+            return 0, errors.New("mfsmaster register error: " + mfs_strerror(int(ans[0])))
+        }
+        return 0, nil
+    case 13, 21:
+        sessionid = d.u32()
+    case 25, 35:
+        d.u32() // version
+        sessionid = d.u32()
+    default:
+        return 0, errors.New("got incorrect size from mfsmaster")
+    }
+    // the rest are session flags and the uid/gid mapping
+    return sessionid, nil
+}
+
 func (mc *MasterConn) Close() {
+    mc.Lock()
+    defer mc.Unlock()
+    mc.close()
+}
+
+// setDial makes the connection go through dial from now on, with a new
+// session.
+func (mc *MasterConn) setDial(dial dialFunc) {
+    mc.Lock()
+    defer mc.Unlock()
+    mc.close()
+    mc.dial = dial
+    mc.sessionid = 0
+}
+
+// close drops the connection, the caller holds the lock
+func (mc *MasterConn) close() {
     if mc.Conn != nil {
         mc.Conn.Close()
         mc.Conn = nil
@@ -122,9 +174,7 @@ func (mc *MasterConn) Close() {
 }
 
 func (mc *MasterConn) Read(b []byte) (int, error) {
-    n, err := io.ReadFull(mc.Conn, b)
-    //    fmt.Println("<<<", b[:n])
-    return n, err
+    return io.ReadFull(mc.Conn, b)
 }
 
 func (mc *MasterConn) nop() error {
@@ -133,59 +183,94 @@ func (mc *MasterConn) nop() error {
     if mc.Conn == nil {
         return errors.New("not connected")
     }
-    msg := pack(ANTOAN_NOP, uint32(0))
+    msg := packet(ANTOAN_NOP, newEncoder().u32(0))
     if n, err := mc.Write(msg); err != nil || n != 12 {
-        mc.Close()
+        mc.hooks.logger().Debug("nop to master failed", "master", mc.addr, "err", err)
+        mc.close()
         return err
     }
     return nil
 }
 
-func (mc *MasterConn) sendAndReceive(cmd uint32, args ...interface{}) (r []byte, err error) {
+// sendAndReceive sends cmd with args to the master and returns the answer
+// without its packet id. An answer made of a non zero status is returned
+// as an Error.
+func (mc *MasterConn) sendAndReceive(cmd uint32, args *encoder) (r []byte, err error) {
     packetid := uint32(1)
-    nargs := make([]interface{}, len(args)+1)
-    nargs[0] = packetid
-    for i, a := range args {
-        nargs[i+1] = a
+    body := newEncoder().u32(packetid)
+    if args != nil {
+        if args.err != nil {
+            return nil, args.err
+        }
+        body.bytes(args.buf)
     }
-    send_bytes := pack(cmd, nargs...)
+    send_bytes := packet(cmd, body)
     mc.Lock()
     defer mc.Unlock()
+    start := time.Now()
+    defer func() {
+        mc.metrics.request(cmd, time.Since(start), err)
+    }()
+
+    op := &Op{Command: commandName(cmd), Addr: mc.addr, Inode: requestInode(cmd, body.buf[4:])}
+    err = mc.hooks.run(op, func() error {
+        r, err = mc.exchange(cmd, packetid, send_bytes)
+        if err == nil {
+            op.ChunkID = replyChunkID(cmd, r)
+        }
+        return err
+    })
+    return r, err
+}
 
+// exchange sends a request and reads its answer, reconnecting once if the
+// connection is broken. The caller holds the lock.
+func (mc *MasterConn) exchange(cmd, packetid uint32, send_bytes []byte) (r []byte, err error) {
+    log := mc.hooks.logger()
     for ii := 0; ii < 2; ii++ {
-        mc.Connect()
-        if mc.Conn == nil {
+        if ii > 0 {
+            log.Warn("master connection broken, retrying", "master", mc.addr, "command", commandName(cmd), "err", err)
+        }
+        if cerr := mc.connect(); mc.Conn == nil {
+            if cerr == nil {
+                cerr = errors.New("not connected")
+            }
+            log.Error("session lost", "master", mc.addr, "err", cerr)
             return nil, errors.New("session lost")
         }
         if _, err = mc.Write(send_bytes); err != nil {
-            mc.Close()
+            mc.close()
             continue
         }
         buf := make([]byte, 12)
         if _, err = mc.Read(buf); err != nil {
-            mc.Close()
+            mc.close()
             continue
         }
-        var rcmd, size, id uint32
-        read(bytes.NewBuffer(buf), &rcmd, &size, &id)
+        d := newDecoder(buf)
+        rcmd, size, id := d.u32(), d.u32(), d.u32()
         for rcmd == ANTOAN_NOP && size == 4 {
             if _, err = mc.Read(buf); err != nil {
-                mc.Close()
+                mc.close()
                 return nil, err
             }
-            read(bytes.NewBuffer(buf), &rcmd, &size, &id)
+            d = newDecoder(buf)
+            rcmd, size, id = d.u32(), d.u32(), d.u32()
         }
         if rcmd != cmd+1 || id != packetid {
-            mc.Close()
+            mc.close()
+            err = errors.New("unexpected answer " + strconv.Itoa(int(rcmd)) + " from master")
             continue
         }
-        if size <= 4 {
-            mc.Close()
+        if size <= 4 || size > mc.maxAnswerSize(cmd) {
+            mc.close()
+            err = errors.New("invalid answer size " + strconv.Itoa(int(size)))
             continue
         }
         buf = make([]byte, size-4)
-        if n, err := mc.Read(buf); err != nil {
-            mc.Close()
+        var n int
+        if n, err = mc.Read(buf); err != nil {
+            mc.close()
         } else {
             if n == 1 && buf[0] != 0 {
                 return nil, Error(buf[0])
@@ -199,196 +284,242 @@ func (mc *MasterConn) sendAndReceive(cmd uint32, args ...interface{}) (r []byte,
     return nil, err
 }
 
+// maxAnswerSize returns the largest answer accepted for cmd
+func (mc *MasterConn) maxAnswerSize(cmd uint32) uint32 {
+    if cmd == CUTOMA_FUSE_GETDIR && mc.MaxDirPacketSize > mc.MaxPacketSize {
+        return mc.MaxDirPacketSize
+    }
+    return mc.MaxPacketSize
+}
+
+// StatInfo is the usage of the whole cluster, in bytes, as df shows it on
+// a mount.
 type StatInfo struct {
-    totalspace    uint64
-    availspace    uint64
-    trashspace    uint64
-    reservedspace uint64
-    inodes        uint32
+    TotalSpace    uint64
+    AvailSpace    uint64
+    TrashSpace    uint64 // held by deleted files until they expire
+    ReservedSpace uint64 // held by deleted files still open
+    Inodes        uint32
 }
 
 func (mc *MasterConn) StatFS() (*StatInfo, error) {
-    ans, err := mc.sendAndReceive(CUTOMA_FUSE_STATFS)
+    ans, err := mc.sendAndReceive(CUTOMA_FUSE_STATFS, nil)
     if err != nil {
         return nil, err
     }
+    return decodeStatFS(ans)
+}
+
+func decodeStatFS(ans []byte) (*StatInfo, error) {
     var stat StatInfo
-    r := bytes.NewBuffer(ans)
-    read(r, &stat.totalspace, &stat.availspace, &stat.trashspace, &stat.reservedspace, &stat.inodes)
+    d := newDecoder(ans)
+    stat.TotalSpace = d.u64()
+    stat.AvailSpace = d.u64()
+    stat.TrashSpace = d.u64()
+    stat.ReservedSpace = d.u64()
+    stat.Inodes = d.u32()
+    if err := d.finish(); err != nil {
+        return nil, errors.New("statfs: " + err.Error())
+    }
     return &stat, nil
 }
 
 func (mc *MasterConn) Access(inode uint32, modemask uint8) (err error) {
-    _, err = mc.sendAndReceive(CUTOMA_FUSE_ACCESS, inode, mc.uid, mc.gid, modemask)
+    _, err = mc.sendAndReceive(CUTOMA_FUSE_ACCESS, newEncoder().u32(inode).u32(mc.uid).u32(mc.gid).u8(modemask))
     return err
 }
 
 func (mc *MasterConn) Lookup(parent uint32, name string) (inode uint32, attr []byte, err error) {
-    ans, err := mc.sendAndReceive(CUTOMA_FUSE_LOOKUP, parent, uint8(len(name)), name, uint32(0), uint32(0))
+    ans, err := mc.sendAndReceive(CUTOMA_FUSE_LOOKUP, newEncoder().u32(parent).name(name).u32(0).u32(0))
     if err != nil {
         return 0, nil, err
     }
-    if len(ans) == 1 {
-        return 0, nil, Error(ans[0])
+    return decodeEntry(ans)
+}
+
+// decodeEntry decodes the inode:32 attr:35B answered for a new or found
+// entry
+func decodeEntry(ans []byte) (inode uint32, attr []byte, err error) {
+    d := newDecoder(ans)
+    inode = d.u32()
+    attr = d.bytes(ATTR_SIZE)
+    if err = d.finish(); err != nil {
+        return 0, nil, errors.New("entry: " + err.Error())
     }
-    if len(ans) != 39 {
-        return 0, nil, errors.New("bad length")
+    return inode, attr, nil
+}
+
+// entryToFileInfo decodes an answer of decodeEntry into a fileStat
+func entryToFileInfo(ans []byte) (*fileStat, error) {
+    inode, attr, err := decodeEntry(ans)
+    if err != nil {
+        return nil, err
     }
-    r := bytes.NewBuffer(ans[:4])
-    read(r, &inode)
-    attr = ans[4:]
-    return
+    return attrToFileInfo(inode, attr)
 }
 
 func (mc *MasterConn) GetAttr(inode uint32) (fi *fileStat, err error) {
-    ans, err := mc.sendAndReceive(CUTOMA_FUSE_GETATTR, inode, mc.uid, mc.gid)
+    ans, err := mc.sendAndReceive(CUTOMA_FUSE_GETATTR, newEncoder().u32(inode).u32(mc.uid).u32(mc.gid))
     if err != nil {
         return nil, err
     }
-    return attrToFileInfo(inode, ans), nil
+    return attrToFileInfo(inode, ans)
 }
 
 func (mc *MasterConn) SetAttr(inode uint32, setmask uint8, mode uint16, attruid, attrgid, atime, mtime uint32) (fi *fileStat, err error) {
-    ans, err := mc.sendAndReceive(CUTOMA_FUSE_SETATTR, inode, mc.uid, mc.gid, setmask, mode, attruid, attrgid, atime, mtime)
+    ans, err := mc.sendAndReceive(CUTOMA_FUSE_SETATTR, newEncoder().u32(inode).u32(mc.uid).u32(mc.gid).
+        u8(setmask).u16(mode).u32(attruid).u32(attrgid).u32(atime).u32(mtime))
     if err != nil {
         return nil, err
     }
-    return attrToFileInfo(inode, ans), nil
+    return attrToFileInfo(inode, ans)
 }
 
 func (mc *MasterConn) Truncate(inode uint32, opened uint8, length int64) (fi *fileStat, err error) {
-    ans, err := mc.sendAndReceive(CUTOMA_FUSE_TRUNCATE, inode, opened, mc.uid, mc.gid, length)
+    ans, err := mc.sendAndReceive(CUTOMA_FUSE_TRUNCATE, newEncoder().u32(inode).u8(opened).u32(mc.uid).u32(mc.gid).u64(uint64(length)))
     if err != nil {
         return nil, err
     }
-    return attrToFileInfo(inode, ans), nil
+    return attrToFileInfo(inode, ans)
 }
 
 func (mc *MasterConn) ReadLink(inode uint32) (path string, err error) {
-    ans, err := mc.sendAndReceive(CUTOMA_FUSE_READLINK, inode)
+    ans, err := mc.sendAndReceive(CUTOMA_FUSE_READLINK, newEncoder().u32(inode))
     if err != nil {
         return
     }
-    var length uint32
-    read(bytes.NewBuffer(ans[:4]), &length)
-    if int(length+4) != len(ans) {
-        return "", errors.New("invalid length")
+    return decodePath(ans)
+}
+
+// decodePath decodes length:32 path:lengthB, the path ends with \0
+func decodePath(ans []byte) (string, error) {
+    d := newDecoder(ans)
+    path := d.path()
+    if err := d.finish(); err != nil {
+        return "", errors.New("path: " + err.Error())
     }
-    return string(ans[4 : 4+length-1]), nil // path is ending with \000
+    return path, nil
 }
 
 func (mc *MasterConn) Symlink(parent uint32, name, path string) (fi *fileStat, err error) {
-    ans, err := mc.sendAndReceive(CUTOMA_FUSE_SYMLINK, parent, uint8(len(name)), name,
-        uint32(len(path)+1), path, "\000", mc.uid, mc.gid)
+    ans, err := mc.sendAndReceive(CUTOMA_FUSE_SYMLINK, newEncoder().u32(parent).name(name).
+        path(path).u32(mc.uid).u32(mc.gid))
     if err != nil {
         return
     }
-    if len(ans) != 39 {
-        return nil, errors.New("invalid length")
-    }
-    var inode uint32
-    read(bytes.NewBuffer(ans[:4]), &inode)
-    return attrToFileInfo(inode, ans[4:]), nil
+    return entryToFileInfo(ans)
 }
 
 func (mc *MasterConn) Mknod(parent uint32, name string, type_ uint8, mode uint16, rdev uint32) (fi *fileStat, err error) {
-    ans, err := mc.sendAndReceive(CUTOMA_FUSE_MKNOD, parent, uint8(len(name)), name, type_, mode, mc.uid, mc.gid, rdev)
+    ans, err := mc.sendAndReceive(CUTOMA_FUSE_MKNOD, newEncoder().u32(parent).name(name).
+        u8(type_).u16(mode).u32(mc.uid).u32(mc.gid).u32(rdev))
     if err != nil {
         return
     }
-    if len(ans) != 39 {
-        return nil, errors.New("invalid length")
-    }
-    var inode uint32
-    read(bytes.NewBuffer(ans[:4]), &inode)
-    return attrToFileInfo(inode, ans[4:]), nil
+    return entryToFileInfo(ans)
 }
 
 func (mc *MasterConn) Mkdir(parent uint32, name string, mode uint16) (fi *fileStat, err error) {
-    ans, err := mc.sendAndReceive(CUTOMA_FUSE_MKDIR, parent, uint8(len(name)), name, mode, mc.uid, mc.gid)
+    ans, err := mc.sendAndReceive(CUTOMA_FUSE_MKDIR, newEncoder().u32(parent).name(name).
+        u16(mode).u32(mc.uid).u32(mc.gid))
     if err != nil {
         return
     }
-    if len(ans) != 39 {
-        return nil, errors.New("invalid length")
-    }
-    var inode uint32
-    read(bytes.NewBuffer(ans[:4]), &inode)
-    return attrToFileInfo(inode, ans[4:]), nil
+    return entryToFileInfo(ans)
 }
 
 func (mc *MasterConn) Unlink(parent uint32, name string) error {
-    _, err := mc.sendAndReceive(CUTOMA_FUSE_UNLINK, parent, uint8(len(name)), name, mc.uid, mc.gid)
+    _, err := mc.sendAndReceive(CUTOMA_FUSE_UNLINK, newEncoder().u32(parent).name(name).u32(mc.uid).u32(mc.gid))
     return err
 }
 
 func (mc *MasterConn) Rmdir(parent uint32, name string) error {
-    _, err := mc.sendAndReceive(CUTOMA_FUSE_RMDIR, parent, uint8(len(name)), name, mc.uid, mc.gid)
+    _, err := mc.sendAndReceive(CUTOMA_FUSE_RMDIR, newEncoder().u32(parent).name(name).u32(mc.uid).u32(mc.gid))
     return err
 }
 
 func (mc *MasterConn) Rename(parent_src uint32, name_src string, parent_dst uint32, name_dst string) error {
-    _, err := mc.sendAndReceive(CUTOMA_FUSE_RENAME, parent_src, uint8(len(name_src)), name_src,
-        parent_dst, uint8(len(name_dst)), name_dst, mc.uid, mc.gid)
+    _, err := mc.sendAndReceive(CUTOMA_FUSE_RENAME, newEncoder().u32(parent_src).name(name_src).
+        u32(parent_dst).name(name_dst).u32(mc.uid).u32(mc.gid))
     return err
 }
 
 func (mc *MasterConn) Link(inode_src, parent_dst uint32, name_dst string) (inode uint32, attr []byte, err error) {
-    ans, err := mc.sendAndReceive(CUTOMA_FUSE_LINK, inode_src, parent_dst, uint8(len(name_dst)), name_dst, mc.uid, mc.gid)
-    if len(ans) != 39 {
-        return 0, nil, errors.New("invalid length")
+    ans, err := mc.sendAndReceive(CUTOMA_FUSE_LINK, newEncoder().u32(inode_src).u32(parent_dst).
+        name(name_dst).u32(mc.uid).u32(mc.gid))
+    if err != nil {
+        return 0, nil, err
     }
-    read(bytes.NewBuffer(ans[:4]), &inode)
-    attr = ans[4:]
-    return
+    return decodeEntry(ans)
 }
 
 func (mc *MasterConn) GetDir(inode uint32) (names []string, err error) {
-    ans, err := mc.sendAndReceive(CUTOMA_FUSE_GETDIR, inode, mc.uid, mc.gid)
+    ans, err := mc.getDir(inode, 0)
     if err != nil {
         return nil, err
     }
-    r := bytes.NewBuffer(ans)
-    for r.Len() > 0 {
-        var length, type_ uint8
-        var inode uint32
-        read(r, &length)
-        if r.Len() < int(length+5) {
-            break
+    for len(ans) > 0 {
+        var name string
+        if name, _, _, ans, err = nextDirEntry(ans, false); err != nil {
+            return names, err
         }
-        name := make([]byte, length)
-        r.Read(name)
-        read(r, &inode, &type_)
-        names = append(names, string(name))
+        names = append(names, name)
     }
-    return
+    return names, nil
 }
 
 func (mc *MasterConn) GetDirPlus(inode uint32) (info []*fileStat, err error) {
-    ans, err := mc.sendAndReceive(CUTOMA_FUSE_GETDIR, inode, mc.uid, mc.gid, uint8(GETDIR_FLAG_WITHATTR))
+    ans, err := mc.getDir(inode, GETDIR_FLAG_WITHATTR)
     if err != nil {
         return nil, err
     }
-    r := bytes.NewBuffer(ans)
-    for r.Len() > 0 {
-        var length uint8
+    for len(ans) > 0 {
+        var name string
         var inode uint32
-        read(r, &length)
-        if r.Len() < int(length+39) {
-            break
+        var attr []byte
+        if name, inode, attr, ans, err = nextDirEntry(ans, true); err != nil {
+            return info, err
         }
-        name := make([]byte, length)
-        attr := make([]byte, 35)
-        r.Read(name)
-        read(r, &inode)
-        r.Read(attr)
-        info = append(info, newFileInfo(string(name), inode, attr))
+        fi, err := newFileInfo(name, inode, attr)
+        if err != nil {
+            return info, err
+        }
+        info = append(info, fi)
     }
-    return
+    return info, nil
+}
+
+// getDir returns the listing of a directory undecoded. There is no paged
+// form of GETDIR in this version of the protocol, the master always sends
+// the whole directory in one packet.
+func (mc *MasterConn) getDir(inode uint32, flags uint8) ([]byte, error) {
+    args := newEncoder().u32(inode).u32(mc.uid).u32(mc.gid)
+    if flags != 0 {
+        args.u8(flags)
+    }
+    return mc.sendAndReceive(CUTOMA_FUSE_GETDIR, args)
+}
+
+// nextDirEntry decodes the first entry of a GETDIR answer and returns the
+// rest. attr is the 35 bytes of attributes, or only the type byte if the
+// listing was asked for without GETDIR_FLAG_WITHATTR.
+func nextDirEntry(ans []byte, withattr bool) (name string, inode uint32, attr, rest []byte, err error) {
+    alen := 1
+    if withattr {
+        alen = ATTR_SIZE
+    }
+    d := newDecoder(ans)
+    name = d.name()
+    inode = d.u32()
+    attr = d.bytes(alen)
+    if d.err != nil {
+        return "", 0, nil, nil, errors.New("getdir: truncated entry")
+    }
+    return name, inode, attr, d.buf, nil
 }
 
 func (mc *MasterConn) OpenCheck(inode uint32, flag uint8) (attr []byte, err error) {
-    ans, err := mc.sendAndReceive(CUTOMA_FUSE_OPEN, inode, mc.uid, mc.gid, flag)
+    ans, err := mc.sendAndReceive(CUTOMA_FUSE_OPEN, newEncoder().u32(inode).u32(mc.uid).u32(mc.gid).u8(flag))
     if err != nil {
         return nil, err
     }
@@ -400,38 +531,49 @@ func (mc *MasterConn) Release(inode uint32) error {
 }
 
 func (mc *MasterConn) ReadChunk(inode uint32, indx uint32) (info *Chunk, err error) {
-    ans, err := mc.sendAndReceive(CUTOMA_FUSE_READ_CHUNK, inode, indx)
+    ans, err := mc.sendAndReceive(CUTOMA_FUSE_READ_CHUNK, newEncoder().u32(inode).u32(indx))
     if err != nil {
         return nil, err
     }
-    n := len(ans)
-    if n < 20 || (n-20)%6 != 0 {
-        return nil, errors.New("read chunk: invalid length: " + strconv.Itoa(n))
+    if info, err = decodeChunk(ans); err != nil {
+        return nil, errors.New("read chunk: " + err.Error())
     }
-    info = new(Chunk)
-    r := bytes.NewBuffer(ans)
-    read(r, &info.length, &info.id, &info.version)
-    info.csdata = ans[20:]
+    info.indx = indx
     return info, nil
 }
 
 func (mc *MasterConn) WriteChunk(inode, indx uint32) (*Chunk, error) {
-    ans, err := mc.sendAndReceive(CUTOMA_FUSE_WRITE_CHUNK, inode, indx)
+    ans, err := mc.sendAndReceive(CUTOMA_FUSE_WRITE_CHUNK, newEncoder().u32(inode).u32(indx))
     if err != nil {
         return nil, err
     }
-    if len(ans) < 20 || (len(ans)-20)%6 != 0 {
-        return nil, errors.New("invalid length")
+    info, err := decodeChunk(ans)
+    if err != nil {
+        return nil, errors.New("write chunk: " + err.Error())
+    }
+    info.indx = indx
+    return info, nil
+}
+
+// decodeChunk decodes length:64 chunkid:64 version:32 N*[ip:32 port:16]
+func decodeChunk(ans []byte) (*Chunk, error) {
+    info := new(Chunk)
+    d := newDecoder(ans)
+    info.length = d.u64()
+    info.id = d.u64()
+    info.version = d.u32()
+    if d.err == nil && d.left()%6 != 0 {
+        return nil, errors.New("invalid length: " + strconv.Itoa(len(ans)))
+    }
+    info.csdata = d.bytes(d.left())
+    if err := d.finish(); err != nil {
+        return nil, err
     }
-    var info Chunk
-    r := bytes.NewBuffer(ans)
-    read(r, &info.length, &info.id, &info.version)
-    info.csdata = ans[20:]
-    return &info, nil
+    return info, nil
 }
 
 func (mc *MasterConn) WriteEnd(chunkid uint64, inode uint32, length uint64) error {
-    _, err := mc.sendAndReceive(CUTOMA_FUSE_WRITE_CHUNK_END, chunkid, inode, length)
+    _, err := mc.sendAndReceive(CUTOMA_FUSE_WRITE_CHUNK_END, newEncoder().u64(chunkid).u32(inode).u64(length))
     return err
 }
 
@@ -445,6 +587,9 @@ func NewMasterMetaConn(addr string) *MasterMetaConn {
     }
     mc := new(MasterMetaConn)
     mc.addr = addr
+    mc.dial = dialTCP
+    mc.MaxPacketSize = MAX_PACKET_SIZE
+    mc.MaxDirPacketSize = MAX_DIR_PACKET_SIZE
     return mc
 }
 
@@ -454,57 +599,55 @@ func (mc *MasterMetaConn) Connect() (err error) {
 }
 
 func (mc *MasterMetaConn) GetReserved() ([]byte, error) {
-    return mc.sendAndReceive(CUTOMA_FUSE_GETRESERVED)
+    return mc.sendAndReceive(CUTOMA_FUSE_GETRESERVED, nil)
 }
 
 func (mc *MasterMetaConn) GetTrash() (map[uint32]string, error) {
-    ans, err := mc.sendAndReceive(CUTOMA_FUSE_GETTRASH)
+    ans, err := mc.sendAndReceive(CUTOMA_FUSE_GETTRASH, nil)
     if err != nil {
         return nil, err
     }
+    return decodeTrash(ans)
+}
+
+// decodeTrash decodes N*[name:NAME inode:32]
+func decodeTrash(ans []byte) (map[uint32]string, error) {
     rs := make(map[uint32]string)
-    var inode uint32
-    for len(ans) > 0 {
-        kl := int(ans[0])
-        if len(ans) < kl+5 {
-            break
+    d := newDecoder(ans)
+    for d.left() > 0 {
+        name := d.name()
+        inode := d.u32()
+        if d.err != nil {
+            return nil, errors.New("trash: " + d.err.Error())
         }
-        name := string(ans[1 : kl+1])
-        read(bytes.NewBuffer(ans[1+kl:1+kl+4]), &inode)
         rs[inode] = name
-        ans = ans[kl+5:]
     }
     return rs, nil
 }
 
 func (mc *MasterMetaConn) GetDetachedAttr(inode uint32) (attr []byte, err error) {
-    return mc.sendAndReceive(CUTOMA_FUSE_GETDETACHEDATTR, inode)
+    return mc.sendAndReceive(CUTOMA_FUSE_GETDETACHEDATTR, newEncoder().u32(inode))
 }
 
 func (mc *MasterMetaConn) GetTrashPath(inode uint32) (string, error) {
-    ans, err := mc.sendAndReceive(CUTOMA_FUSE_GETTRASHPATH, inode)
+    ans, err := mc.sendAndReceive(CUTOMA_FUSE_GETTRASHPATH, newEncoder().u32(inode))
     if err != nil {
         return "", err
     }
-    var l uint32
-    read(bytes.NewBuffer(ans[:4]), &l)
-    if len(ans) != int(l+4) {
-        return "", errors.New("length not match")
-    }
-    return string(ans[4:]), nil
+    return decodePath(ans)
 }
 
 func (mc *MasterMetaConn) SetTrashPath(inode uint32, path string) error {
-    _, err := mc.sendAndReceive(CUTOMA_FUSE_SETTRASHPATH, inode, uint32(len(path)+1), path, "\000")
+    _, err := mc.sendAndReceive(CUTOMA_FUSE_SETTRASHPATH, newEncoder().u32(inode).path(path))
     return err
 }
 
 func (mc *MasterMetaConn) Undel(inode uint32) error {
-    _, err := mc.sendAndReceive(CUTOMA_FUSE_UNDEL, inode)
+    _, err := mc.sendAndReceive(CUTOMA_FUSE_UNDEL, newEncoder().u32(inode))
     return err
 }
 
 func (mc *MasterMetaConn) Purge(inode uint32) error {
-    _, err := mc.sendAndReceive(CUTOMA_FUSE_PURGE, inode)
+    _, err := mc.sendAndReceive(CUTOMA_FUSE_PURGE, newEncoder().u32(inode))
     return err
 }
@@ -1,11 +1,14 @@
 package moosefs
 
-import "testing"
+import (
+    "sync"
+    "testing"
+)
 
 const testname = "test123"
 
 func TestMasterConn(t *testing.T) {
-    mc := NewMasterConn("mfsmaster", "/")
+    mc := NewMasterConn(testMaster.Addr(), "/")
     e := mc.Connect()
     if e != nil {
         t.Error("fs_connect failed", e)
@@ -40,7 +43,7 @@ func TestMasterConn(t *testing.T) {
         //t.Log("dir of /", info)
     }
 
-    if stat, err := mc.StatFS(); err != nil || stat.inodes == 0 {
+    if stat, err := mc.StatFS(); err != nil || stat.Inodes == 0 {
         t.Error("stats failed", err)
     } else {
         //t.Log("stat info", stat)
@@ -150,3 +153,176 @@ func TestMasterConn(t *testing.T) {
 
     mc.Close()
 }
+
+func testAttr(type_ uint8, length uint64) []byte {
+    return newEncoder().u8(type_).u16(0755).u32(1).u32(2).u32(3).u32(4).u32(5).u32(1).u64(length).buf
+}
+
+func FuzzDecodeRegister(f *testing.F) {
+    f.Add([]byte{0})
+    f.Add([]byte{ERROR_REGISTER})
+    f.Add(newEncoder().u32(VERSION).u32(7).u8(0).u32(0).u32(0).u32(0).u32(0).buf)
+    f.Add(make([]byte, 13))
+    f.Fuzz(func(t *testing.T, ans []byte) {
+        decodeRegister(ans)
+    })
+}
+
+func FuzzDecodeStatFS(f *testing.F) {
+    f.Add(newEncoder().u64(100).u64(50).u64(1).u64(2).u32(10).buf)
+    f.Add(make([]byte, 28))
+    f.Fuzz(func(t *testing.T, ans []byte) {
+        if stat, err := decodeStatFS(ans); err == nil && (stat == nil || len(ans) != 36) {
+            t.Error("accepted", len(ans))
+        }
+    })
+}
+
+func FuzzDecodeEntry(f *testing.F) {
+    f.Add(newEncoder().u32(2).bytes(testAttr(TYPE_FILE, 5)).buf)
+    f.Add(newEncoder().u32(2).bytes(testAttr(TYPE_DIRECTORY, 0)).buf[:20])
+    f.Fuzz(func(t *testing.T, ans []byte) {
+        inode, attr, err := decodeEntry(ans)
+        if err != nil {
+            return
+        }
+        fi, err := attrToFileInfo(inode, attr)
+        if err != nil || uint32(fi.inode) != inode {
+            t.Error("decode attr", err)
+        }
+        if _, err := entryToFileInfo(ans); err != nil {
+            t.Error("entry", err)
+        }
+    })
+}
+
+func FuzzAttrToFileInfo(f *testing.F) {
+    for _, type_ := range []uint8{TYPE_FILE, TYPE_DIRECTORY, TYPE_SYMLINK, TYPE_FIFO, 0} {
+        f.Add(testAttr(type_, 1<<40))
+    }
+    f.Add([]byte{TYPE_FILE})
+    f.Fuzz(func(t *testing.T, attr []byte) {
+        fi, err := attrToFileInfo(1, attr)
+        if (err == nil) != (len(attr) == ATTR_SIZE) || (err == nil && fi == nil) {
+            t.Error("length check", len(attr), err)
+        }
+    })
+}
+
+func FuzzDecodePath(f *testing.F) {
+    f.Add(newEncoder().path("target").buf)
+    f.Add(newEncoder().u32(0).buf)
+    f.Add(newEncoder().u32(100).str("short").buf)
+    f.Fuzz(func(t *testing.T, ans []byte) {
+        if p, err := decodePath(ans); err == nil && len(p)+4 > len(ans) {
+            t.Error("path longer than the answer", len(p), len(ans))
+        }
+    })
+}
+
+func FuzzNextDirEntry(f *testing.F) {
+    f.Add(newEncoder().name(".").u32(1).u8(TYPE_DIRECTORY).name("file").u32(2).u8(TYPE_FILE).buf, false)
+    f.Add(newEncoder().name("file").u32(2).bytes(testAttr(TYPE_FILE, 5)).buf, true)
+    f.Add([]byte{200, 'a'}, false)
+    f.Fuzz(func(t *testing.T, ans []byte, withattr bool) {
+        for len(ans) > 0 {
+            _, _, attr, rest, err := nextDirEntry(ans, withattr)
+            if err != nil {
+                return
+            }
+            if len(rest) >= len(ans) {
+                t.Fatal("no progress")
+            }
+            if withattr {
+                if _, err := attrToFileInfo(1, attr); err != nil {
+                    t.Error("attr", err)
+                }
+            } else if len(attr) != 1 {
+                t.Error("type", attr)
+            }
+            ans = rest
+        }
+    })
+}
+
+func FuzzDecodeChunk(f *testing.F) {
+    f.Add(newEncoder().u64(5).u64(1).u32(1).u32(0x7f000001).u16(9422).buf)
+    f.Add(newEncoder().u64(5).u64(0).u32(0).buf)
+    f.Add(newEncoder().u64(5).u64(1).u32(1).u16(1).buf)
+    f.Fuzz(func(t *testing.T, ans []byte) {
+        info, err := decodeChunk(ans)
+        if err != nil {
+            return
+        }
+        if len(info.csdata)%6 != 0 || len(info.csdata)+20 != len(ans) {
+            t.Error("locations", len(info.csdata), len(ans))
+        }
+    })
+}
+
+func FuzzDecodeTrash(f *testing.F) {
+    f.Add(newEncoder().name("a/b").u32(3).name("c").u32(4).buf)
+    f.Add([]byte{5, 'a'})
+    f.Fuzz(func(t *testing.T, ans []byte) {
+        decodeTrash(ans)
+    })
+}
+
+// TestMasterConnClose closes the connection while requests are sent on it
+func TestMasterConnClose(t *testing.T) {
+    mc := NewMasterConn(testMaster.Addr(), "/")
+    defer mc.Close()
+    var wg sync.WaitGroup
+    for i := 0; i < 4; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for j := 0; j < 20; j++ {
+                if _, err := mc.GetAttr(MFS_ROOT_ID); err != nil {
+                    t.Error("getattr", err)
+                    return
+                }
+            }
+        }()
+    }
+    for j := 0; j < 20; j++ {
+        mc.Close()
+        mc.Connect()
+    }
+    wg.Wait()
+}
+
+func TestMaxPacketSize(t *testing.T) {
+    mc := NewMasterConn(testMaster.Addr(), "/")
+    defer mc.Close()
+    // packetid:32 and the attributes
+    mc.MaxPacketSize = 4 + ATTR_SIZE
+    if _, err := mc.GetAttr(MFS_ROOT_ID); err != nil {
+        t.Error("answer of the largest size", err)
+    }
+    mc.MaxPacketSize = 4 + ATTR_SIZE - 1
+    if _, err := mc.GetAttr(MFS_ROOT_ID); err == nil {
+        t.Error("answer over the limit accepted")
+    }
+
+    // listings have a limit of their own
+    mc.MaxPacketSize = 5
+    if _, err := mc.GetDirPlus(MFS_ROOT_ID); err != nil {
+        t.Error("listing over the limit of other answers", err)
+    }
+    mc.MaxDirPacketSize = 5
+    if _, err := mc.GetDirPlus(MFS_ROOT_ID); err == nil {
+        t.Error("listing over the limit accepted")
+    }
+}
+
+func TestMasterMetaConn(t *testing.T) {
+    mc := NewMasterMetaConn(testMaster.Addr())
+    defer mc.Close()
+    if err := mc.Connect(); err != nil {
+        t.Fatal("connect", err)
+    }
+    if _, err := mc.StatFS(); err != nil {
+        t.Error("statfs", err)
+    }
+}
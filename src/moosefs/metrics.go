@@ -0,0 +1,337 @@
+package moosefs
+
+import (
+    "fmt"
+    "io"
+    "sort"
+    "strconv"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// upper bounds of the buckets of the latency histograms, in seconds
+var LATENCY_BUCKETS = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Histogram counts observations in buckets, Counts[i] are the ones not
+// above Bounds[i] and the last count is for the rest.
+type Histogram struct {
+    Bounds []float64
+    Counts []uint64
+    Sum    float64
+    Count  uint64
+}
+
+func (h *Histogram) observe(v float64) {
+    if h.Counts == nil {
+        h.Bounds = LATENCY_BUCKETS
+        h.Counts = make([]uint64, len(h.Bounds)+1)
+    }
+    h.Counts[sort.SearchFloat64s(h.Bounds, v)]++
+    h.Sum += v
+    h.Count++
+}
+
+func (h Histogram) copy() Histogram {
+    h.Counts = append([]uint64(nil), h.Counts...)
+    return h
+}
+
+// CommandMetrics are the requests of one kind sent to the master.
+type CommandMetrics struct {
+    Requests uint64
+    Errors   uint64    // failed requests, including error statuses
+    Latency  Histogram // in seconds
+}
+
+// ChunkServerMetrics are the block operations done with one chunkserver.
+type ChunkServerMetrics struct {
+    ReadBytes     uint64
+    ReadBlocks    uint64
+    WrittenBytes  uint64
+    WrittenBlocks uint64
+    Errors        uint64 // failed reads and writes
+    CRCErrors     uint64
+    Retries       uint64 // operations done again after failing with it
+}
+
+// Metrics is a snapshot of the activity of a client.
+type Metrics struct {
+    Master       map[string]*CommandMetrics     // by command, like "LOOKUP"
+    ChunkServers map[string]*ChunkServerMetrics // by address
+
+    OpenFiles         int64
+    PooledConns       int // idle connections to chunkservers, of all clients
+    InodeCacheEntries int
+    InodeCacheBytes   int64
+    BlockCacheBytes   int64
+    ChunkCacheEntries int
+}
+
+// metrics collects the counters of a client, a nil *metrics ignores them.
+type metrics struct {
+    mutex      sync.Mutex
+    master     map[uint32]*CommandMetrics
+    cs         map[string]*ChunkServerMetrics
+    open_files int64
+}
+
+func newMetrics() *metrics {
+    return &metrics{
+        master: make(map[uint32]*CommandMetrics),
+        cs:     make(map[string]*ChunkServerMetrics),
+    }
+}
+
+// request counts a request to the master which took d
+func (m *metrics) request(cmd uint32, d time.Duration, err error) {
+    if m == nil {
+        return
+    }
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+    cm, ok := m.master[cmd]
+    if !ok {
+        cm = new(CommandMetrics)
+        m.master[cmd] = cm
+    }
+    cm.Requests++
+    if err != nil {
+        cm.Errors++
+    }
+    cm.Latency.observe(d.Seconds())
+}
+
+// chunkServer updates the counters of the chunkserver at addr with f
+func (m *metrics) chunkServer(addr string, f func(*ChunkServerMetrics)) {
+    if m == nil {
+        return
+    }
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+    csm, ok := m.cs[addr]
+    if !ok {
+        csm = new(ChunkServerMetrics)
+        m.cs[addr] = csm
+    }
+    f(csm)
+}
+
+// blockOp counts a read or a write of n bytes from offset in a chunk
+func (m *metrics) blockOp(addr string, write bool, offset uint32, n int, err error) {
+    m.chunkServer(addr, func(csm *ChunkServerMetrics) {
+        if n > 0 {
+            blocks := uint64((offset+uint32(n)-1)/MFS_BLOCK_SIZE - offset/MFS_BLOCK_SIZE + 1)
+            if write {
+                csm.WrittenBytes += uint64(n)
+                csm.WrittenBlocks += blocks
+            } else {
+                csm.ReadBytes += uint64(n)
+                csm.ReadBlocks += blocks
+            }
+        }
+        if err != nil {
+            csm.Errors++
+            if err == errCRC || err == Error(ERROR_CRC) {
+                csm.CRCErrors++
+            }
+        }
+    })
+}
+
+// retry counts an operation done again after failing with addr
+func (m *metrics) retry(addr string) {
+    m.chunkServer(addr, func(csm *ChunkServerMetrics) {
+        csm.Retries++
+    })
+}
+
+func (m *metrics) openFile(delta int64) {
+    if m != nil {
+        atomic.AddInt64(&m.open_files, delta)
+    }
+}
+
+// Metrics returns the counters of the client so far.
+func (c *Client) Metrics() *Metrics {
+    ms := &Metrics{
+        Master:       make(map[string]*CommandMetrics),
+        ChunkServers: make(map[string]*ChunkServerMetrics),
+    }
+    m := c.metrics
+    m.mutex.Lock()
+    for cmd, cm := range m.master {
+        cp := *cm
+        cp.Latency = cm.Latency.copy()
+        ms.Master[commandName(cmd)] = &cp
+    }
+    for addr, csm := range m.cs {
+        cp := *csm
+        ms.ChunkServers[addr] = &cp
+    }
+    m.mutex.Unlock()
+
+    ms.OpenFiles = atomic.LoadInt64(&m.open_files)
+    mutex.Lock()
+    for _, conns := range pool {
+        ms.PooledConns += len(conns)
+    }
+    mutex.Unlock()
+    stats := c.inode_cache.getStats()
+    ms.InodeCacheEntries, ms.InodeCacheBytes = stats.Entries, stats.Bytes
+    if c.bcache != nil {
+        ms.BlockCacheBytes = c.bcache.Size()
+    }
+    c.chunks.Lock()
+    ms.ChunkCacheEntries = c.chunks.count
+    c.chunks.Unlock()
+    return ms
+}
+
+// names of the requests to the master
+var commandNames = map[uint32]string{
+    CUTOMA_FUSE_REGISTER:        "REGISTER",
+    CUTOMA_FUSE_STATFS:          "STATFS",
+    CUTOMA_FUSE_ACCESS:          "ACCESS",
+    CUTOMA_FUSE_LOOKUP:          "LOOKUP",
+    CUTOMA_FUSE_GETATTR:         "GETATTR",
+    CUTOMA_FUSE_SETATTR:         "SETATTR",
+    CUTOMA_FUSE_READLINK:        "READLINK",
+    CUTOMA_FUSE_SYMLINK:         "SYMLINK",
+    CUTOMA_FUSE_MKNOD:           "MKNOD",
+    CUTOMA_FUSE_MKDIR:           "MKDIR",
+    CUTOMA_FUSE_UNLINK:          "UNLINK",
+    CUTOMA_FUSE_RMDIR:           "RMDIR",
+    CUTOMA_FUSE_RENAME:          "RENAME",
+    CUTOMA_FUSE_LINK:            "LINK",
+    CUTOMA_FUSE_GETDIR:          "GETDIR",
+    CUTOMA_FUSE_OPEN:            "OPEN",
+    CUTOMA_FUSE_READ_CHUNK:      "READ_CHUNK",
+    CUTOMA_FUSE_WRITE_CHUNK:     "WRITE_CHUNK",
+    CUTOMA_FUSE_WRITE_CHUNK_END: "WRITE_CHUNK_END",
+    CUTOMA_FUSE_GETTRASH:        "GETTRASH",
+    CUTOMA_FUSE_GETDETACHEDATTR: "GETDETACHEDATTR",
+    CUTOMA_FUSE_GETTRASHPATH:    "GETTRASHPATH",
+    CUTOMA_FUSE_SETTRASHPATH:    "SETTRASHPATH",
+    CUTOMA_FUSE_UNDEL:           "UNDEL",
+    CUTOMA_FUSE_PURGE:           "PURGE",
+    CUTOMA_FUSE_TRUNCATE:        "TRUNCATE",
+    CUTOMA_FUSE_GETRESERVED:     "GETRESERVED",
+}
+
+func commandName(cmd uint32) string {
+    if name, ok := commandNames[cmd]; ok {
+        return name
+    }
+    return strconv.FormatUint(uint64(cmd), 10)
+}
+
+// WritePrometheus writes the metrics in the text format of Prometheus.
+func (ms *Metrics) WritePrometheus(w io.Writer) error {
+    pw := &promWriter{w: w}
+
+    cmds := make([]string, 0, len(ms.Master))
+    for cmd := range ms.Master {
+        cmds = append(cmds, cmd)
+    }
+    sort.Strings(cmds)
+    pw.header("mfs_master_requests_total", "counter", "Requests sent to the master.")
+    for _, cmd := range cmds {
+        pw.sample("mfs_master_requests_total", "command", cmd, "", "", float64(ms.Master[cmd].Requests))
+    }
+    pw.header("mfs_master_request_errors_total", "counter", "Requests to the master which failed.")
+    for _, cmd := range cmds {
+        pw.sample("mfs_master_request_errors_total", "command", cmd, "", "", float64(ms.Master[cmd].Errors))
+    }
+    pw.header("mfs_master_request_duration_seconds", "histogram", "Latency of the requests to the master.")
+    for _, cmd := range cmds {
+        h := ms.Master[cmd].Latency
+        var cum uint64
+        for i, c := range h.Counts {
+            cum += c
+            le := "+Inf"
+            if i < len(h.Bounds) {
+                le = strconv.FormatFloat(h.Bounds[i], 'g', -1, 64)
+            }
+            pw.sample("mfs_master_request_duration_seconds_bucket", "command", cmd, "le", le, float64(cum))
+        }
+        pw.sample("mfs_master_request_duration_seconds_sum", "command", cmd, "", "", h.Sum)
+        pw.sample("mfs_master_request_duration_seconds_count", "command", cmd, "", "", float64(h.Count))
+    }
+
+    addrs := make([]string, 0, len(ms.ChunkServers))
+    for addr := range ms.ChunkServers {
+        addrs = append(addrs, addr)
+    }
+    sort.Strings(addrs)
+    for _, c := range []struct {
+        name, help string
+        value      func(*ChunkServerMetrics) uint64
+    }{
+        {"mfs_chunkserver_read_bytes_total", "Bytes read from the chunkserver.",
+            func(m *ChunkServerMetrics) uint64 { return m.ReadBytes }},
+        {"mfs_chunkserver_read_blocks_total", "Blocks read from the chunkserver.",
+            func(m *ChunkServerMetrics) uint64 { return m.ReadBlocks }},
+        {"mfs_chunkserver_written_bytes_total", "Bytes written to the chunkserver.",
+            func(m *ChunkServerMetrics) uint64 { return m.WrittenBytes }},
+        {"mfs_chunkserver_written_blocks_total", "Blocks written to the chunkserver.",
+            func(m *ChunkServerMetrics) uint64 { return m.WrittenBlocks }},
+        {"mfs_chunkserver_errors_total", "Failed reads and writes with the chunkserver.",
+            func(m *ChunkServerMetrics) uint64 { return m.Errors }},
+        {"mfs_chunkserver_crc_errors_total", "CRC errors of the chunkserver.",
+            func(m *ChunkServerMetrics) uint64 { return m.CRCErrors }},
+        {"mfs_chunkserver_retries_total", "Operations retried after failing with the chunkserver.",
+            func(m *ChunkServerMetrics) uint64 { return m.Retries }},
+    } {
+        pw.header(c.name, "counter", c.help)
+        for _, addr := range addrs {
+            pw.sample(c.name, "server", addr, "", "", float64(c.value(ms.ChunkServers[addr])))
+        }
+    }
+
+    for _, g := range []struct {
+        name, help string
+        value      float64
+    }{
+        {"mfs_open_files", "Files opened and not closed.", float64(ms.OpenFiles)},
+        {"mfs_pooled_conns", "Idle connections to chunkservers.", float64(ms.PooledConns)},
+        {"mfs_inode_cache_entries", "Entries of the inode cache.", float64(ms.InodeCacheEntries)},
+        {"mfs_inode_cache_bytes", "Bytes used by the inode cache.", float64(ms.InodeCacheBytes)},
+        {"mfs_block_cache_bytes", "Bytes used by the block cache.", float64(ms.BlockCacheBytes)},
+        {"mfs_chunk_cache_entries", "Chunk locations in the cache.", float64(ms.ChunkCacheEntries)},
+    } {
+        pw.header(g.name, "gauge", g.help)
+        pw.sample(g.name, "", "", "", "", g.value)
+    }
+    return pw.err
+}
+
+type promWriter struct {
+    w   io.Writer
+    err error
+}
+
+func (pw *promWriter) printf(format string, args ...interface{}) {
+    if pw.err == nil {
+        _, pw.err = fmt.Fprintf(pw.w, format, args...)
+    }
+}
+
+func (pw *promWriter) header(name, typ, help string) {
+    pw.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes a value with up to two labels
+func (pw *promWriter) sample(name, k1, v1, k2, v2 string, value float64) {
+    labels := ""
+    if k1 != "" {
+        labels = k1 + "=" + strconv.Quote(v1)
+    }
+    if k2 != "" {
+        labels += "," + k2 + "=" + strconv.Quote(v2)
+    }
+    if labels != "" {
+        labels = "{" + labels + "}"
+    }
+    pw.printf("%s%s %s\n", name, labels, strconv.FormatFloat(value, 'g', -1, 64))
+}
@@ -0,0 +1,92 @@
+package moosefs
+
+import (
+    "bytes"
+    "moosefstest"
+    "strings"
+    "testing"
+)
+
+func TestMetrics(t *testing.T) {
+    c := NewClient(testMaster.Addr(), "/", false)
+    defer c.Close()
+    data := testData(2*MFS_BLOCK_SIZE + 1)
+    writeTestFile(t, c, "metered", data)
+    defer c.Remove("metered")
+
+    f, err := c.Open("metered")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if m := c.Metrics(); m.OpenFiles != 1 {
+        t.Error("open files", m.OpenFiles)
+    }
+    f.Close()
+    f.Close()
+
+    css := testMaster.ChunkServers()
+    css[0].SetFault(func(cmd uint32, payload []byte) *moosefstest.Fault {
+        return &moosefstest.Fault{Corrupt: true}
+    })
+    got, err := c.ReadFile("metered")
+    css[0].SetFault(nil)
+    if err != nil || !bytes.Equal(got, data) {
+        t.Fatal("read", len(got), err)
+    }
+
+    m := c.Metrics()
+    if m.OpenFiles != 0 {
+        t.Error("open files", m.OpenFiles)
+    }
+    wc := m.Master["WRITE_CHUNK"]
+    if wc == nil || wc.Requests == 0 || wc.Latency.Count != wc.Requests {
+        t.Error("write chunk", wc)
+    }
+    var read, written, blocks, crc, retries uint64
+    for _, cs := range m.ChunkServers {
+        read += cs.ReadBytes
+        written += cs.WrittenBytes
+        blocks += cs.WrittenBlocks
+        crc += cs.CRCErrors
+        retries += cs.Retries
+    }
+    if read != uint64(len(data)) || written != uint64(len(data)) || blocks != 3 {
+        t.Error("bytes", read, written, blocks)
+    }
+    if crc == 0 || retries != crc {
+        t.Error("crc errors", crc, "retries", retries)
+    }
+
+    var text bytes.Buffer
+    if err := m.WritePrometheus(&text); err != nil {
+        t.Fatal(err)
+    }
+    for _, line := range []string{
+        `mfs_master_requests_total{command="LOOKUP"} `,
+        `mfs_master_request_duration_seconds_bucket{command="WRITE_CHUNK",le="+Inf"} `,
+        `# TYPE mfs_chunkserver_crc_errors_total counter`,
+        `mfs_open_files 0`,
+    } {
+        if !strings.Contains(text.String(), "\n"+line) {
+            t.Error("missing", line)
+        }
+    }
+}
+
+func TestMetricsFailedClose(t *testing.T) {
+    c := NewClient(testMaster.Addr(), "/", false)
+    defer c.Close()
+    f, err := c.Create("/nospace")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer c.Remove("/nospace")
+    c.MinFreeSpace = 1 << 62
+    f.Write(testData(LARGE_WRITE_SIZE))
+    if err := f.Close(); err == nil {
+        t.Error("close without space")
+    }
+    if n := c.Metrics().OpenFiles; n != 0 {
+        t.Error("open files after a failed close", n)
+    }
+}
@@ -5,52 +5,106 @@ import (
     "io"
     "os"
     "path"
+    "strconv"
     "strings"
     "sync"
     "sync/atomic"
+    "syscall"
     "time"
 )
 
 const MASTER_CONNS = 4
 
+// how many times a chunk is read with fresh locations before giving up
+const READ_RETRIES = 3
+
+// defaults for retrying a failed chunk write
+const (
+    WRITE_RETRIES         = 10
+    WRITE_RETRY_DELAY     = 100 * time.Millisecond
+    WRITE_RETRY_MAX_DELAY = 5 * time.Second
+)
+
 type Client struct {
     mcs []*MasterConn
     idx uint64
 
+    // WriteRetries is the number of attempts made to write a chunk before
+    // Sync gives up, WriteRetryDelay the initial backoff between them.
+    WriteRetries    int
+    WriteRetryDelay time.Duration
+
+    // MinFreeSpace is the space CheckSpace keeps free in the cluster, so
+    // that large writes fail with ERROR_NOSPACE before filling it.
+    MinFreeSpace uint64
+
+    space spaceCheck
+
+    chunks *chunkCache
+    bcache *BlockCache
+    dial   dialFunc // nil for the pooled connections to chunkservers
+
+    metrics *metrics
+    hooks   *hooks
+
     enable_cache bool
-    cache_mutex  sync.Mutex //
-    inode_cache  map[uint32]map[string]*fileStat
+    inode_cache  *inodeCache
 
     cwd        string
     curr_inode uint32
 }
 
+// A File may be used from many goroutines at once. ReadAt and WriteAt do
+// not touch the offset and may run in parallel, while Read, Write and Seek
+// are serialized.
 type File struct {
     path  string
     inode uint32
+    flag  int // of OpenFile
     info  *fileStat
 
+    length uint64 // of the file as last seen from the master, atomic
+
     client *Client
 
+    rmutex sync.Mutex // offset, read buffer and directory listings
     offset int64
     rbuf   []byte
     roff   int64
-    woff   int64
-    wbuf   []byte
+    rgen   uint64 // wgen when rbuf was filled
+    ra     readahead
 
-    dircache     []*fileStat
-    dirnamecache []string
-    cscache      map[uint64]*Chunk
+    mutex sync.RWMutex // dirty data, held for reading by ReadAt
+    dirty dirtyChunks
+    wgen  uint64 // bumped by every write
+
+    imutex sync.Mutex // info
+
+    dirIter *DirIter // for Readdir and Readdirnames
+    dirPos  int      // entries they returned
+    closed  bool
 }
 
 func NewClient(addr, subdir string, enable_cache bool) (c *Client) {
     c = &Client{}
+    c.metrics = newMetrics()
+    c.hooks = new(hooks)
     c.mcs = make([]*MasterConn, MASTER_CONNS)
     for i := 0; i < MASTER_CONNS; i++ {
         c.mcs[i] = NewMasterConn(addr, subdir)
+        c.mcs[i].metrics = c.metrics
+        c.mcs[i].hooks = c.hooks
     }
+    c.chunks = newChunkCache(CHUNK_CACHE_TTL, CHUNK_CACHE_SIZE)
+    c.WriteRetries = WRITE_RETRIES
+    c.WriteRetryDelay = WRITE_RETRY_DELAY
     c.enable_cache = enable_cache
-    c.inode_cache = make(map[uint32]map[string]*fileStat)
+    c.inode_cache = newInodeCache(CacheOptions{
+        EntryTTL:    INODE_CACHE_ENTRY_TTL,
+        AttrTTL:     INODE_CACHE_ATTR_TTL,
+        NegativeTTL: INODE_CACHE_NEG_TTL,
+        MaxBytes:    INODE_CACHE_MAX_BYTES,
+    })
     c.cwd = "/"
     c.curr_inode = MFS_ROOT_ID
     return
@@ -63,6 +117,52 @@ func (c *Client) Close() {
     c.mcs = nil
 }
 
+// SetBlockCache makes the client keep the data it reads in bc, nil turns
+// the cache off.
+func (c *Client) SetBlockCache(bc *BlockCache) {
+    c.bcache = bc
+}
+
+// SetMaxPacketSize changes the largest answer accepted from the master,
+// see MasterConn.MaxPacketSize.
+func (c *Client) SetMaxPacketSize(size uint32) {
+    for _, mc := range c.mcs {
+        mc.Lock()
+        mc.MaxPacketSize = size
+        mc.Unlock()
+    }
+}
+
+// SetMaxDirPacketSize changes the largest directory listing accepted from
+// the master, see MasterConn.MaxDirPacketSize.
+func (c *Client) SetMaxDirPacketSize(size uint32) {
+    for _, mc := range c.mcs {
+        mc.Lock()
+        mc.MaxDirPacketSize = size
+        mc.Unlock()
+    }
+}
+
+// SetRecorder makes the client record all its traffic with the master and
+// the chunkservers into r, see Recorder.
+func (c *Client) SetRecorder(r *Recorder) {
+    c.setDial(r.dial)
+}
+
+// SetReplayer makes the client talk to p instead of the master and the
+// chunkservers, see Replayer.
+func (c *Client) SetReplayer(p *Replayer) {
+    c.setDial(p.dial)
+}
+
+func (c *Client) setDial(dial dialFunc) {
+    c.dial = dial
+    for _, mc := range c.mcs {
+        mc.setDial(dial)
+    }
+    c.chunks.clear()
+}
+
 func (c *Client) getMasterConn() *MasterConn {
     idx := atomic.AddUint64(&c.idx, 1)
     return c.mcs[idx%MASTER_CONNS]
@@ -77,119 +177,138 @@ func (c *Client) Open(name string) (*File, error) {
 }
 
 func (c *Client) lookup_inode(parent uint32, name string) (*fileStat, error) {
-    c.cache_mutex.Lock()
-    cache, ok := c.inode_cache[parent]
-    if !ok {
-        cache = make(map[string]*fileStat)
-        c.inode_cache[parent] = cache
+    if c.enable_cache {
+        fi, state := c.inode_cache.get(parent, name)
+        switch state {
+        case cacheHit:
+            return fi, nil
+        case cacheNegative:
+            return nil, Error(ERROR_ENOENT)
+        case cacheStaleAttr:
+            nfi, err := c.getMasterConn().GetAttr(uint32(fi.inode))
+            if err == nil {
+                nfi.name = name
+                c.inode_cache.put(parent, name, nfi)
+                return nfi, nil
+            }
+            // the inode is gone, look the name up again
+            c.inode_cache.purge(parent, name)
+        }
     }
-    fi, ok := cache[name]
-    c.cache_mutex.Unlock()
 
-    if !ok {
-        inode, attr, err := c.getMasterConn().Lookup(parent, name)
-        if err != nil {
-            return nil, err
+    inode, attr, err := c.getMasterConn().Lookup(parent, name)
+    if err != nil {
+        if e, ok := err.(Error); ok && e == ERROR_ENOENT && c.enable_cache {
+            c.inode_cache.putNegative(parent, name)
         }
-        fi = attrToFileInfo(inode, attr)
-        fi.name = name
+        return nil, err
+    }
+    fi, err := newFileInfo(name, inode, attr)
+    if err != nil {
+        return nil, err
+    }
 
-        if c.enable_cache {
-            c.cache_mutex.Lock()
-            cache[name] = fi
-            c.cache_mutex.Unlock()
-        }
+    if c.enable_cache {
+        c.inode_cache.put(parent, name, fi)
     }
     return fi, nil
 }
 
-func (c *Client) lookup(name string, followSymlink bool) (fi *fileStat, parent uint32, err error) {
-    parent = c.curr_inode
-    ss := strings.Split(name, "/")
-    if ss[0] == "" {
-        parent = MFS_ROOT_ID
-    }
-    for i, n := range ss {
-        if len(n) == 0 {
-            continue
+// OpenFile opens name like os.OpenFile. The access mode of flag is
+// checked by the master and enforced by the File, O_CREATE|O_EXCL fails
+// with ERROR_EEXIST if name exists, and with O_APPEND every Write goes to
+// the end of the file. While data is buffered the end is not asked from
+// the master again, so appends from several Files only stay apart when
+// each of them is synced before the next one writes.
+func (c *Client) OpenFile(name string, flag int, perm os.FileMode) (file *File, err error) {
+    var fi *fileStat
+    created := false
+    if flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0 {
+        parent, base, err := c.getParent(name)
+        if err != nil {
+            return nil, err
         }
-        fi, err = c.lookup_inode(parent, n)
+        fi, err = c.getMasterConn().Mknod(parent, base, TYPE_FILE, unixMode(perm), 0)
+        c.forget(parent, base)
         if err != nil {
-            return nil, parent, err
+            return nil, err
         }
-        if fi.IsSymlink() && (i < len(ss)-1 || followSymlink) {
-            target, err := c.getMasterConn().ReadLink(uint32(fi.inode))
-            if err != nil {
-                return nil, parent, errors.New("read link: " + err.Error())
-            }
-            if !strings.HasPrefix(target, "/") {
-                target = path.Join(strings.Join(ss[:i], "/"), target)
-            }
-            fi, _, err = c.lookup(target, true)
-            if err != nil {
-                return nil, parent, errors.New("follow :" + target + err.Error())
-            }
+        created = true
+    } else {
+        var parent uint32
+        var base string
+        parent, base, fi, err = c.resolve(name, true)
+        if err == nil && base == "" {
+            fi, err = c.getMasterConn().GetAttr(parent)
         }
-        parent = uint32(fi.inode)
-    }
-    if parent == MFS_ROOT_ID {
-        fi, err = c.getMasterConn().GetAttr(parent)
         if err != nil {
-            return nil, parent, err
-        }
-    }
-    return fi, parent, nil
-}
-
-func (c *Client) OpenFile(name string, flag int, perm os.FileMode) (file *File, err error) {
-    fi, parent, err := c.lookup(name, true)
-    if err != nil {
-        if e, ok := err.(Error); ok && e == Error(ERROR_ENOENT) {
-            if flag&os.O_CREATE > 0 {
-                if !strings.HasPrefix(name, "/") {
-                    _, name = path.Split(name)
+            e, ok := err.(Error)
+            switch {
+            case ok && e == Error(ERROR_ENOENT) && flag&os.O_CREATE != 0 && parent != 0:
+                fi, err = c.getMasterConn().Mknod(parent, base, TYPE_FILE, unixMode(perm), 0)
+                c.forget(parent, base)
+                if err == Error(ERROR_EEXIST) {
+                    // created by someone else meanwhile
+                    fi, _, err = c.lookup(name, true)
+                } else {
+                    created = err == nil
                 }
-                fi, err = c.getMasterConn().Mknod(parent, name, TYPE_FILE, uint16(perm), 0)
                 if err != nil {
                     return nil, errors.New("mknod failed: " + err.Error())
                 }
-            } else {
+            case ok || err == syscall.ELOOP:
                 return nil, err
+            default:
+                return nil, errors.New("lookup failed: " + err.Error())
             }
-        } else {
-            return nil, errors.New("lookup failed: " + err.Error())
+        }
+    }
+
+    acc := flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR)
+    if fi.IsDir() {
+        if acc != os.O_RDONLY {
+            return nil, syscall.EISDIR
         }
     } else {
-        if (flag & os.O_TRUNC) > 0 {
-            fi, err = c.getMasterConn().Truncate(uint32(fi.inode), 0, 0)
-            if err != nil {
-                return nil, errors.New("truncate failed: " + err.Error())
-            }
+        var want uint8
+        if acc != os.O_WRONLY {
+            want |= WANT_READ
+        }
+        if acc != os.O_RDONLY {
+            want |= WANT_WRITE
+        }
+        if created {
+            // the creator may write even if perm doesn't allow it
+            want |= AFTER_CREATE
+        }
+        if _, err = c.getMasterConn().OpenCheck(uint32(fi.inode), want); err != nil {
+            return nil, err
         }
     }
 
-    /*
-       if !fi.IsDirectory() {
-           f := uint8(WANT_READ)
-           if flag & os.O_WRONLY > 0 {
-               f = WANT_WRITE
-           } else if flag & os.O_RDWR > 0 {
-               f = WANT_READ | WANT_WRITE
-           }
-
-           _, err := c.getMasterConn().OpenCheck(uint32(fi.inode), f)
-           if err != nil {
-               return nil, err
-           }
-       }*/
+    if flag&os.O_TRUNC != 0 && !created && !fi.IsDir() {
+        inode := uint32(fi.inode)
+        fi, err = c.getMasterConn().Truncate(inode, 0, 0)
+        c.chunks.invalidateInode(inode)
+        c.stale(inode)
+        if err != nil {
+            return nil, errors.New("truncate failed: " + err.Error())
+        }
+        fi.name = path.Base(name)
+    }
+    return c.newFile(name, fi, flag), nil
+}
 
-    file = &File{}
+func (c *Client) newFile(name string, fi *fileStat, flag int) *File {
+    file := &File{}
     file.path = name
     file.inode = uint32(fi.inode)
-    file.cscache = make(map[uint64]*Chunk)
+    file.flag = flag
     file.client = c
     file.info = fi
-    return file, nil
+    file.length = uint64(fi.size)
+    c.metrics.openFile(1)
+    return file
 }
 
 func (c *Client) Link(oldname, newname string) error {
@@ -197,23 +316,14 @@ func (c *Client) Link(oldname, newname string) error {
     if err != nil {
         return errors.New(oldname + " not exists")
     }
-    _, _, err = c.getMasterConn().Link(uint32(fi.inode), c.curr_inode, newname)
-    return err
-}
-
-func (c *Client) getParent(name string) (uint32, string, error) {
-    parent_inode := c.curr_inode
-    var dir string
-    dir, name = path.Split(name)
-    if dir != "" {
-        var err error
-        fi, _, err := c.lookup(dir, true)
-        if err != nil {
-            return 0, name, err
-        }
-        parent_inode = uint32(fi.inode)
+    parent, base, err := c.getParent(newname)
+    if err != nil {
+        return err
     }
-    return parent_inode, name, nil
+    _, _, err = c.getMasterConn().Link(uint32(fi.inode), parent, base)
+    c.forget(parent, base)
+    c.stale(uint32(fi.inode))
+    return err
 }
 
 func (c *Client) Mkdir(name string, perm os.FileMode) (err error) {
@@ -222,11 +332,31 @@ func (c *Client) Mkdir(name string, perm os.FileMode) (err error) {
         return err
     }
     _, err = c.getMasterConn().Mkdir(parent_inode, name, uint16(perm))
+    c.forget(parent_inode, name)
     return err
 }
 
 func (c *Client) MkdirAll(name string, perm os.FileMode) error {
-    return errors.New("no impl")
+    name = path.Clean(name)
+    if fi, err := c.Stat(name); err == nil {
+        if fi.IsDir() {
+            return nil
+        }
+        return Error(ERROR_ENOTDIR)
+    }
+    if dir := path.Dir(name); dir != name && dir != "." && dir != "/" {
+        if err := c.MkdirAll(dir, perm); err != nil {
+            return err
+        }
+    }
+    err := c.Mkdir(name, perm)
+    if err != nil {
+        // someone else may have created it meanwhile
+        if fi, e := c.Lstat(name); e == nil && fi.IsDir() {
+            return nil
+        }
+    }
+    return err
 }
 
 func (c *Client) Remove(name string) error {
@@ -234,7 +364,9 @@ func (c *Client) Remove(name string) error {
     if err != nil {
         return err
     }
-    return c.getMasterConn().Unlink(parent_inode, name)
+    err = c.getMasterConn().Unlink(parent_inode, name)
+    c.forget(parent_inode, name)
+    return err
 }
 
 func (c *Client) Rmdir(name string) error {
@@ -242,11 +374,32 @@ func (c *Client) Rmdir(name string) error {
     if err != nil {
         return err
     }
-    return c.getMasterConn().Rmdir(parent_inode, name)
+    err = c.getMasterConn().Rmdir(parent_inode, name)
+    c.forget(parent_inode, name)
+    return err
 }
 
-func (c *Client) RemoveAll(path string) error {
-    return errors.New("no impl")
+func (c *Client) RemoveAll(name string) error {
+    fi, err := c.Lstat(name)
+    if err != nil {
+        if e, ok := err.(Error); ok && e == ERROR_ENOENT {
+            return nil
+        }
+        return err
+    }
+    if !fi.IsDir() {
+        return c.Remove(name)
+    }
+    fis, err := c.readDir(uint32(fi.(*fileStat).inode))
+    if err != nil {
+        return err
+    }
+    for _, fi := range fis {
+        if err := c.RemoveAll(path.Join(name, fi.name)); err != nil {
+            return err
+        }
+    }
+    return c.Rmdir(name)
 }
 
 func (c *Client) Rename(oldname, newname string) error {
@@ -258,7 +411,11 @@ func (c *Client) Rename(oldname, newname string) error {
     if err != nil {
         return err
     }
-    return c.getMasterConn().Rename(parent_inode1, name1, parent_inode2, name2)
+    err = c.getMasterConn().Rename(parent_inode1, name1, parent_inode2, name2)
+    // the renamed subtree and the replaced entry
+    c.forget(parent_inode1, name1)
+    c.forget(parent_inode2, name2)
+    return err
 }
 
 func (c *Client) Symlink(oldname, newname string) error {
@@ -267,20 +424,27 @@ func (c *Client) Symlink(oldname, newname string) error {
         return err
     }
     _, err = c.getMasterConn().Symlink(parent_inode, name, oldname)
+    c.forget(parent_inode, name)
     return err
 }
 
 func (c *Client) Truncate(name string, size int64) error {
-    _, err := c.OpenFile(name, os.O_TRUNC, 0555)
+    fi, _, err := c.lookup(name, true)
+    if err != nil {
+        return err
+    }
+    _, err = c.getMasterConn().Truncate(uint32(fi.inode), 0, size)
+    c.chunks.invalidateInode(uint32(fi.inode))
+    c.stale(uint32(fi.inode))
     return err
 }
 
 func (c *Client) Stat(name string) (os.FileInfo, error) {
-    f, err := c.Open(name)
+    fi, _, err := c.lookup(name, true)
     if err != nil {
         return nil, err
     }
-    return f.Stat()
+    return fi, nil
 }
 
 func (c *Client) Lstat(name string) (os.FileInfo, error) {
@@ -292,17 +456,63 @@ func (c *Client) Lstat(name string) (os.FileInfo, error) {
 }
 
 func (c *Client) Readlink(name string) (string, error) {
-    return "", errors.New("no impl")
+    fi, _, err := c.lookup(name, false)
+    if err != nil {
+        return "", err
+    }
+    if !fi.IsSymlink() {
+        return "", Error(ERROR_EINVAL)
+    }
+    return c.getMasterConn().ReadLink(uint32(fi.inode))
+}
+
+// setAttr changes the attributes of name selected by setmask.
+func (c *Client) setAttr(name string, setmask uint8, mode uint16, uid, gid, atime, mtime uint32) error {
+    fi, _, err := c.lookup(name, true)
+    if err != nil {
+        return err
+    }
+    return c.setInodeAttr(uint32(fi.inode), setmask, mode, uid, gid, atime, mtime)
+}
+
+func (c *Client) setInodeAttr(inode uint32, setmask uint8, mode uint16, uid, gid, atime, mtime uint32) error {
+    _, err := c.getMasterConn().SetAttr(inode, setmask, mode, uid, gid, atime, mtime)
+    c.stale(inode)
+    return err
+}
+
+// unixMode returns the permission bits of mode as the master keeps them
+func unixMode(mode os.FileMode) uint16 {
+    m := uint16(mode.Perm())
+    if mode&os.ModeSetuid != 0 {
+        m |= S_ISUID
+    }
+    if mode&os.ModeSetgid != 0 {
+        m |= S_ISGID
+    }
+    if mode&os.ModeSticky != 0 {
+        m |= S_ISVTX
+    }
+    return m
 }
 
 func (c *Client) Chmod(name string, mode os.FileMode) error {
-    // TODO mc.SetAttr()
-    return nil
+    return c.setAttr(name, SET_MODE_FLAG, unixMode(mode), 0, 0, 0, 0)
 }
 
+// Chown changes the owner of name, a negative uid or gid is left alone.
 func (c *Client) Chown(name string, uid, gid int) error {
-    // TODO mc.SetAttr()
-    return nil
+    var setmask uint8
+    if uid >= 0 {
+        setmask |= SET_UID_FLAG
+    }
+    if gid >= 0 {
+        setmask |= SET_GID_FLAG
+    }
+    if setmask == 0 {
+        return nil
+    }
+    return c.setAttr(name, setmask, 0, uint32(uid), uint32(gid), 0, 0)
 }
 
 func (c *Client) Lchown(name string, uid, gid int) error {
@@ -310,84 +520,141 @@ func (c *Client) Lchown(name string, uid, gid int) error {
 }
 
 func (c *Client) Chtimes(name string, atime, mtime time.Time) error {
-    // TODO mc.SetAttr()
-    return nil
+    return c.setAttr(name, SET_ATIME_FLAG|SET_MTIME_FLAG, 0, 0, 0, uint32(atime.Unix()), uint32(mtime.Unix()))
 }
 
 func (c *Client) Getwd() (string, error) {
     return c.cwd, nil
 }
 
+// Chdir changes the current directory. Like getcwd(3), the working
+// directory is kept as the real path, with the symlinks resolved.
 func (c *Client) Chdir(dir string) error {
-    fi, _, err := c.lookup(dir, true)
+    w, base, fi, err := c.walkPath(dir, true)
     if err != nil {
         return err
     }
-    if strings.HasPrefix(dir, "/") {
-        c.cwd = dir
-    } else {
-        c.cwd = path.Join(c.cwd, dir)
+    if base != "" {
+        if !fi.IsDir() {
+            return Error(ERROR_ENOTDIR)
+        }
+        w.dirs = append(w.dirs, uint32(fi.inode))
+        w.names = append(w.names, base)
     }
-    c.curr_inode = uint32(fi.inode)
+    c.cwd = w.path(c.cwd)
+    c.curr_inode = w.dirs[len(w.dirs)-1]
     return nil
 }
 
-func (c *Client) purge_inode_cache_in_dir(fi *fileStat) int {
-    n := 0
-    if cache, exists := c.inode_cache[uint32(fi.inode)]; exists {
-        for _, fi := range cache {
-            n += c.purge_inode_cache_in_dir(fi)
+// PurgeINodeCache drops the cached entry of path, and everything cached
+// below it if it is a directory.
+func (c *Client) PurgeINodeCache(path string) (n_purged int, err error) {
+    if strings.HasSuffix(path, "/") {
+        // the whole tree below a directory
+        parent, _, _, err := c.resolve(path+".", true)
+        if err != nil {
+            return 0, err
         }
-        delete(c.inode_cache, uint32(fi.inode))
-        n++
+        c.inode_cache.Lock()
+        n_purged = c.inode_cache.purgeDir(parent)
+        c.inode_cache.Unlock()
+        return n_purged, nil
     }
-    return n
-}
-
-func (c *Client) PurgeINodeCache(path string) (n_purged int, err error) {
-    fi, parent, err := c.lookup(path, true)
+    parent, name, err := c.getParent(path)
     if err != nil {
         return
     }
+    return c.inode_cache.purge(parent, name), nil
+}
 
-    c.cache_mutex.Lock()
+// forget updates the inode cache after name in parent was changed.
+func (c *Client) forget(parent uint32, name string) {
+    if c.enable_cache {
+        c.inode_cache.forget(parent, name)
+    }
+}
 
-    n_purged = c.purge_inode_cache_in_dir(fi)
-    if _, exists := c.inode_cache[parent]; exists {
-        delete(c.inode_cache[parent], fi.name)
-        n_purged++
+// stale updates the inode cache after the attributes of inode changed.
+func (c *Client) stale(inode uint32) {
+    if c.enable_cache {
+        c.inode_cache.stale(inode)
     }
+}
 
-    c.cache_mutex.Unlock()
+// SetCacheOptions empties the inode cache and makes it use opts, it may be
+// called while the client is in use.
+func (c *Client) SetCacheOptions(opts CacheOptions) {
+    c.inode_cache.reset(opts)
+}
 
-    return
+// CacheStats returns the counters of the inode cache.
+func (c *Client) CacheStats() CacheStats {
+    return c.inode_cache.getStats()
 }
 
 // File
 
+var (
+    _ io.ReadWriteSeeker = (*File)(nil)
+    _ io.ReaderAt        = (*File)(nil)
+    _ io.WriterAt        = (*File)(nil)
+    _ io.Closer          = (*File)(nil)
+)
+
+// Close syncs the data written and releases the file, even if the sync
+// fails.
 func (f *File) Close() error {
-    if len(f.wbuf) > 0 {
-        return f.Sync()
-    }
+    err := f.Sync()
+    f.rmutex.Lock()
     f.offset = 0
     f.rbuf = nil
-    f.wbuf = nil
-    return nil
+    f.ra.drop()
+    if !f.closed {
+        f.closed = true
+        f.client.metrics.openFile(-1)
+    }
+    f.rmutex.Unlock()
+    return err
 }
 
 func (f *File) Path() string {
     return f.path
 }
 
+// Len returns the size of the file, including data not yet synced.
 func (f *File) Len() int64 {
     fi, err := f.Stat()
     if err != nil {
         return 0
     }
+    f.mutex.RLock()
+    end := f.dirty.end()
+    f.mutex.RUnlock()
+    if end > fi.Size() {
+        return end
+    }
     return fi.Size()
 }
 
+func (f *File) readable() bool {
+    return f.flag&(os.O_RDONLY|os.O_WRONLY|os.O_RDWR) != os.O_WRONLY
+}
+
+func (f *File) writable() bool {
+    return f.flag&(os.O_RDONLY|os.O_WRONLY|os.O_RDWR) != os.O_RDONLY
+}
+
 func (f *File) Read(b []byte) (n int, err error) {
+    if !f.readable() {
+        return 0, syscall.EBADF
+    }
+    f.rmutex.Lock()
+    defer f.rmutex.Unlock()
+
+    if f.rgen != atomic.LoadUint64(&f.wgen) {
+        // the file was written since the buffer was filled
+        f.rbuf = f.rbuf[:0]
+    }
     got := 0
     for got < len(b) {
         if f.offset >= f.roff && f.offset < f.roff+int64(len(f.rbuf)) {
@@ -400,195 +667,443 @@ func (f *File) Read(b []byte) (n int, err error) {
             }
         }
 
-        f.roff = f.offset
-        left := f.Len() - f.offset
-        rsize := int64(4 * 1024 * 1024)
-        if left < rsize {
-            rsize = left
-        }
-        if len(f.rbuf) < int(rsize) {
-            f.rbuf = make([]byte, rsize)
-        } else {
-            f.rbuf = f.rbuf[:rsize]
-        }
-        n, err := f.ReadAt(f.rbuf, uint64(f.offset))
-        if n == 0 {
+        if err := f.fill(); err != nil {
             return got, err
         }
-        f.rbuf = f.rbuf[:n]
     }
-    panic("should not here")
-    return
+    return got, nil
 }
 
 const CHUNK_SIZE = 64 * 1024 * 1024
 
-func (f *File) ReadAt(b []byte, offset uint64) (n int, err error) {
+// ReadAt reads from the chunkservers, with the data written to the file
+// but not yet synced laid over it.
+func (f *File) ReadAt(b []byte, offset int64) (n int, err error) {
+    if offset < 0 {
+        return 0, syscall.EINVAL
+    }
+    if !f.readable() {
+        return 0, syscall.EBADF
+    }
+    // keep Sync from writing the dirty data while we read the old one
+    f.mutex.RLock()
+    defer f.mutex.RUnlock()
+
+    n, err = f.readAt(b, uint64(offset))
+    if f.dirty.size == 0 {
+        return n, err
+    }
+    if err == io.EOF && n < len(b) {
+        // unsynced data beyond the end of file
+        if end := f.dirty.end() - offset; end > int64(n) {
+            if end >= int64(len(b)) {
+                end = int64(len(b))
+                err = nil
+            }
+            for i := n; i < int(end); i++ {
+                b[i] = 0
+            }
+            n = int(end)
+        }
+    }
+    f.dirty.read(b[:n], offset)
+    return n, err
+}
+
+func (f *File) readAt(b []byte, offset uint64) (n int, err error) {
     got := 0
-    for {
+    for got < len(b) {
         indx := offset / CHUNK_SIZE
         off := offset % CHUNK_SIZE
 
-        info, ok := f.cscache[indx]
-        if !ok {
-            info, err = f.client.getMasterConn().ReadChunk(f.inode, uint32(indx))
-            if err != nil {
-                return got, err
-            }
-            f.cscache[indx] = info
+        info, err := f.readChunk(uint32(indx))
+        if err != nil {
+            return got, err
         }
-
-        size := min(len(b)-got, int(info.length-off))
-        if size <= 0 {
+        if offset >= info.length {
             return got, io.EOF
         }
 
-        n, err := info.Read(b[got:got+size], uint32(off))
+        // stop at the end of the chunk or of the file
+        size := min(len(b)-got, int(CHUNK_SIZE-off))
+        if left := info.length - offset; uint64(size) > left {
+            size = int(left)
+        }
+
+        n, err := f.client.readChunkData(f.inode, uint32(indx), info, b[got:got+size], uint32(off))
         got += n
         offset += uint64(n)
         if err != nil {
             return got, err
         }
-        if got == len(b) {
-            return got, nil
+    }
+    return got, nil
+}
+
+// readChunk returns the location of a chunk of the file, and remembers
+// the length of the file the master answered with.
+func (f *File) readChunk(indx uint32) (*Chunk, error) {
+    info, err := f.client.readChunk(f.inode, indx, atomic.LoadUint64(&f.length))
+    if err != nil {
+        return nil, err
+    }
+    atomic.StoreUint64(&f.length, info.length)
+    return info, nil
+}
+
+// readChunk returns the location of a chunk, from the cache if it was
+// got with the same length of the file.
+func (c *Client) readChunk(inode, indx uint32, length uint64) (*Chunk, error) {
+    if info := c.chunks.get(inode, indx, length); info != nil {
+        return info, nil
+    }
+    info, err := c.getMasterConn().ReadChunk(inode, indx)
+    if err != nil {
+        return nil, err
+    }
+    c.setupChunk(info, inode)
+    c.chunks.put(inode, indx, info)
+    return info, nil
+}
+
+// setupChunk makes a chunk got from the master use the caches and the
+// connections of the client.
+func (c *Client) setupChunk(info *Chunk, inode uint32) {
+    info.inode = inode
+    info.cache = c.bcache
+    info.dial = c.dial
+    info.metrics = c.metrics
+    info.hooks = c.hooks
+}
+
+// readChunkData reads from a chunk, asking the master for its current
+// location again when the chunkservers we know of fail, because the chunk
+// may have got a new version or been moved away from them.
+func (c *Client) readChunkData(inode, indx uint32, info *Chunk, buf []byte, off uint32) (n int, err error) {
+    for try := 0; try < READ_RETRIES; try++ {
+        if try > 0 {
+            c.hooks.logger().Info("read chunk failed, asking master again", "inode", inode,
+                "chunk", info.id, "try", try, "err", err)
+            c.chunks.invalidate(inode, indx)
+            if info, err = c.readChunk(inode, indx, info.length); err != nil {
+                return 0, err
+            }
         }
-        if offset >= info.length {
-            return got, io.EOF
+        n, err = info.Read(buf, off)
+        if err == nil {
+            return n, nil
         }
     }
-    return got, nil
+    c.chunks.invalidate(inode, indx)
+    return n, err
 }
 
+// whence values of Seek for sparse files, as on Linux
+const (
+    SEEK_DATA = 3
+    SEEK_HOLE = 4
+)
+
 func (f *File) Seek(offset int64, whence int) (int64, error) {
+    f.rmutex.Lock()
+    defer f.rmutex.Unlock()
+
     switch whence {
     case os.SEEK_SET:
         f.offset = offset
     case os.SEEK_CUR:
         f.offset += offset
     case os.SEEK_END:
-        f.offset = f.info.Size() + offset
+        f.offset = f.Len() + offset
+    case SEEK_DATA, SEEK_HOLE:
+        off, err := f.seekHole(offset, whence == SEEK_DATA)
+        if err != nil {
+            return f.offset, err
+        }
+        f.offset = off
     }
     return f.offset, nil
 }
 
+// SeekData returns the offset of the first data at or after offset. Holes
+// are only detected at chunk granularity, so a hole inside a chunk is
+// reported as data.
+func (f *File) SeekData(offset int64) (int64, error) {
+    return f.seekHole(offset, true)
+}
+
+// SeekHole returns the offset of the first hole at or after offset, which
+// is the length of the file if there is no hole after offset.
+func (f *File) SeekHole(offset int64) (int64, error) {
+    return f.seekHole(offset, false)
+}
+
+func (f *File) seekHole(offset int64, data bool) (int64, error) {
+    if offset < 0 {
+        return 0, syscall.EINVAL
+    }
+    for pos := offset; ; {
+        indx := pos / CHUNK_SIZE
+        info, err := f.readChunk(uint32(indx))
+        if err != nil {
+            return 0, err
+        }
+        length := int64(info.length)
+        if offset >= length {
+            return 0, syscall.ENXIO
+        }
+        if pos >= length {
+            // the end of file counts as a hole
+            if data {
+                return 0, syscall.ENXIO
+            }
+            return length, nil
+        }
+        // a chunk without id was never written
+        if (info.id != 0) == data {
+            return pos, nil
+        }
+        pos = (indx + 1) * CHUNK_SIZE
+    }
+}
+
 func (f *File) Stat() (fi os.FileInfo, err error) {
+    f.imutex.Lock()
+    defer f.imutex.Unlock()
+
     if f.info != nil {
         return f.info, nil
     }
-    f.info, err = f.client.getMasterConn().GetAttr(f.inode)
-    return f.info, err
+    info, err := f.client.getMasterConn().GetAttr(f.inode)
+    if err != nil {
+        return nil, err
+    }
+    info.name = path.Base(f.path)
+    f.info = info
+    return info, nil
 }
 
-func (f *File) Readdir(count int) (fis []os.FileInfo, err error) {
-    fi := f.dircache
-    if fi == nil {
-        fi, err = f.client.getMasterConn().GetDirPlus(f.inode)
-        if err != nil {
-            return nil, err
-        }
-        f.dircache = fi
-    }
+func (f *File) Chmod(mode uint32) error {
+    err := f.client.setInodeAttr(f.inode, SET_MODE_FLAG, uint16(mode&07777), 0, 0, 0, 0)
+    f.imutex.Lock()
+    f.info = nil
+    f.imutex.Unlock()
+    return err
+}
 
-    if len(fi) < int(f.offset) {
-        return nil, nil
+func (f *File) Sync() error {
+    f.mutex.Lock()
+    defer f.mutex.Unlock()
+    return f.sync()
+}
+
+func (f *File) sync() error {
+    if f.dirty.size == 0 {
+        return nil
     }
-    fi = fi[f.offset:]
-    if count > 0 && len(fi) > count {
-        fi = fi[:count]
+    if f.dirty.size >= LARGE_WRITE_SIZE {
+        if err := f.client.CheckSpace(int64(f.dirty.size)); err != nil {
+            return err
+        }
     }
-    f.offset += int64(len(fi))
-    for _, i := range fi {
-        fis = append(fis, i)
+    defer func() {
+        f.client.chunks.invalidateInode(f.inode)
+        f.client.stale(f.inode)
+    }()
+    for _, indx := range f.dirty.indexes() {
+        if err := f.writeChunk(indx, f.dirty.chunks[indx]); err != nil {
+            return err
+        }
+        f.dirty.remove(indx)
     }
-    return
+    // the length has changed
+    f.imutex.Lock()
+    f.info = nil
+    f.imutex.Unlock()
+    return nil
 }
 
-func (f *File) Readdirnames(count int) (names []string, err error) {
-    if f.dirnamecache == nil {
-        names, err = f.client.getMasterConn().GetDir(f.inode)
-        if err != nil {
-            return nil, err
+// canRetryWrite reports whether a failed chunk write is worth another try.
+// Chunkserver and connection failures are retried with a fresh chain, but
+// errors about the file itself are returned at once.
+func canRetryWrite(err error) bool {
+    if e, ok := err.(Error); ok {
+        switch e {
+        case ERROR_EPERM, ERROR_ENOTDIR, ERROR_ENOENT, ERROR_EACCES, ERROR_EINVAL,
+            ERROR_INDEXTOOBIG, ERROR_CHUNKLOST, ERROR_NOSPACE, ERROR_QUOTA, ERROR_EROFS:
+            return false
         }
-        f.dirnamecache = names
-    } else {
-        names = f.dirnamecache
     }
+    return true
+}
 
-    if len(names) < int(f.offset) {
-        return nil, nil
+// writeRetryDelay returns how long to wait before attempt try (counted from 1).
+func (c *Client) writeRetryDelay(try int, err error) time.Duration {
+    d := c.WriteRetryDelay
+    for i := 1; i < try && d < WRITE_RETRY_MAX_DELAY; i++ {
+        d *= 2
     }
-    names = names[f.offset:]
-    if count > 0 && len(names) > count {
-        names = names[:count]
+    // the master needs time to notice chunkservers coming back
+    if e, ok := err.(Error); ok && e == ERROR_NOCHUNKSERVERS && d < time.Second {
+        d = time.Second
     }
-    f.offset += int64(len(names))
-    return
+    if d > WRITE_RETRY_MAX_DELAY {
+        d = WRITE_RETRY_MAX_DELAY
+    }
+    return d
 }
 
-func (f *File) Chmod(mode uint32) error {
-    // TODO
-    return errors.New("Not Impl")
-}
+// writeChunk sends the extents of chunk chindx to the chunkservers. On
+// failure the chunk is released with WriteEnd and the write starts over with
+// a new version and chain of chunkservers from the master.
+func (f *File) writeChunk(chindx uint32, exts []*extent) (err error) {
+    c := f.client
+    tries := c.WriteRetries
+    if tries < 1 {
+        tries = 1
+    }
+    for try := 0; try < tries; try++ {
+        if try > 0 {
+            c.hooks.logger().Warn("write chunk failed, retrying", "inode", f.inode,
+                "index", chindx, "try", try, "err", err)
+            time.Sleep(c.writeRetryDelay(try, err))
+        }
 
-func (f *File) Sync() error {
-    for len(f.wbuf) > 0 {
-        chindx := f.woff >> 26
-        info, err := f.client.getMasterConn().WriteChunk(f.inode, uint32(chindx))
+        var info *Chunk
+        info, err = c.getMasterConn().WriteChunk(f.inode, chindx)
         if err != nil {
-            return errors.New("write chunk failed:" + err.Error())
+            if !canRetryWrite(err) {
+                return errors.New("write chunk failed:" + err.Error())
+            }
+            continue
+        }
+        c.setupChunk(info, f.inode)
+
+        for _, e := range exts {
+            if _, err = info.Write(e.data, uint32(e.off%CHUNK_SIZE)); err != nil {
+                break
+            }
         }
-        off := f.woff & 0x3ffffff
-        size := min(len(f.wbuf), int(1<<26-off))
-        _, err = info.Write(f.wbuf[:size], uint32(off))
         if err != nil {
-            return errors.New("write data to chunk server: " + err.Error())
+            // unlock the chunk, the length 0 leaves the file size untouched
+            c.getMasterConn().WriteEnd(info.id, f.inode, 0)
+            if !canRetryWrite(err) {
+                return errors.New("write data to chunk server: " + err.Error())
+            }
+            if len(info.csdata) >= 6 && try < tries-1 {
+                c.metrics.retry(parseAddr(info.csdata))
+            }
+            continue
         }
 
-        length := off + int64(size)
-        err = f.client.getMasterConn().WriteEnd(info.id, f.inode, uint64(length))
+        length := uint64(exts[len(exts)-1].end())
+        err = c.getMasterConn().WriteEnd(info.id, f.inode, length)
         if err != nil {
             return errors.New("write end to ms: " + err.Error())
         }
-        delete(f.cscache, info.id)
-        f.wbuf = f.wbuf[size:]
-        f.woff += int64(size)
+        return nil
     }
-    return nil
+    return errors.New("write chunk failed after " + strconv.Itoa(tries) + " tries: " + err.Error())
 }
 
 func (f *File) Truncate(size int64) error {
-    _, err := f.client.getMasterConn().Truncate(f.inode, 1, size)
-    f.woff = 0
-    f.wbuf = nil
+    if !f.writable() {
+        return syscall.EBADF
+    }
+    f.mutex.Lock()
+    defer f.mutex.Unlock()
+
+    fi, err := f.client.getMasterConn().Truncate(f.inode, 1, size)
+    f.client.chunks.invalidateInode(f.inode)
+    f.client.stale(f.inode)
+    f.dirty.truncate(size)
+    atomic.AddUint64(&f.wgen, 1)
+    if err == nil {
+        fi.name = path.Base(f.path)
+        f.imutex.Lock()
+        f.info = fi
+        f.imutex.Unlock()
+    }
     return err
 }
 
 func (f *File) needSync() bool {
-    return len(f.wbuf) > 1024*1024
+    return f.dirty.size > 1024*1024
 }
 
 func (f *File) Write(b []byte) (int, error) {
-    f.wbuf = append(f.wbuf, b...)
-    f.offset += int64(len(b))
+    if !f.writable() {
+        return 0, syscall.EBADF
+    }
+    f.rmutex.Lock()
+    defer f.rmutex.Unlock()
 
-    if f.needSync() {
-        if err := f.Sync(); err != nil {
+    if f.flag&os.O_APPEND != 0 {
+        end, err := f.appendOffset()
+        if err != nil {
             return 0, err
         }
+        f.offset = end
     }
-
-    return len(b), nil
+    n, err := f.writeAt(b, f.offset)
+    f.offset += int64(n)
+    return n, err
+}
+
+// appendOffset returns the end of the file for O_APPEND. The length is
+// asked from the master when nothing is buffered, otherwise the data
+// buffered so far ends the file unless the length last seen is larger.
+func (f *File) appendOffset() (int64, error) {
+    f.mutex.RLock()
+    end := f.dirty.end()
+    buffered := f.dirty.size > 0
+    f.mutex.RUnlock()
+    if !buffered {
+        f.imutex.Lock()
+        f.info = nil
+        f.imutex.Unlock()
+    }
+    fi, err := f.Stat()
+    if err != nil {
+        return 0, err
+    }
+    if end > fi.Size() {
+        return end, nil
+    }
+    return fi.Size(), nil
 }
 
+// WriteAt buffers b to be written at off. Writes may overlap or come in any
+// order, the data is sent to the chunkservers by Sync, or once enough of it
+// is buffered.
 func (f *File) WriteAt(b []byte, off int64) (int, error) {
-    if off < f.woff || off > f.woff+int64(len(f.wbuf)) {
-        if e := f.Sync(); e != nil {
-            return 0, e
+    if f.flag&os.O_APPEND != 0 {
+        return 0, errors.New("invalid use of WriteAt on file opened with O_APPEND")
+    }
+    if !f.writable() {
+        return 0, syscall.EBADF
+    }
+    return f.writeAt(b, off)
+}
+
+func (f *File) writeAt(b []byte, off int64) (int, error) {
+    if off < 0 {
+        return 0, syscall.EINVAL
+    }
+    f.mutex.Lock()
+    defer f.mutex.Unlock()
+
+    f.dirty.write(b, off)
+    // the read buffer may hold the old data
+    atomic.AddUint64(&f.wgen, 1)
+
+    if f.needSync() {
+        if err := f.sync(); err != nil {
+            return 0, err
         }
-        f.woff = off
     }
 
-    return f.Write(b)
+    return len(b), nil
 }
 
 func (f *File) WriteString(s string) (int, error) {
@@ -692,3 +1207,7 @@ func Chdir(dir string) error {
 func PurgeINodeCache(path string) (n_purged int, err error) {
     return client.PurgeINodeCache(path)
 }
+
+func Statfs() (*StatInfo, error) {
+    return client.Statfs()
+}
@@ -1,11 +1,36 @@
 package moosefs
 
 import (
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "fmt"
     "io"
+    "io/fs"
+    "io/ioutil"
+    "moosefstest"
     "os"
+    "sync"
+    "syscall"
     "testing"
+    "time"
 )
 
+var testMaster *moosefstest.Master
+
+func TestMain(m *testing.M) {
+    var err error
+    testMaster, err = moosefstest.Start(2)
+    if err != nil {
+        fmt.Println("start fake master:", err)
+        os.Exit(1)
+    }
+    Init(testMaster.Addr(), false)
+    code := m.Run()
+    testMaster.Close()
+    os.Exit(code)
+}
+
 func TestAPI(t *testing.T) {
     if err := Chdir("/"); err != nil {
         t.Error("chdir fail")
@@ -88,7 +113,7 @@ func TestPurgeINodeCache(t *testing.T) {
     f.Close()
 
     // initialize another client to get stats
-    client := NewClient("mfsmaster", "/", true)
+    client := NewClient(testMaster.Addr(), "/", true)
 
     // assert file size == 0
     fi, err := client.Stat(path)
@@ -159,7 +184,7 @@ func TestDisableCache(t *testing.T) {
     f.Close()
 
     // initialize another client (cache disabled) to get stats
-    client := NewClient("mfsmaster", "/", false)
+    client := NewClient(testMaster.Addr(), "/", false)
 
     // assert file size == 0
     fi, err := client.Stat(path)
@@ -199,3 +224,383 @@ func TestDisableCache(t *testing.T) {
         t.Error("remove failed", err.Error())
     }
 }
+
+func testData(size int) []byte {
+    data := make([]byte, size)
+    for i := range data {
+        data[i] = byte(i * 7 / 3)
+    }
+    return data
+}
+
+func writeTestFile(t *testing.T, c *Client, name string, data []byte) {
+    f, err := c.Create(name)
+    if err != nil {
+        t.Fatal("create", err)
+    }
+    if _, err := f.Write(data); err != nil {
+        t.Error("write", err)
+    }
+    if err := f.Close(); err != nil {
+        t.Error("close", err)
+    }
+}
+
+func TestReadWriteBlocks(t *testing.T) {
+    data := testData(3*MFS_BLOCK_SIZE + 123)
+    writeTestFile(t, client, "blocks", data)
+    defer Remove("blocks")
+
+    f, err := Open("blocks")
+    if err != nil {
+        t.Fatal("open", err)
+    }
+    defer f.Close()
+    if got, err := ioutil.ReadAll(f); err != nil || !bytes.Equal(got, data) {
+        t.Error("read back", len(got), err)
+    }
+    buf := make([]byte, 1000)
+    if n, err := f.ReadAt(buf, MFS_BLOCK_SIZE-500); n != 1000 || err != nil {
+        t.Error("readat", n, err)
+    } else if !bytes.Equal(buf, data[MFS_BLOCK_SIZE-500:MFS_BLOCK_SIZE+500]) {
+        t.Error("readat across blocks")
+    }
+}
+
+func TestSparse(t *testing.T) {
+    f, err := Create("sparse")
+    if err != nil {
+        t.Fatal("create", err)
+    }
+    defer Remove("sparse")
+    if _, err := f.WriteAt([]byte("x"), CHUNK_SIZE+10); err != nil {
+        t.Error("writeat", err)
+    }
+    f.Close()
+
+    f, _ = Open("sparse")
+    defer f.Close()
+    if fi, err := f.Stat(); err != nil || fi.Size() != CHUNK_SIZE+11 {
+        t.Error("size", fi, err)
+    }
+    buf := []byte{1, 1, 1, 1}
+    if n, err := f.ReadAt(buf, 100); n != 4 || err != nil || !bytes.Equal(buf, make([]byte, 4)) {
+        t.Error("read hole", n, err, buf)
+    }
+    if off, err := f.SeekData(0); off != CHUNK_SIZE || err != nil {
+        t.Error("seek data", off, err)
+    }
+}
+
+func TestWriteFaults(t *testing.T) {
+    c := NewClient(testMaster.Addr(), "/", false)
+    defer c.Close()
+    c.WriteRetryDelay = time.Millisecond
+
+    testMaster.SetFault(moosefstest.FailCommand(CUTOMA_FUSE_WRITE_CHUNK, ERROR_LOCKED, 2))
+    defer testMaster.SetFault(nil)
+    css := testMaster.ChunkServers()
+    fault := moosefstest.FailCommand(CUTOCS_WRITE_DATA, ERROR_IO, 1)
+    for _, cs := range css {
+        cs.SetFault(fault)
+        defer cs.SetFault(nil)
+    }
+
+    before := testMaster.Count(CUTOMA_FUSE_WRITE_CHUNK)
+    data := testData(2*MFS_BLOCK_SIZE + 1)
+    writeTestFile(t, c, "faulty", data)
+    defer c.Remove("faulty")
+    if n := testMaster.Count(CUTOMA_FUSE_WRITE_CHUNK) - before; n != 4 {
+        t.Error("write chunk requests", n)
+    }
+    if got, err := c.ReadFile("faulty"); err != nil || !bytes.Equal(got, data) {
+        t.Error("read back", len(got), err)
+    }
+
+    c.WriteRetries = 2
+    testMaster.SetFault(moosefstest.FailCommand(CUTOMA_FUSE_WRITE_CHUNK, ERROR_NOSPACE, -1))
+    f, _ := c.OpenFile("faulty", os.O_RDWR, 0)
+    f.Write([]byte("more"))
+    if err := f.Sync(); err == nil {
+        t.Error("write without space succeeded")
+    }
+    f.Close()
+}
+
+func TestReadFailover(t *testing.T) {
+    data := testData(MFS_BLOCK_SIZE + 10)
+    writeTestFile(t, client, "failover", data)
+    defer Remove("failover")
+
+    css := testMaster.ChunkServers()
+    if len(css) < 2 {
+        t.Fatal("need two chunkservers")
+    }
+    faults := []moosefstest.FaultFunc{
+        moosefstest.DropCommand(CUTOCS_READ, -1),
+        moosefstest.FailCommand(CUTOCS_READ, ERROR_IO, -1),
+        func(cmd uint32, payload []byte) *moosefstest.Fault {
+            return &moosefstest.Fault{Corrupt: true}
+        },
+    }
+    for i, fault := range faults {
+        css[0].SetFault(fault)
+        c := NewClient(testMaster.Addr(), "/", false)
+        if got, err := c.ReadFile("failover"); err != nil || !bytes.Equal(got, data) {
+            t.Error("read with fault", i, len(got), err)
+        }
+        c.Close()
+    }
+    css[0].SetFault(nil)
+}
+
+func TestOpenFlags(t *testing.T) {
+    c := NewClient(testMaster.Addr(), "/", false)
+    defer c.Close()
+
+    f, err := c.OpenFile("excl", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+    if err != nil {
+        t.Fatal("create excl", err)
+    }
+    defer c.Remove("excl")
+    if _, err := f.Read(make([]byte, 1)); err != syscall.EBADF {
+        t.Error("read from write only file", err)
+    }
+    f.WriteString("a")
+    f.Close()
+    if _, err := c.OpenFile("excl", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644); !errors.Is(err, fs.ErrExist) {
+        t.Error("create existing file with O_EXCL", err)
+    }
+
+    f, _ = c.Open("excl")
+    if _, err := f.Write([]byte("x")); err != syscall.EBADF {
+        t.Error("write to read only file", err)
+    }
+    if err := f.Truncate(0); err != syscall.EBADF {
+        t.Error("truncate read only file", err)
+    }
+    f.Close()
+
+    f1, _ := c.OpenFile("excl", os.O_WRONLY|os.O_APPEND, 0)
+    f2, _ := c.OpenFile("excl", os.O_WRONLY|os.O_APPEND, 0)
+    f1.WriteString("b")
+    f1.Sync()
+    f2.WriteString("c")
+    f2.WriteString("d")
+    f2.Close()
+    f1.WriteString("e")
+    f1.Close()
+    if got, _ := c.ReadFile("excl"); string(got) != "abcde" {
+        t.Error("append", string(got))
+    }
+    if _, err := f1.WriteAt([]byte("x"), 0); err == nil {
+        t.Error("WriteAt with O_APPEND")
+    }
+
+    c.Chmod("excl", 0444)
+    for _, mc := range c.mcs {
+        mc.uid, mc.gid = 1000, 1000
+    }
+    if _, err := c.OpenFile("excl", os.O_RDWR, 0); !errors.Is(err, fs.ErrPermission) {
+        t.Error("open read only file for writing", err)
+    }
+    if f, err := c.Open("excl"); err != nil {
+        t.Error("open for reading", err)
+    } else {
+        f.Close()
+    }
+    for _, mc := range c.mcs {
+        mc.uid, mc.gid = 0, 0
+    }
+}
+
+func TestAppendBuffered(t *testing.T) {
+    c := NewClient(testMaster.Addr(), "/", false)
+    defer c.Close()
+    writeTestFile(t, c, "appended", []byte("a"))
+    defer c.Remove("appended")
+
+    var mutex sync.Mutex
+    ops := make(map[string]int)
+    c.AddInterceptor(func(op *Op, next func() error) error {
+        mutex.Lock()
+        ops[op.Command]++
+        mutex.Unlock()
+        return next()
+    })
+    f, err := c.OpenFile("appended", os.O_WRONLY|os.O_APPEND, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, s := range []string{"b", "c", "d", "e"} {
+        f.WriteString(s)
+    }
+    if err := f.Close(); err != nil {
+        t.Error(err)
+    }
+    mutex.Lock()
+    if ops["WRITE_CHUNK"] != 1 || ops["GETATTR"] > 1 {
+        t.Error("appends not buffered", ops)
+    }
+    mutex.Unlock()
+    if got, _ := c.ReadFile("appended"); string(got) != "abcde" {
+        t.Error("append", string(got))
+    }
+}
+
+func TestFileInfoSys(t *testing.T) {
+    c := NewClient(testMaster.Addr(), "/", false)
+    defer c.Close()
+
+    writeTestFile(t, c, "/sys1", []byte("x"))
+    defer c.Remove("/sys1")
+    if err := c.Link("/sys1", "/sys2"); err != nil {
+        t.Fatal("link", err)
+    }
+    defer c.Remove("/sys2")
+    fi1, _ := c.Stat("/sys1")
+    fi2, _ := c.Stat("/sys2")
+    st1, ok1 := fi1.Sys().(*Stat_t)
+    st2, ok2 := fi2.Sys().(*Stat_t)
+    if !ok1 || !ok2 || st1.Inode != st2.Inode || st1.Nlink != 2 || st1.Type != TYPE_FILE {
+        t.Fatal("hard link", st1, st2)
+    }
+    if st1.Mtime != fi1.ModTime() || st1.Uid != 0 {
+        t.Error("stat", st1)
+    }
+
+    mc := c.getMasterConn()
+    nodes := []struct {
+        name string
+        typ  uint8
+        mode os.FileMode
+    }{
+        {"/fifo", TYPE_FIFO, os.ModeNamedPipe},
+        {"/sock", TYPE_SOCKET, os.ModeSocket},
+        {"/blk", TYPE_BLOCKDEV, os.ModeDevice},
+        {"/chr", TYPE_CHARDEV, os.ModeDevice | os.ModeCharDevice},
+    }
+    for _, n := range nodes {
+        if _, err := mc.Mknod(MFS_ROOT_ID, n.name[1:], n.typ, 0640|S_ISGID, 8<<16|1); err != nil {
+            t.Fatal("mknod", n.name, err)
+        }
+        defer c.Remove(n.name)
+        fi, err := c.Lstat(n.name)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if fi.Mode() != n.mode|os.ModeSetgid|0640 {
+            t.Error("mode of", n.name, fi.Mode())
+        }
+        st := fi.Sys().(*Stat_t)
+        if n.mode&os.ModeDevice != 0 && (st.Major() != 8 || st.Minor() != 1 || fi.Size() != 0) {
+            t.Error("rdev of", n.name, st.Rdev, fi.Size())
+        }
+    }
+}
+
+func TestConcurrentFile(t *testing.T) {
+    const workers, size = 4, MFS_BLOCK_SIZE + 100
+    f, err := Create("/concurrent")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer Remove("/concurrent")
+    defer f.Close()
+
+    var wg sync.WaitGroup
+    for w := 0; w < workers; w++ {
+        wg.Add(1)
+        go func(w int) {
+            defer wg.Done()
+            data := bytes.Repeat([]byte{byte('a' + w)}, size)
+            off := int64(w * size)
+            buf := make([]byte, size)
+            for i := 0; i < 5; i++ {
+                if _, err := f.WriteAt(data, off); err != nil {
+                    t.Error("write", err)
+                    return
+                }
+                if n, err := f.ReadAt(buf, off); err != nil || n != size || !bytes.Equal(buf, data) {
+                    t.Error("read back", w, n, err)
+                    return
+                }
+            }
+        }(w)
+    }
+    for i := 0; i < 2; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for j := 0; j < 5; j++ {
+                if err := f.Sync(); err != nil {
+                    t.Error("sync", err)
+                }
+                if _, err := f.Stat(); err != nil {
+                    t.Error("stat", err)
+                }
+            }
+        }()
+    }
+    wg.Wait()
+
+    if err := f.Sync(); err != nil {
+        t.Fatal(err)
+    }
+    got, err := client.ReadFile("/concurrent")
+    if err != nil || len(got) != workers*size {
+        t.Fatal("read", len(got), err)
+    }
+    for w := 0; w < workers; w++ {
+        if !bytes.Equal(got[w*size:(w+1)*size], bytes.Repeat([]byte{byte('a' + w)}, size)) {
+            t.Error("data of worker", w)
+        }
+    }
+}
+
+func TestWriteIDs(t *testing.T) {
+    var mutex sync.Mutex
+    var ids []uint32
+    css := testMaster.ChunkServers()
+    for _, cs := range css {
+        cs.SetFault(func(cmd uint32, payload []byte) *moosefstest.Fault {
+            if cmd == CUTOCS_WRITE_DATA {
+                mutex.Lock()
+                ids = append(ids, binary.BigEndian.Uint32(payload[8:]))
+                mutex.Unlock()
+            }
+            return nil
+        })
+    }
+    writeTestFile(t, client, "/writeids", testData(3*MFS_BLOCK_SIZE))
+    defer Remove("/writeids")
+    for _, cs := range css {
+        cs.SetFault(nil)
+    }
+
+    // writeid 0 is the answer to CUTOCS_WRITE, the blocks count from 1
+    if len(ids) != 3 || ids[0] != 1 || ids[1] != 2 || ids[2] != 3 {
+        t.Error("write ids", ids)
+    }
+}
+
+func TestGrownByOtherClient(t *testing.T) {
+    c1 := NewClient(testMaster.Addr(), "/", false)
+    defer c1.Close()
+    c2 := NewClient(testMaster.Addr(), "/", false)
+    defer c2.Close()
+    writeTestFile(t, c1, "grown", []byte("a"))
+    defer c1.Remove("grown")
+    // caches the location of the chunk with the length 1
+    if got, _ := c1.ReadFile("grown"); string(got) != "a" {
+        t.Error("read", string(got))
+    }
+
+    // no chunk is written, so reading the old one still works
+    if err := c2.Truncate("grown", 4); err != nil {
+        t.Fatal(err)
+    }
+    if got, _ := c1.ReadFile("grown"); string(got) != "a\x00\x00\x00" {
+        t.Error("new open read the old length", string(got))
+    }
+}
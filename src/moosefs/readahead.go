@@ -0,0 +1,187 @@
+package moosefs
+
+import (
+    "errors"
+    "io"
+    "sync/atomic"
+    "time"
+)
+
+// sizes of the read buffer of a File, which grows while the file is read
+// sequentially and the chunkservers can't keep up with the reader
+const (
+    READAHEAD_MIN     = 1 * 1024 * 1024
+    READAHEAD_INIT    = 4 * 1024 * 1024
+    READAHEAD_MAX     = 32 * 1024 * 1024
+    READAHEAD_WINDOWS = 2 // windows fetched in the background
+)
+
+// the error of a prefetch stopped by drop
+var errPrefetchCanceled = errors.New("prefetch canceled")
+
+// prefetch is a window of a file being read in the background.
+type prefetch struct {
+    off    int64
+    buf    []byte
+    gen    uint64 // wgen of the file when the read started
+    cancel chan struct{}
+    done   chan struct{}
+
+    n    int
+    err  error
+    took time.Duration
+}
+
+// readahead tracks how a File is read by Read, and prefetches the windows
+// following the read buffer as long as the reads are sequential.
+type readahead struct {
+    window  int
+    next    int64 // where a sequential read continues
+    seq     int   // sequential fills in a row
+    filled  time.Time
+    pending []*prefetch
+}
+
+// drop cancels the prefetched windows and waits for their goroutines, so
+// that nothing is read for a File once it is closed.
+func (ra *readahead) drop() {
+    for _, p := range ra.pending {
+        close(p.cancel)
+    }
+    for _, p := range ra.pending {
+        <-p.done
+    }
+    ra.pending = nil
+}
+
+// pop returns the window prefetched at off, if any.
+func (ra *readahead) pop(off int64) *prefetch {
+    if len(ra.pending) == 0 || ra.pending[0].off != off {
+        ra.drop()
+        return nil
+    }
+    p := ra.pending[0]
+    ra.pending = ra.pending[1:]
+    return p
+}
+
+// adapt resizes the window after p was consumed. It grows when the reader
+// had to wait for the chunkservers, and shrinks when the reader is so slow
+// that big windows only waste memory.
+func (ra *readahead) adapt(p *prefetch, waited, consumed time.Duration) {
+    if waited > p.took/4 {
+        ra.window *= 2
+        if ra.window > READAHEAD_MAX {
+            ra.window = READAHEAD_MAX
+        }
+    } else if p.took < consumed/8 {
+        ra.window /= 2
+        if ra.window < READAHEAD_MIN {
+            ra.window = READAHEAD_MIN
+        }
+    }
+}
+
+// schedule starts reading the windows after the read buffer in background.
+func (ra *readahead) schedule(f *File, gen uint64, size int64) {
+    end := ra.next
+    if len(ra.pending) > 0 {
+        last := ra.pending[len(ra.pending)-1]
+        end = last.off + int64(len(last.buf))
+    }
+    for len(ra.pending) < READAHEAD_WINDOWS && end < size {
+        n := int64(ra.window)
+        if size-end < n {
+            n = size - end
+        }
+        p := &prefetch{off: end, buf: make([]byte, n), gen: gen,
+            cancel: make(chan struct{}), done: make(chan struct{})}
+        go p.run(f)
+        ra.pending = append(ra.pending, p)
+        end += n
+    }
+}
+
+// run reads the window by pieces of READAHEAD_MIN, checking between them
+// whether it was canceled.
+func (p *prefetch) run(f *File) {
+    defer close(p.done)
+    start := time.Now()
+    for p.n < len(p.buf) {
+        select {
+        case <-p.cancel:
+            p.err = errPrefetchCanceled
+            return
+        default:
+        }
+        end := min(p.n+READAHEAD_MIN, len(p.buf))
+        n, err := f.ReadAt(p.buf[p.n:end], p.off+int64(p.n))
+        p.n += n
+        if err != nil {
+            p.err = err
+            break
+        }
+    }
+    p.took = time.Since(start)
+}
+
+// fill loads the read buffer at the current offset, from the prefetched
+// windows if the file is read sequentially. The caller holds rmutex.
+func (f *File) fill() error {
+    ra := &f.ra
+    if ra.window == 0 {
+        ra.window = READAHEAD_INIT
+    }
+    off := f.offset
+    gen := atomic.LoadUint64(&f.wgen)
+    size := f.Len()
+    if off >= size {
+        return io.EOF
+    }
+
+    consumed := time.Since(ra.filled)
+    if off == ra.next {
+        ra.seq++
+    } else {
+        // random access, stop reading ahead
+        ra.seq = 0
+        ra.window = READAHEAD_INIT
+    }
+
+    var buf []byte
+    if p := ra.pop(off); p != nil {
+        start := time.Now()
+        <-p.done
+        waited := time.Since(start)
+        if p.gen == gen && p.n > 0 && (p.err == nil || p.err == io.EOF) {
+            buf = p.buf[:p.n]
+            ra.adapt(p, waited, consumed)
+        } else {
+            ra.drop()
+        }
+    }
+    if buf == nil {
+        rsize := int64(ra.window)
+        if size-off < rsize {
+            rsize = size - off
+        }
+        if cap(f.rbuf) < int(rsize) {
+            buf = make([]byte, rsize)
+        } else {
+            buf = f.rbuf[:rsize]
+        }
+        n, err := f.ReadAt(buf, off)
+        if n == 0 {
+            return err
+        }
+        buf = buf[:n]
+    }
+
+    f.rbuf, f.roff, f.rgen = buf, off, gen
+    ra.next = off + int64(len(buf))
+    ra.filled = time.Now()
+    if ra.seq > 0 {
+        ra.schedule(f, gen, size)
+    }
+    return nil
+}
@@ -0,0 +1,99 @@
+package moosefs
+
+import (
+    "encoding/binary"
+    "io"
+    "moosefstest"
+    "testing"
+    "time"
+)
+
+func TestReadaheadAdapt(t *testing.T) {
+    ra := readahead{window: READAHEAD_INIT}
+    p := &prefetch{took: time.Millisecond}
+    // the reader waited for the chunkservers
+    for i := 0; i < 5; i++ {
+        ra.adapt(p, time.Millisecond, time.Millisecond)
+    }
+    if ra.window != READAHEAD_MAX {
+        t.Error("grown window", ra.window)
+    }
+    // the reader is much slower than the chunkservers
+    for i := 0; i < 10; i++ {
+        ra.adapt(p, 0, time.Second)
+    }
+    if ra.window != READAHEAD_MIN {
+        t.Error("shrunk window", ra.window)
+    }
+}
+
+func TestReadaheadSeek(t *testing.T) {
+    writeTestFile(t, client, "/readahead", testData(3*READAHEAD_INIT))
+    defer Remove("/readahead")
+    f, err := Open("/readahead")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer f.Close()
+
+    buf := make([]byte, 1024)
+    f.Read(buf)
+    if f.ra.seq != 1 || len(f.ra.pending) == 0 {
+        t.Fatal("no prefetch after a sequential read", f.ra.seq, len(f.ra.pending))
+    }
+    f.ra.window = READAHEAD_MAX
+    f.Seek(2*READAHEAD_INIT+100, io.SeekStart)
+    if _, err := f.Read(buf); err != nil {
+        t.Fatal(err)
+    }
+    if f.ra.seq != 0 || f.ra.window != READAHEAD_INIT || len(f.ra.pending) != 0 {
+        t.Error("readahead after seek", f.ra.seq, f.ra.window, len(f.ra.pending))
+    }
+    if want := testData(3 * READAHEAD_INIT)[2*READAHEAD_INIT+100:][:1024]; string(buf) != string(want) {
+        t.Error("data after seek")
+    }
+}
+
+func TestReadaheadDrop(t *testing.T) {
+    writeTestFile(t, client, "/dropped", testData(3*READAHEAD_INIT))
+    defer Remove("/dropped")
+    f, err := Open("/dropped")
+    if err != nil {
+        t.Fatal(err)
+    }
+    css := testMaster.ChunkServers()
+    for _, cs := range css {
+        cs.SetFault(func(cmd uint32, payload []byte) *moosefstest.Fault {
+            // slow down the prefetched windows only
+            if cmd == CUTOCS_READ && binary.BigEndian.Uint32(payload[12:]) >= READAHEAD_INIT {
+                return &moosefstest.Fault{Delay: 20 * time.Millisecond}
+            }
+            return nil
+        })
+    }
+    defer func() {
+        for _, cs := range css {
+            cs.SetFault(nil)
+        }
+    }()
+
+    f.Read(make([]byte, 1024))
+    pending := f.ra.pending
+    if len(pending) == 0 {
+        t.Fatal("no prefetch")
+    }
+
+    f.Close()
+    canceled := false
+    for _, p := range pending {
+        select {
+        case <-p.done:
+        default:
+            t.Fatal("prefetch still running after Close")
+        }
+        canceled = canceled || p.err == errPrefetchCanceled
+    }
+    if !canceled {
+        t.Error("no prefetch was canceled")
+    }
+}
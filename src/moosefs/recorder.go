@@ -0,0 +1,416 @@
+package moosefs
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "io"
+    "net"
+    "strconv"
+    "sync"
+    "time"
+)
+
+// dialFunc opens the connection to a master or a chunkserver
+type dialFunc func(addr string, master bool) (net.Conn, error)
+
+func dialTCP(addr string, master bool) (net.Conn, error) {
+    return net.Dial("tcp", addr)
+}
+
+// magic at the start of a recorder file
+const RECORD_MAGIC = "MFSREC01"
+
+// types of records
+const (
+    RECORD_SEND        = 0 // a packet from the client
+    RECORD_RECV        = 1 // a packet from the server
+    RECORD_MASTER      = 2 // a new connection to a master
+    RECORD_CHUNKSERVER = 3 // a new connection to a chunkserver
+)
+
+// A Record is a packet seen on a connection of a client, or the opening
+// of a connection. A recorder file holds RECORD_MAGIC and then the records
+// as time:64 (unix nanoseconds) conn:32 type:8, followed by cmd:32
+// length:32 payload for packets or length:16 address for connections.
+type Record struct {
+    Time time.Time
+    Conn uint32 // the connection, numbered from 1
+    Type uint8
+    Cmd  uint32
+    Data []byte
+    Addr string // the remote address of a new connection
+}
+
+// Recorder writes the packets of the connections of a client to a file,
+// see Client.SetRecorder.
+type Recorder struct {
+    mutex     sync.Mutex
+    w         *bufio.Writer
+    c         io.Writer
+    next_conn uint32
+    err       error
+}
+
+// NewRecorder starts a recording into w.
+func NewRecorder(w io.Writer) *Recorder {
+    r := &Recorder{w: bufio.NewWriter(w), c: w}
+    _, r.err = r.w.WriteString(RECORD_MAGIC)
+    return r
+}
+
+// Flush writes the buffered records to the underlying writer.
+func (r *Recorder) Flush() error {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    if err := r.w.Flush(); r.err == nil {
+        r.err = err
+    }
+    return r.err
+}
+
+// Close flushes the records and closes the underlying writer if it is an
+// io.Closer. It returns the first error of the recording.
+func (r *Recorder) Close() error {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    if err := r.w.Flush(); r.err == nil {
+        r.err = err
+    }
+    if c, ok := r.c.(io.Closer); ok {
+        if err := c.Close(); r.err == nil {
+            r.err = err
+        }
+    }
+    return r.err
+}
+
+func (r *Recorder) write(rec *Record) {
+    e := newEncoder().u64(uint64(rec.Time.UnixNano())).u32(rec.Conn).u8(rec.Type)
+    if rec.Type == RECORD_MASTER || rec.Type == RECORD_CHUNKSERVER {
+        e.u16(uint16(len(rec.Addr))).str(rec.Addr)
+    } else {
+        e.u32(rec.Cmd).u32(uint32(len(rec.Data))).bytes(rec.Data)
+    }
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    if r.err == nil {
+        _, r.err = r.w.Write(e.buf)
+    }
+}
+
+func (r *Recorder) dial(addr string, master bool) (net.Conn, error) {
+    conn, err := net.Dial("tcp", addr)
+    if err != nil {
+        return nil, err
+    }
+    r.mutex.Lock()
+    r.next_conn++
+    id := r.next_conn
+    r.mutex.Unlock()
+
+    typ := uint8(RECORD_CHUNKSERVER)
+    if master {
+        typ = RECORD_MASTER
+    }
+    r.write(&Record{Time: time.Now(), Conn: id, Type: typ, Addr: addr})
+    rc := &recordConn{Conn: conn, r: r, id: id}
+    rc.send.typ, rc.recv.typ = RECORD_SEND, RECORD_RECV
+    return rc, nil
+}
+
+// recordConn splits the bytes going through a connection into packets
+type recordConn struct {
+    net.Conn
+    r    *Recorder
+    id   uint32
+    send framer
+    recv framer
+}
+
+type framer struct {
+    mutex  sync.Mutex
+    typ    uint8
+    buf    []byte
+    broken bool
+}
+
+// feed adds the bytes b and records the packets completed by them
+func (f *framer) feed(rc *recordConn, b []byte) {
+    f.mutex.Lock()
+    defer f.mutex.Unlock()
+    if f.broken {
+        return
+    }
+    f.buf = append(f.buf, b...)
+    for len(f.buf) >= 8 {
+        size := binary.BigEndian.Uint32(f.buf[4:])
+        if size > MAX_DIR_PACKET_SIZE {
+            // not a packet boundary, give up on this direction
+            f.broken, f.buf = true, nil
+            return
+        }
+        if len(f.buf) < 8+int(size) {
+            return
+        }
+        data := append([]byte(nil), f.buf[8:8+size]...)
+        rc.r.write(&Record{Time: time.Now(), Conn: rc.id, Type: f.typ,
+            Cmd: binary.BigEndian.Uint32(f.buf), Data: data})
+        f.buf = f.buf[8+size:]
+    }
+}
+
+func (rc *recordConn) Write(b []byte) (int, error) {
+    n, err := rc.Conn.Write(b)
+    rc.send.feed(rc, b[:n])
+    return n, err
+}
+
+func (rc *recordConn) Read(b []byte) (int, error) {
+    n, err := rc.Conn.Read(b)
+    rc.recv.feed(rc, b[:n])
+    return n, err
+}
+
+// RecordReader reads the records of a recorder file.
+type RecordReader struct {
+    r     *bufio.Reader
+    magic bool
+}
+
+func NewRecordReader(r io.Reader) *RecordReader {
+    return &RecordReader{r: bufio.NewReader(r)}
+}
+
+// Next returns the next record, or io.EOF at the end of the file.
+func (rr *RecordReader) Next() (*Record, error) {
+    if !rr.magic {
+        magic := make([]byte, len(RECORD_MAGIC))
+        if _, err := io.ReadFull(rr.r, magic); err != nil || string(magic) != RECORD_MAGIC {
+            return nil, errors.New("not a recorder file")
+        }
+        rr.magic = true
+    }
+    hdr := make([]byte, 13)
+    if _, err := io.ReadFull(rr.r, hdr); err != nil {
+        if err == io.ErrUnexpectedEOF {
+            err = errors.New("record: " + errShortPacket.Error())
+        }
+        return nil, err
+    }
+    d := newDecoder(hdr)
+    rec := &Record{Time: time.Unix(0, int64(d.u64())), Conn: d.u32(), Type: d.u8()}
+    switch rec.Type {
+    case RECORD_MASTER, RECORD_CHUNKSERVER:
+        addr, err := rr.read(2)
+        if err != nil {
+            return nil, err
+        }
+        rec.Addr = string(addr)
+    case RECORD_SEND, RECORD_RECV:
+        cmd := make([]byte, 4)
+        if _, err := io.ReadFull(rr.r, cmd); err != nil {
+            return nil, errors.New("record: " + errShortPacket.Error())
+        }
+        rec.Cmd = binary.BigEndian.Uint32(cmd)
+        var err error
+        if rec.Data, err = rr.read(4); err != nil {
+            return nil, err
+        }
+    default:
+        return nil, errors.New("record: unknown type")
+    }
+    return rec, nil
+}
+
+// read reads a length of n bytes followed by as many bytes
+func (rr *RecordReader) read(n int) ([]byte, error) {
+    hdr := make([]byte, n)
+    if _, err := io.ReadFull(rr.r, hdr); err != nil {
+        return nil, errors.New("record: " + errShortPacket.Error())
+    }
+    var size uint64
+    for _, b := range hdr {
+        size = size<<8 | uint64(b)
+    }
+    if size > MAX_DIR_PACKET_SIZE {
+        return nil, errors.New("record: " + errLongPacket.Error())
+    }
+    // grown as the data comes, a broken size doesn't allocate it all
+    data, err := io.ReadAll(io.LimitReader(rr.r, int64(size)))
+    if err != nil || uint64(len(data)) != size {
+        return nil, errors.New("record: " + errShortPacket.Error())
+    }
+    return data, nil
+}
+
+// ReadRecords reads all the records of a recorder file.
+func ReadRecords(r io.Reader) ([]*Record, error) {
+    var recs []*Record
+    rr := NewRecordReader(r)
+    for {
+        rec, err := rr.Next()
+        if err == io.EOF {
+            return recs, nil
+        }
+        if err != nil {
+            return recs, err
+        }
+        recs = append(recs, rec)
+    }
+}
+
+// an exchange is a request and the packets answered to it
+type exchange struct {
+    cmd     uint32
+    data    []byte
+    replies [][]byte
+    used    bool
+}
+
+// Replayer serves the answers of a recording to a client instead of the
+// real master and chunkservers, see Client.SetReplayer. Each request is
+// matched with the first unused recorded one with the same content, or
+// else with the same command, on a connection of the same kind (to the
+// same chunkserver).
+type Replayer struct {
+    mutex     sync.Mutex
+    exchanges map[string][]*exchange
+}
+
+// NewReplayer prepares the replay of recs.
+func NewReplayer(recs []*Record) *Replayer {
+    p := &Replayer{exchanges: make(map[string][]*exchange)}
+    keys := make(map[uint32]string)
+    current := make(map[uint32]*exchange)
+    for _, rec := range recs {
+        switch rec.Type {
+        case RECORD_MASTER:
+            keys[rec.Conn] = replayKey(rec.Addr, true)
+        case RECORD_CHUNKSERVER:
+            keys[rec.Conn] = replayKey(rec.Addr, false)
+        case RECORD_SEND:
+            if rec.Cmd == ANTOAN_NOP {
+                continue
+            }
+            ex := &exchange{cmd: rec.Cmd, data: rec.Data}
+            key := keys[rec.Conn]
+            p.exchanges[key] = append(p.exchanges[key], ex)
+            current[rec.Conn] = ex
+        case RECORD_RECV:
+            if ex := current[rec.Conn]; ex != nil && rec.Cmd != ANTOAN_NOP {
+                ex.replies = append(ex.replies, packet(rec.Cmd, newEncoder().bytes(rec.Data)))
+            }
+        }
+    }
+    return p
+}
+
+// the master may have any address, chunkservers are told apart
+func replayKey(addr string, master bool) string {
+    if master {
+        return "master"
+    }
+    return addr
+}
+
+// answer finds the replies to a request
+func (p *Replayer) answer(key string, cmd uint32, data []byte) ([][]byte, bool) {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+    var found *exchange
+    for _, ex := range p.exchanges[key] {
+        if ex.used || ex.cmd != cmd {
+            continue
+        }
+        if bytes.Equal(ex.data, data) {
+            found = ex
+            break
+        }
+        if found == nil {
+            found = ex
+        }
+    }
+    if found == nil {
+        return nil, false
+    }
+    found.used = true
+    return found.replies, true
+}
+
+func (p *Replayer) dial(addr string, master bool) (net.Conn, error) {
+    return &replayConn{p: p, key: replayKey(addr, master), addr: addr}, nil
+}
+
+// replayConn answers the packets written to it from a Replayer. Reading
+// with no answer pending gives io.EOF, as if the server went away.
+type replayConn struct {
+    p    *Replayer
+    key  string
+    addr string
+
+    mutex  sync.Mutex
+    in     []byte
+    out    bytes.Buffer
+    closed bool
+}
+
+func (c *replayConn) Write(b []byte) (int, error) {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    if c.closed {
+        return 0, net.ErrClosed
+    }
+    c.in = append(c.in, b...)
+    for len(c.in) >= 8 {
+        d := newDecoder(c.in)
+        cmd, size := d.u32(), d.u32()
+        if len(c.in) < 8+int(size) {
+            break
+        }
+        data := c.in[8 : 8+size]
+        c.in = c.in[8+size:]
+        if cmd == ANTOAN_NOP {
+            continue
+        }
+        replies, ok := c.p.answer(c.key, cmd, data)
+        if !ok {
+            return len(b), errors.New("replay: no recorded answer to command " + strconv.Itoa(int(cmd)))
+        }
+        for _, r := range replies {
+            c.out.Write(r)
+        }
+    }
+    return len(b), nil
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    if c.closed {
+        return 0, net.ErrClosed
+    }
+    if c.out.Len() == 0 {
+        return 0, io.EOF
+    }
+    return c.out.Read(b)
+}
+
+func (c *replayConn) Close() error {
+    c.mutex.Lock()
+    c.closed = true
+    c.mutex.Unlock()
+    return nil
+}
+
+type replayAddr string
+
+func (a replayAddr) Network() string { return "replay" }
+func (a replayAddr) String() string  { return string(a) }
+
+func (c *replayConn) LocalAddr() net.Addr                { return replayAddr("client") }
+func (c *replayConn) RemoteAddr() net.Addr               { return replayAddr(c.addr) }
+func (c *replayConn) SetDeadline(t time.Time) error      { return nil }
+func (c *replayConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *replayConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,79 @@
+package moosefs
+
+import (
+    "bytes"
+    "io/ioutil"
+    "moosefstest"
+    "testing"
+)
+
+// recordedSession writes and reads back a file with c
+func recordedSession(c *Client, data []byte) ([]byte, error) {
+    f, err := c.Create("recorded")
+    if err != nil {
+        return nil, err
+    }
+    if _, err = f.Write(data); err != nil {
+        return nil, err
+    }
+    if err = f.Close(); err != nil {
+        return nil, err
+    }
+    f, err = c.Open("recorded")
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+    return ioutil.ReadAll(f)
+}
+
+func TestRecordReplay(t *testing.T) {
+    m, err := moosefstest.Start(1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    data := bytes.Repeat([]byte("recorded traffic "), 10000)
+
+    var file bytes.Buffer
+    rec := NewRecorder(&file)
+    c := NewClient(m.Addr(), "/", false)
+    c.SetRecorder(rec)
+    got, err := recordedSession(c, data)
+    if err != nil || !bytes.Equal(got, data) {
+        t.Fatal("record:", err)
+    }
+    c.Close()
+    m.Close()
+    if err = rec.Close(); err != nil {
+        t.Fatal(err)
+    }
+
+    recs, err := ReadRecords(bytes.NewReader(file.Bytes()))
+    if err != nil {
+        t.Fatal(err)
+    }
+    var masters, chunkservers int
+    for _, r := range recs {
+        switch r.Type {
+        case RECORD_MASTER:
+            masters++
+        case RECORD_CHUNKSERVER:
+            chunkservers++
+        }
+    }
+    if masters == 0 || chunkservers == 0 {
+        t.Error("connections not recorded", masters, chunkservers)
+    }
+
+    // the master is gone, everything comes from the recording
+    c = NewClient(m.Addr(), "/", false)
+    c.SetReplayer(NewReplayer(recs))
+    defer c.Close()
+    got, err = recordedSession(c, data)
+    if err != nil {
+        t.Fatal("replay:", err)
+    }
+    if !bytes.Equal(got, data) {
+        t.Error("replay read other data")
+    }
+}
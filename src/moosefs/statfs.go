@@ -0,0 +1,63 @@
+package moosefs
+
+import (
+    "errors"
+    "sync"
+    "time"
+)
+
+// how long the answer of statfs is trusted by CheckSpace
+const STATFS_CACHE_TTL = time.Second
+
+// Sync checks the free space before writing this much data
+const LARGE_WRITE_SIZE = 1024 * 1024
+
+// spaceCheck keeps the last answer of statfs for CheckSpace
+type spaceCheck struct {
+    sync.Mutex
+    stat   *StatInfo
+    expire time.Time
+}
+
+// Statfs returns the usage of the cluster.
+func (c *Client) Statfs() (*StatInfo, error) {
+    stat, err := c.getMasterConn().StatFS()
+    if err != nil {
+        return nil, err
+    }
+    c.space.Lock()
+    c.space.stat, c.space.expire = stat, time.Now().Add(STATFS_CACHE_TTL)
+    c.space.Unlock()
+    s := *stat
+    return &s, nil
+}
+
+// CheckSpace returns ERROR_NOSPACE if writing size bytes would leave less
+// than MinFreeSpace available in the cluster. It is done by Sync before
+// writing large amounts of data, and may be used to refuse a big job
+// early. The usage is asked to the master at most once per
+// STATFS_CACHE_TTL, and the space checked is taken from it meanwhile.
+// A negative size is rejected with ERROR_EINVAL.
+func (c *Client) CheckSpace(size int64) error {
+    if size < 0 {
+        return Error(ERROR_EINVAL)
+    }
+    c.space.Lock()
+    stat := c.space.stat
+    if stat == nil || time.Now().After(c.space.expire) {
+        c.space.Unlock()
+        if _, err := c.Statfs(); err != nil {
+            return errors.New("statfs: " + err.Error())
+        }
+        c.space.Lock()
+        stat = c.space.stat
+    }
+    defer c.space.Unlock()
+
+    need := uint64(size) + c.MinFreeSpace
+    if stat.AvailSpace < need {
+        return Error(ERROR_NOSPACE)
+    }
+    stat.AvailSpace -= uint64(size)
+    return nil
+}
@@ -0,0 +1,50 @@
+package moosefs
+
+import (
+    "errors"
+    "moosefstest"
+    "syscall"
+    "testing"
+)
+
+func TestStatfs(t *testing.T) {
+    c := NewClient(testMaster.Addr(), "/", false)
+    defer c.Close()
+
+    stat, err := c.Statfs()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if stat.TotalSpace != moosefstest.DEFAULT_TOTAL_SPACE || stat.AvailSpace > stat.TotalSpace || stat.Inodes == 0 {
+        t.Error("statfs", stat)
+    }
+
+    // small writes are not checked
+    c.MinFreeSpace = stat.TotalSpace
+    writeTestFile(t, c, "/small", []byte("abc"))
+    defer c.Remove("/small")
+
+    f, err := c.Create("/large")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer c.Remove("/large")
+    f.Write(testData(LARGE_WRITE_SIZE))
+    if err := f.Sync(); !errors.Is(err, syscall.ENOSPC) {
+        t.Error("large write with no space left", err)
+    }
+    if err := c.CheckSpace(1); err != Error(ERROR_NOSPACE) {
+        t.Error("check space", err)
+    }
+    if err := c.CheckSpace(-1); err != Error(ERROR_EINVAL) {
+        t.Error("check negative space", err)
+    }
+
+    c.MinFreeSpace = 0
+    if err := f.Close(); err != nil {
+        t.Error("large write", err)
+    }
+    if fi, _ := c.Stat("/large"); fi.Size() != LARGE_WRITE_SIZE {
+        t.Error("size", fi.Size())
+    }
+}
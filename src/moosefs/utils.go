@@ -1,11 +1,11 @@
 package moosefs
 
 import (
-    "bytes"
-    "encoding/binary"
-    "io"
+    "errors"
+    "io/fs"
     "os"
-    "reflect"
+    "strconv"
+    "syscall"
     "time"
 )
 
@@ -15,6 +15,24 @@ func (e Error) Error() string {
     return mfs_strerror(int(e))
 }
 
+// Is makes errors.Is(err, fs.ErrNotExist) and the like work for the
+// status codes of the master.
+func (e Error) Is(target error) bool {
+    switch target {
+    case fs.ErrNotExist:
+        return e == ERROR_ENOENT
+    case fs.ErrExist:
+        return e == ERROR_EEXIST
+    case fs.ErrPermission:
+        return e == ERROR_EPERM || e == ERROR_EACCES
+    case fs.ErrInvalid:
+        return e == ERROR_EINVAL
+    case syscall.ENOSPC:
+        return e == ERROR_NOSPACE
+    }
+    return false
+}
+
 func min(a, b int) int {
     if a < b {
         return a
@@ -22,47 +40,6 @@ func min(a, b int) int {
     return b
 }
 
-func write(w io.Writer, data ...interface{}) {
-    for _, d := range data {
-        binary.Write(w, binary.BigEndian, d)
-    }
-}
-
-func read(r io.Reader, data ...interface{}) {
-    for _, d := range data {
-        binary.Read(r, binary.BigEndian, d)
-    }
-}
-
-func sizeof(d interface{}) int {
-    t := reflect.TypeOf(d)
-    switch t.Kind() {
-    case reflect.String, reflect.Slice:
-        return reflect.ValueOf(d).Len()
-    }
-    return int(t.Size())
-}
-
-func pack(cmd uint32, args ...interface{}) []byte {
-    size := 0
-    for _, arg := range args {
-        size += sizeof(arg)
-    }
-    w := bytes.NewBuffer(nil)
-    write(w, cmd, uint32(size))
-    for _, arg := range args {
-        switch reflect.TypeOf(arg).Kind() {
-        case reflect.String:
-            w.Write([]byte(arg.(string)))
-        case reflect.Slice:
-            w.Write(arg.([]byte))
-        default:
-            write(w, arg)
-        }
-    }
-    return w.Bytes()
-}
-
 // A fileStat is the implementation of FileInfo returned by Stat and Lstat.
 type fileStat struct {
     inode   uint64
@@ -85,46 +62,104 @@ func (fs *fileStat) IsDir() bool        { return fs.mode.IsDir() }
 func (fs *fileStat) IsSymlink() bool    { return fs.mode&os.ModeSymlink != 0 }
 func (fs *fileStat) Sys() interface{}   { return fs.sys }
 
-func attrToFileInfo(inode uint32, attr []byte) *fileStat {
-    if len(attr) != 35 {
-        panic("invalid length")
-    }
-    var fi fileStat
-    r := bytes.NewBuffer(attr)
-    var type_ uint8
-    var mode uint16
-    var uid, gid, atime, mtime, ctime, nlink uint32
-    read(r, &type_, &mode, &uid, &gid, &atime, &mtime, &ctime, &nlink)
+// Stat_t is what Sys returns for the FileInfo of Stat, Lstat and Readdir:
+// the attributes which don't fit in os.FileInfo, like syscall.Stat_t.
+type Stat_t struct {
+    Inode uint32
+    Nlink uint32
+    Uid   uint32
+    Gid   uint32
+    Atime time.Time
+    Mtime time.Time
+    Ctime time.Time
+    Type  uint8  // TYPE_FILE, TYPE_DIRECTORY ...
+    Rdev  uint32 // major:16 minor:16, for devices
+}
 
-    fi.inode = uint64(inode)
-    fi.mode = os.FileMode(mode & 07777)
-    fi.uid = int(uid)
-    fi.gid = int(gid)
-    fi.aTime = time.Unix(int64(atime), 0)
-    fi.modTime = time.Unix(int64(mtime), 0)
-    fi.cTime = time.Unix(int64(ctime), 0)
+// Major returns the major number of a device.
+func (st *Stat_t) Major() uint32 { return st.Rdev >> 16 }
 
-    fi.size = 0
+// Minor returns the minor number of a device.
+func (st *Stat_t) Minor() uint32 { return st.Rdev & 0xffff }
+
+// fileMode converts the type and the mode of an inode to an os.FileMode
+func fileMode(type_ uint8, mode uint16) os.FileMode {
+    m := os.FileMode(mode & 0777)
+    if mode&S_ISUID != 0 {
+        m |= os.ModeSetuid
+    }
+    if mode&S_ISGID != 0 {
+        m |= os.ModeSetgid
+    }
+    if mode&S_ISVTX != 0 {
+        m |= os.ModeSticky
+    }
     switch type_ {
-    case TYPE_DIRECTORY, TYPE_SYMLINK, TYPE_FILE:
-        switch type_ {
-        case TYPE_DIRECTORY:
-            fi.mode |= os.ModeDir
-        case TYPE_SYMLINK:
-            fi.mode |= os.ModeSymlink
-        case TYPE_FILE:
-            var length int64
-            read(r, &length)
-            fi.size = length
-        }
+    case TYPE_FILE:
+    case TYPE_DIRECTORY:
+        m |= os.ModeDir
+    case TYPE_SYMLINK:
+        m |= os.ModeSymlink
+    case TYPE_FIFO:
+        m |= os.ModeNamedPipe
+    case TYPE_BLOCKDEV:
+        m |= os.ModeDevice
+    case TYPE_CHARDEV:
+        m |= os.ModeDevice | os.ModeCharDevice
+    case TYPE_SOCKET:
+        m |= os.ModeSocket
     default:
-        fi.mode = 0
+        // trash and reserved files of the meta filesystem
+        m |= os.ModeIrregular
     }
-    return &fi
+    return m
 }
 
-func newFileInfo(name string, inode uint32, attr []byte) *fileStat {
-    fi := attrToFileInfo(inode, attr)
+// attrToFileInfo decodes the 35 bytes of attributes of inode
+func attrToFileInfo(inode uint32, attr []byte) (*fileStat, error) {
+    if len(attr) != ATTR_SIZE {
+        return nil, errors.New("attr: invalid length " + strconv.Itoa(len(attr)))
+    }
+    var fi fileStat
+    var st Stat_t
+    d := newDecoder(attr)
+    st.Type = d.u8()
+    mode := d.u16()
+    st.Uid, st.Gid = d.u32(), d.u32()
+    atime, mtime, ctime := d.u32(), d.u32(), d.u32()
+    st.Nlink = d.u32()
+    var length uint64
+    switch st.Type {
+    case TYPE_BLOCKDEV, TYPE_CHARDEV:
+        st.Rdev = d.u32()
+        d.u32()
+    default:
+        length = d.u64()
+    }
+    st.Inode = inode
+    st.Atime = time.Unix(int64(atime), 0)
+    st.Mtime = time.Unix(int64(mtime), 0)
+    st.Ctime = time.Unix(int64(ctime), 0)
+
+    fi.inode = uint64(inode)
+    fi.mode = fileMode(st.Type, mode)
+    fi.uid = int(st.Uid)
+    fi.gid = int(st.Gid)
+    fi.aTime = st.Atime
+    fi.modTime = st.Mtime
+    fi.cTime = st.Ctime
+    if st.Type == TYPE_FILE {
+        fi.size = int64(length)
+    }
+    fi.sys = &st
+    return &fi, nil
+}
+
+func newFileInfo(name string, inode uint32, attr []byte) (*fileStat, error) {
+    fi, err := attrToFileInfo(inode, attr)
+    if err != nil {
+        return nil, err
+    }
     fi.name = name
-    return fi
+    return fi, nil
 }
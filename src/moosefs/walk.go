@@ -0,0 +1,293 @@
+package moosefs
+
+import (
+    "io/fs"
+    "os"
+    "path"
+    "path/filepath"
+    "sort"
+    "sync"
+)
+
+// default number of directories listed at once by WalkParallel
+const WALK_WORKERS = 8
+
+// dirEntry is a fs.DirEntry built from the attributes returned by GETDIR.
+type dirEntry struct {
+    fi *fileStat
+}
+
+func (d dirEntry) Name() string               { return d.fi.Name() }
+func (d dirEntry) IsDir() bool                { return d.fi.IsDir() }
+func (d dirEntry) Type() fs.FileMode          { return d.fi.Mode().Type() }
+func (d dirEntry) Info() (fs.FileInfo, error) { return d.fi, nil }
+func (d dirEntry) String() string             { return fs.FormatDirEntry(d) }
+
+// readDir lists a directory with the attributes of its entries, sorted by
+// name.
+func (c *Client) readDir(inode uint32) ([]*fileStat, error) {
+    var fis []*fileStat
+    it := c.newDirIter(inode, true)
+    for it.Next() {
+        fis = append(fis, it.Info().(*fileStat))
+    }
+    if it.Err() != nil {
+        return nil, it.Err()
+    }
+    sort.Slice(fis, func(i, j int) bool { return fis[i].name < fis[j].name })
+    return fis, nil
+}
+
+// Walk walks the tree rooted at root like filepath.Walk does. The
+// attributes of the entries come with the directory listings, so no
+// request is sent to the master for a single file.
+func (c *Client) Walk(root string, fn filepath.WalkFunc) error {
+    info, err := c.Lstat(root)
+    if err != nil {
+        err = fn(root, nil, err)
+    } else {
+        err = c.walk(root, info.(*fileStat), fn)
+    }
+    if err == filepath.SkipDir || err == filepath.SkipAll {
+        return nil
+    }
+    return err
+}
+
+func (c *Client) walk(name string, info *fileStat, fn filepath.WalkFunc) error {
+    if !info.IsDir() {
+        return fn(name, info, nil)
+    }
+
+    fis, err := c.readDir(uint32(info.inode))
+    err1 := fn(name, info, err)
+    if err != nil || err1 != nil {
+        return err1
+    }
+
+    for _, fi := range fis {
+        err = c.walk(path.Join(name, fi.name), fi, fn)
+        if err != nil && (!fi.IsDir() || err != filepath.SkipDir) {
+            return err
+        }
+    }
+    return nil
+}
+
+// WalkDir walks the tree rooted at root like filepath.WalkDir does.
+func (c *Client) WalkDir(root string, fn fs.WalkDirFunc) error {
+    info, err := c.Lstat(root)
+    if err != nil {
+        err = fn(root, nil, err)
+    } else {
+        err = c.walkDir(root, dirEntry{info.(*fileStat)}, fn)
+    }
+    if err == filepath.SkipDir || err == filepath.SkipAll {
+        return nil
+    }
+    return err
+}
+
+func (c *Client) walkDir(name string, d dirEntry, fn fs.WalkDirFunc) error {
+    if err := fn(name, d, nil); err != nil || !d.IsDir() {
+        if err == filepath.SkipDir && d.IsDir() {
+            err = nil
+        }
+        return err
+    }
+
+    fis, err := c.readDir(uint32(d.fi.inode))
+    if err != nil {
+        err = fn(name, d, err)
+        if err != nil {
+            if err == filepath.SkipDir && d.IsDir() {
+                err = nil
+            }
+            return err
+        }
+    }
+
+    for _, fi := range fis {
+        if err := c.walkDir(path.Join(name, fi.name), dirEntry{fi}, fn); err != nil {
+            if err == filepath.SkipDir {
+                break
+            }
+            return err
+        }
+    }
+    return nil
+}
+
+// WalkOptions control WalkParallel.
+type WalkOptions struct {
+    // Workers is the number of directories listed at once.
+    Workers int
+
+    // FollowSymlinks makes the walk descend into symbolic links to
+    // directories. Each directory is visited once even if it is linked
+    // from many places.
+    FollowSymlinks bool
+
+    // OnError is called when a directory can't be listed or a link can't
+    // be followed. The walk stops if it returns an error. Without OnError
+    // the first such error stops the walk.
+    OnError func(name string, err error) error
+}
+
+// WalkFunc is called by WalkParallel for every file and directory.
+type WalkFunc func(name string, info os.FileInfo) error
+
+// WalkParallel walks the tree rooted at root, listing several directories
+// at once. fn is called from many goroutines and in no particular order. If
+// it returns filepath.SkipDir for a directory the directory is not entered,
+// any other error stops the walk and is returned.
+func (c *Client) WalkParallel(root string, opts *WalkOptions, fn WalkFunc) error {
+    if opts == nil {
+        opts = &WalkOptions{}
+    }
+    w := &walker{c: c, opts: opts, fn: fn, visited: make(map[uint64]bool)}
+    w.cond = sync.NewCond(&w.mutex)
+
+    var info os.FileInfo
+    var err error
+    if opts.FollowSymlinks {
+        info, err = c.Stat(root)
+    } else {
+        info, err = c.Lstat(root)
+    }
+    if err != nil {
+        return err
+    }
+    w.visit(root, info.(*fileStat))
+
+    workers := opts.Workers
+    if workers <= 0 {
+        workers = WALK_WORKERS
+    }
+    var wg sync.WaitGroup
+    for i := 0; i < workers; i++ {
+        wg.Add(1)
+        go func() {
+            w.work()
+            wg.Done()
+        }()
+    }
+    wg.Wait()
+
+    if w.err == filepath.SkipDir || w.err == filepath.SkipAll {
+        return nil
+    }
+    return w.err
+}
+
+type walkDir struct {
+    name  string
+    inode uint32
+}
+
+type walker struct {
+    c    *Client
+    opts *WalkOptions
+    fn   WalkFunc
+
+    mutex   sync.Mutex
+    cond    *sync.Cond
+    queue   []walkDir
+    pending int // directories queued or being listed
+    visited map[uint64]bool
+    err     error
+}
+
+func (w *walker) work() {
+    for {
+        w.mutex.Lock()
+        for len(w.queue) == 0 && w.pending > 0 && w.err == nil {
+            w.cond.Wait()
+        }
+        if w.pending == 0 || w.err != nil {
+            w.mutex.Unlock()
+            return
+        }
+        d := w.queue[len(w.queue)-1]
+        w.queue = w.queue[:len(w.queue)-1]
+        w.mutex.Unlock()
+
+        it := w.c.newDirIter(d.inode, true)
+        for it.Next() && !w.stopped() {
+            w.visit(path.Join(d.name, it.Name()), it.Info().(*fileStat))
+        }
+        if it.Err() != nil {
+            w.fail(d.name, it.Err())
+        }
+
+        w.mutex.Lock()
+        w.pending--
+        if w.pending == 0 {
+            w.cond.Broadcast()
+        }
+        w.mutex.Unlock()
+    }
+}
+
+// visit calls fn for an entry and queues it if it is a directory to enter.
+func (w *walker) visit(name string, fi *fileStat) {
+    if fi.IsSymlink() && w.opts.FollowSymlinks {
+        target, err := w.c.Stat(name)
+        if err != nil {
+            w.fail(name, err)
+            return
+        }
+        // the attributes may be shared with the inode cache
+        nfi := *target.(*fileStat)
+        nfi.name = path.Base(name)
+        fi = &nfi
+    }
+
+    err := w.fn(name, fi)
+    if err == filepath.SkipDir && fi.IsDir() {
+        return
+    }
+    if err != nil {
+        w.stop(err)
+        return
+    }
+    if !fi.IsDir() {
+        return
+    }
+
+    w.mutex.Lock()
+    defer w.mutex.Unlock()
+    if w.opts.FollowSymlinks {
+        if w.visited[fi.inode] {
+            return
+        }
+        w.visited[fi.inode] = true
+    }
+    w.queue = append(w.queue, walkDir{name, uint32(fi.inode)})
+    w.pending++
+    w.cond.Signal()
+}
+
+func (w *walker) fail(name string, err error) {
+    if w.opts.OnError != nil {
+        err = w.opts.OnError(name, err)
+    }
+    if err != nil {
+        w.stop(err)
+    }
+}
+
+func (w *walker) stop(err error) {
+    w.mutex.Lock()
+    if w.err == nil {
+        w.err = err
+    }
+    w.cond.Broadcast()
+    w.mutex.Unlock()
+}
+
+func (w *walker) stopped() bool {
+    w.mutex.Lock()
+    defer w.mutex.Unlock()
+    return w.err != nil
+}
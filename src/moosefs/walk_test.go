@@ -0,0 +1,106 @@
+package moosefs
+
+import (
+    "errors"
+    "io/fs"
+    "os"
+    "path/filepath"
+    "reflect"
+    "sort"
+    "sync"
+    "testing"
+)
+
+// makeTree creates /walk with a few directories and files
+func makeTree(t *testing.T, c *Client) {
+    c.MkdirAll("/walk/a", 0755)
+    c.MkdirAll("/walk/b", 0755)
+    for _, name := range []string{"/walk/a/x", "/walk/a/y", "/walk/b/z", "/walk/c"} {
+        writeTestFile(t, c, name, []byte(name))
+    }
+}
+
+var walkAll = []string{"/walk", "/walk/a", "/walk/a/x", "/walk/a/y", "/walk/b", "/walk/b/z", "/walk/c"}
+
+func TestWalk(t *testing.T) {
+    c := NewClient(testMaster.Addr(), "/", false)
+    defer c.Close()
+    makeTree(t, c)
+    defer c.RemoveAll("/walk")
+
+    var names []string
+    err := c.Walk("/walk", func(name string, info os.FileInfo, err error) error {
+        if err != nil {
+            return err
+        }
+        names = append(names, name)
+        if name == "/walk/a" {
+            return filepath.SkipDir
+        }
+        return nil
+    })
+    want := []string{"/walk", "/walk/a", "/walk/b", "/walk/b/z", "/walk/c"}
+    if err != nil || !reflect.DeepEqual(names, want) {
+        t.Error("walk with SkipDir", names, err)
+    }
+
+    names = nil
+    errStop := errors.New("stop")
+    err = c.WalkDir("/walk", func(name string, d fs.DirEntry, err error) error {
+        if err != nil {
+            return err
+        }
+        names = append(names, name)
+        if name == "/walk/b/z" {
+            return errStop
+        }
+        return nil
+    })
+    if err != errStop || !reflect.DeepEqual(names, walkAll[:6]) {
+        t.Error("walk stopped by an error", names, err)
+    }
+
+    var got error
+    c.Walk("/walk/missing", func(name string, info os.FileInfo, err error) error {
+        got = err
+        return nil
+    })
+    if !errors.Is(got, fs.ErrNotExist) {
+        t.Error("walk of a missing root", got)
+    }
+}
+
+func TestWalkParallel(t *testing.T) {
+    c := NewClient(testMaster.Addr(), "/", false)
+    defer c.Close()
+    makeTree(t, c)
+    defer c.RemoveAll("/walk")
+
+    var mutex sync.Mutex
+    var names []string
+    err := c.WalkParallel("/walk", &WalkOptions{Workers: 3}, func(name string, info os.FileInfo) error {
+        mutex.Lock()
+        names = append(names, name)
+        mutex.Unlock()
+        if name == "/walk/a" {
+            return filepath.SkipDir
+        }
+        return nil
+    })
+    sort.Strings(names)
+    want := []string{"/walk", "/walk/a", "/walk/b", "/walk/b/z", "/walk/c"}
+    if err != nil || !reflect.DeepEqual(names, want) {
+        t.Error("parallel walk with SkipDir", names, err)
+    }
+
+    errStop := errors.New("stop")
+    err = c.WalkParallel("/walk", nil, func(name string, info os.FileInfo) error {
+        if name == "/walk/b" {
+            return errStop
+        }
+        return nil
+    })
+    if err != errStop {
+        t.Error("parallel walk stopped by an error", err)
+    }
+}
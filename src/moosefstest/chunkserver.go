@@ -0,0 +1,210 @@
+package moosefstest
+
+import (
+    "hash/crc32"
+    "net"
+    "sync"
+)
+
+// ChunkServer is a fake chunkserver speaking CUTOCS/CSTOCU. The chunk data
+// lives in its master, so every chunkserver holds a copy of every chunk.
+type ChunkServer struct {
+    faults
+
+    master *Master
+    ln     net.Listener
+    ip     uint32
+    port   uint16
+
+    mutex  sync.Mutex
+    conns  map[net.Conn]bool
+    closed bool
+}
+
+// AddChunkServer starts a new chunkserver and registers it with m.
+func (m *Master) AddChunkServer() (*ChunkServer, error) {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        return nil, err
+    }
+    addr := ln.Addr().(*net.TCPAddr)
+    ip := addr.IP.To4()
+    cs := &ChunkServer{
+        master: m,
+        ln:     ln,
+        ip:     uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3]),
+        port:   uint16(addr.Port),
+        conns:  make(map[net.Conn]bool),
+    }
+    m.mutex.Lock()
+    m.servers = append(m.servers, cs)
+    m.mutex.Unlock()
+    go cs.accept()
+    return cs, nil
+}
+
+// Addr returns the address of the chunkserver.
+func (cs *ChunkServer) Addr() string {
+    return cs.ln.Addr().String()
+}
+
+// Close stops the chunkserver, the master stops handing it out.
+func (cs *ChunkServer) Close() {
+    m := cs.master
+    m.mutex.Lock()
+    for i, s := range m.servers {
+        if s == cs {
+            m.servers = append(m.servers[:i:i], m.servers[i+1:]...)
+            break
+        }
+    }
+    m.mutex.Unlock()
+
+    cs.mutex.Lock()
+    cs.closed = true
+    for conn := range cs.conns {
+        conn.Close()
+    }
+    cs.mutex.Unlock()
+    cs.ln.Close()
+}
+
+func (cs *ChunkServer) accept() {
+    for {
+        conn, err := cs.ln.Accept()
+        if err != nil {
+            return
+        }
+        cs.mutex.Lock()
+        if cs.closed {
+            cs.mutex.Unlock()
+            conn.Close()
+            return
+        }
+        cs.conns[conn] = true
+        cs.mutex.Unlock()
+        go cs.serve(conn)
+    }
+}
+
+func (cs *ChunkServer) serve(conn net.Conn) {
+    defer func() {
+        cs.mutex.Lock()
+        delete(cs.conns, conn)
+        cs.mutex.Unlock()
+        conn.Close()
+    }()
+
+    // the chunk being written on this connection
+    var wchunk uint64
+    var wversion uint32
+    for {
+        cmd, data, err := readPacket(conn)
+        if err != nil {
+            return
+        }
+        if cmd == ANTOAN_NOP {
+            continue
+        }
+        fault := cs.check(cmd, data)
+        if fault != nil && fault.Drop {
+            return
+        }
+        r := &reader{buf: data}
+        switch cmd {
+        case CUTOCS_READ:
+            id, version, offset, size := r.u64(), r.u32(), r.u32(), r.u32()
+            if r.err != nil {
+                return
+            }
+            if err := cs.read(conn, fault, id, version, offset, size); err != nil {
+                return
+            }
+
+        case CUTOCS_WRITE:
+            id, version := r.u64(), r.u32()
+            if r.err != nil {
+                return
+            }
+            status := uint8(STATUS_OK)
+            if fault != nil && fault.Status != 0 {
+                status = fault.Status
+            } else if _, status = cs.master.readChunk(id, version, 0, 0); status == STATUS_OK {
+                wchunk, wversion = id, version
+            }
+            if writeStatus(conn, id, 0, status) != nil {
+                return
+            }
+
+        case CUTOCS_WRITE_DATA:
+            id, writeid, blockno, offset, size, crc := r.u64(), r.u32(), r.u16(), r.u16(), r.u32(), r.u32()
+            buf := r.take(int(size))
+            if r.err != nil {
+                return
+            }
+            status := uint8(STATUS_OK)
+            switch {
+            case fault != nil && fault.Status != 0:
+                status = fault.Status
+            case id != wchunk:
+                status = ERROR_NOTSTARTED
+            case blockno >= MFS_BLOCKS:
+                status = ERROR_BNUMTOOBIG
+            case uint32(offset)+size > MFS_BLOCK_SIZE:
+                status = ERROR_WRONGSIZE
+            case crc != crc32.ChecksumIEEE(buf):
+                status = ERROR_CRC
+            default:
+                status = cs.master.writeChunk(id, wversion, uint32(blockno)*MFS_BLOCK_SIZE+uint32(offset), buf)
+            }
+            if writeStatus(conn, id, writeid, status) != nil {
+                return
+            }
+
+        case CUTOCS_WRITE_FINISH:
+            wchunk = 0
+
+        default:
+            return
+        }
+    }
+}
+
+func writeStatus(conn net.Conn, id uint64, writeid uint32, status uint8) error {
+    return writePacket(conn, CSTOCU_WRITE_STATUS, new(writer).u64(id).u32(writeid).u8(status).buf)
+}
+
+// read sends the requested range block by block, followed by the status
+func (cs *ChunkServer) read(conn net.Conn, fault *Fault, id uint64, version, offset, size uint32) error {
+    status := uint8(STATUS_OK)
+    var data []byte
+    switch {
+    case fault != nil && fault.Status != 0:
+        status = fault.Status
+    case size == 0 || uint64(offset)+uint64(size) > CHUNK_SIZE:
+        status = ERROR_WRONGSIZE
+    default:
+        data, status = cs.master.readChunk(id, version, offset, size)
+    }
+    for len(data) > 0 {
+        blockoffset := offset % MFS_BLOCK_SIZE
+        n := MFS_BLOCK_SIZE - blockoffset
+        if n > uint32(len(data)) {
+            n = uint32(len(data))
+        }
+        block := data[:n]
+        crc := crc32.ChecksumIEEE(block)
+        if fault != nil && fault.Corrupt {
+            block = append([]byte(nil), block...)
+            block[0] ^= 0xff
+        }
+        w := new(writer).u64(id).u16(uint16(offset / MFS_BLOCK_SIZE)).u16(uint16(blockoffset))
+        w.u32(n).u32(crc).bytes(block)
+        if err := writePacket(conn, CSTOCU_READ_DATA, w.buf); err != nil {
+            return err
+        }
+        data = data[n:]
+        offset += n
+    }
+    return writePacket(conn, CSTOCU_READ_STATUS, new(writer).u64(id).u8(status).buf)
+}
@@ -0,0 +1,136 @@
+package moosefstest
+
+// The protocol constants used by the fakes. They mirror moosefs/consts.go,
+// which can not be imported here because the tests of moosefs use this
+// package.
+
+const (
+    MFS_ROOT_ID       = 1
+    MFS_NAME_MAX      = 255
+    MFS_MAX_FILE_SIZE = 0x20000000000
+    MFS_BLOCK_SIZE    = 0x10000
+    MFS_BLOCKS        = 0x400
+    CHUNK_SIZE        = MFS_BLOCK_SIZE * MFS_BLOCKS
+)
+
+const VERSION = uint32(0x01F1F5)
+
+const GETDIR_FLAG_WITHATTR = 0x01
+
+const (
+    TYPE_FILE      = 'f'
+    TYPE_SYMLINK   = 'l'
+    TYPE_DIRECTORY = 'd'
+    TYPE_FIFO      = 'q'
+    TYPE_BLOCKDEV  = 'b'
+    TYPE_CHARDEV   = 'c'
+    TYPE_SOCKET    = 's'
+)
+
+const (
+    STATUS_OK = iota
+
+    ERROR_EPERM
+    ERROR_ENOTDIR
+    ERROR_ENOENT
+    ERROR_EACCES
+    ERROR_EEXIST
+    ERROR_EINVAL
+    ERROR_ENOTEMPTY
+    ERROR_CHUNKLOST
+    ERROR_OUTOFMEMORY
+
+    ERROR_INDEXTOOBIG
+    ERROR_LOCKED
+    ERROR_NOCHUNKSERVERS
+    ERROR_NOCHUNK
+    ERROR_CHUNKBUSY
+    ERROR_REGISTER
+    ERROR_NOTDONE
+    ERROR_NOTOPENED
+    ERROR_NOTSTARTED
+
+    ERROR_WRONGVERSION
+    ERROR_CHUNKEXIST
+    ERROR_NOSPACE
+    ERROR_IO
+    ERROR_BNUMTOOBIG
+    ERROR_WRONGSIZE
+    ERROR_WRONGOFFSET
+    ERROR_CANTCONNECT
+    ERROR_WRONGCHUNKID
+    ERROR_DISCONNECTED
+    ERROR_CRC
+    ERROR_DELAYED
+    ERROR_CANTCREATEPATH
+
+    ERROR_MISMATCH
+
+    ERROR_EROFS
+    ERROR_QUOTA
+    ERROR_BADSESSIONID
+)
+
+const (
+    WANT_READ  = 1
+    WANT_WRITE = 2
+)
+
+// modemask of CUTOMA_FUSE_ACCESS
+const (
+    MODE_MASK_X = 1 << iota
+    MODE_MASK_W
+    MODE_MASK_R
+)
+
+const (
+    SET_GOAL_FLAG = 1 << iota
+    SET_MODE_FLAG
+    SET_UID_FLAG
+    SET_GID_FLAG
+    SET_LENGTH_FLAG
+    SET_MTIME_FLAG
+    SET_ATIME_FLAG
+)
+
+const ANTOAN_NOP = 0
+
+const (
+    CUTOCS_READ         = 200
+    CSTOCU_READ_STATUS  = 201
+    CSTOCU_READ_DATA    = 202
+    CUTOCS_WRITE        = 210
+    CSTOCU_WRITE_STATUS = 211
+    CUTOCS_WRITE_DATA   = 212
+    CUTOCS_WRITE_FINISH = 213
+)
+
+const (
+    FUSE_REGISTER_BLOB_ACL = "DjI1GAQDULI5d2YjA26ypc3ovkhjvhciTQVx3CS4nYgtBoUcsljiVpsErJENHaw0"
+    REGISTER_NEWSESSION    = 2
+    REGISTER_RECONNECT     = 3
+)
+
+const (
+    CUTOMA_FUSE_REGISTER        = 400
+    MATOCU_FUSE_REGISTER        = 401
+    CUTOMA_FUSE_STATFS          = 402
+    CUTOMA_FUSE_ACCESS          = 404
+    CUTOMA_FUSE_LOOKUP          = 406
+    CUTOMA_FUSE_GETATTR         = 408
+    CUTOMA_FUSE_SETATTR         = 410
+    CUTOMA_FUSE_READLINK        = 412
+    CUTOMA_FUSE_SYMLINK         = 414
+    CUTOMA_FUSE_MKNOD           = 416
+    CUTOMA_FUSE_MKDIR           = 418
+    CUTOMA_FUSE_UNLINK          = 420
+    CUTOMA_FUSE_RMDIR           = 422
+    CUTOMA_FUSE_RENAME          = 424
+    CUTOMA_FUSE_LINK            = 426
+    CUTOMA_FUSE_GETDIR          = 428
+    CUTOMA_FUSE_OPEN            = 430
+    CUTOMA_FUSE_READ_CHUNK      = 432
+    CUTOMA_FUSE_WRITE_CHUNK     = 434
+    CUTOMA_FUSE_WRITE_CHUNK_END = 436
+    CUTOMA_FUSE_TRUNCATE        = 464
+)
@@ -0,0 +1,88 @@
+package moosefstest
+
+import (
+    "sync"
+    "time"
+)
+
+// A Fault changes how the fake answers one request.
+type Fault struct {
+    Delay   time.Duration // wait before handling the request
+    Drop    bool          // close the connection instead of answering
+    Status  uint8         // answer with this status instead of handling it
+    Corrupt bool          // chunkservers only: send data with a bad CRC
+}
+
+// A FaultFunc is called with every request and its payload, it returns
+// the fault to inject or nil to handle the request normally.
+type FaultFunc func(cmd uint32, payload []byte) *Fault
+
+// FailCommand answers the next times requests of cmd with status, or all
+// of them if times is negative.
+func FailCommand(cmd uint32, status uint8, times int) FaultFunc {
+    var mutex sync.Mutex
+    return func(c uint32, payload []byte) *Fault {
+        mutex.Lock()
+        defer mutex.Unlock()
+        if c != cmd || times == 0 {
+            return nil
+        }
+        times--
+        return &Fault{Status: status}
+    }
+}
+
+// DropCommand closes the connection on the next times requests of cmd,
+// or on all of them if times is negative.
+func DropCommand(cmd uint32, times int) FaultFunc {
+    var mutex sync.Mutex
+    return func(c uint32, payload []byte) *Fault {
+        mutex.Lock()
+        defer mutex.Unlock()
+        if c != cmd || times == 0 {
+            return nil
+        }
+        times--
+        return &Fault{Drop: true}
+    }
+}
+
+// faults is embedded by the fake servers
+type faults struct {
+    fmutex sync.Mutex
+    fault  FaultFunc
+    counts map[uint32]int
+}
+
+// SetFault installs f, nil removes any fault.
+func (s *faults) SetFault(f FaultFunc) {
+    s.fmutex.Lock()
+    s.fault = f
+    s.fmutex.Unlock()
+}
+
+// Count returns the number of requests of cmd received so far.
+func (s *faults) Count(cmd uint32) int {
+    s.fmutex.Lock()
+    defer s.fmutex.Unlock()
+    return s.counts[cmd]
+}
+
+// check counts the request and applies the delay of its fault
+func (s *faults) check(cmd uint32, payload []byte) *Fault {
+    s.fmutex.Lock()
+    if s.counts == nil {
+        s.counts = make(map[uint32]int)
+    }
+    s.counts[cmd]++
+    f := s.fault
+    s.fmutex.Unlock()
+    if f == nil {
+        return nil
+    }
+    fault := f(cmd, payload)
+    if fault != nil && fault.Delay > 0 {
+        time.Sleep(fault.Delay)
+    }
+    return fault
+}
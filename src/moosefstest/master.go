@@ -0,0 +1,793 @@
+// Package moosefstest runs a fake MooseFS master and chunkservers on the
+// loopback interface, so the client can be tested without a cluster.
+//
+// The master keeps its namespace in memory and speaks enough of the
+// CUTOMA/MATOCU protocol for the client: register, statfs, access,
+// lookup, getattr, setattr, readlink, symlink, mknod, mkdir, unlink,
+// rmdir, rename, link, getdir, open, truncate and read/write chunk. The
+// chunkservers share the chunk data of their master.
+package moosefstest
+
+import (
+    "net"
+    "sort"
+    "sync"
+    "time"
+)
+
+const DEFAULT_TOTAL_SPACE = 1 << 40
+
+type node struct {
+    inode   uint32
+    typ     uint8
+    mode    uint16
+    uid     uint32
+    gid     uint32
+    atime   uint32
+    mtime   uint32
+    ctime   uint32
+    nlink   uint32
+    length  uint64
+    rdev    uint32
+    target  string
+    parent  uint32
+    entries map[string]uint32
+    chunks  []uint64
+}
+
+func (n *node) attr() []byte {
+    w := new(writer).u8(n.typ).u16(n.mode).u32(n.uid).u32(n.gid)
+    w.u32(n.atime).u32(n.mtime).u32(n.ctime).u32(n.nlink)
+    switch n.typ {
+    case TYPE_FILE:
+        w.u64(n.length)
+    case TYPE_SYMLINK:
+        w.u64(uint64(len(n.target)))
+    case TYPE_BLOCKDEV, TYPE_CHARDEV:
+        w.u32(n.rdev).u32(0)
+    default:
+        w.u64(0)
+    }
+    return w.buf
+}
+
+// access checks the rwx bits of mask (MODE_MASK_*) for uid and gid
+func (n *node) access(uid, gid uint32, mask uint8) bool {
+    if uid == 0 {
+        return true
+    }
+    perm := n.mode
+    if uid == n.uid {
+        perm >>= 6
+    } else if gid == n.gid {
+        perm >>= 3
+    }
+    return uint8(perm&7)&mask == mask
+}
+
+type chunk struct {
+    id      uint64
+    version uint32
+    data    []byte
+}
+
+// Master is a fake mfsmaster.
+type Master struct {
+    TotalSpace uint64 // reported by statfs
+
+    faults
+
+    mutex      sync.Mutex
+    ln         net.Listener
+    nodes      map[uint32]*node
+    next_inode uint32
+    chunks     map[uint64]*chunk
+    next_chunk uint64
+    sessions   map[uint32]bool
+    servers    []*ChunkServer
+    conns      map[net.Conn]bool
+    closed     bool
+}
+
+// NewMaster starts a master with an empty root directory and no
+// chunkservers.
+func NewMaster() (*Master, error) {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        return nil, err
+    }
+    m := &Master{
+        TotalSpace: DEFAULT_TOTAL_SPACE,
+        ln:         ln,
+        nodes:      make(map[uint32]*node),
+        next_inode: MFS_ROOT_ID,
+        chunks:     make(map[uint64]*chunk),
+        next_chunk: 1,
+        sessions:   make(map[uint32]bool),
+        conns:      make(map[net.Conn]bool),
+    }
+    root := m.newNode(TYPE_DIRECTORY, 0777, 0, 0)
+    root.parent = root.inode
+    go m.accept()
+    return m, nil
+}
+
+// Start starts a master with n chunkservers.
+func Start(n int) (*Master, error) {
+    m, err := NewMaster()
+    if err != nil {
+        return nil, err
+    }
+    for i := 0; i < n; i++ {
+        if _, err := m.AddChunkServer(); err != nil {
+            m.Close()
+            return nil, err
+        }
+    }
+    return m, nil
+}
+
+// Addr returns the address clients should connect to.
+func (m *Master) Addr() string {
+    return m.ln.Addr().String()
+}
+
+// ChunkServers returns the running chunkservers.
+func (m *Master) ChunkServers() []*ChunkServer {
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+    return append([]*ChunkServer(nil), m.servers...)
+}
+
+// Close stops the master and all its chunkservers.
+func (m *Master) Close() {
+    for _, cs := range m.ChunkServers() {
+        cs.Close()
+    }
+    m.mutex.Lock()
+    m.closed = true
+    for conn := range m.conns {
+        conn.Close()
+    }
+    m.mutex.Unlock()
+    m.ln.Close()
+}
+
+func (m *Master) accept() {
+    for {
+        conn, err := m.ln.Accept()
+        if err != nil {
+            return
+        }
+        m.mutex.Lock()
+        if m.closed {
+            m.mutex.Unlock()
+            conn.Close()
+            return
+        }
+        m.conns[conn] = true
+        m.mutex.Unlock()
+        go m.serve(conn)
+    }
+}
+
+func (m *Master) serve(conn net.Conn) {
+    defer func() {
+        m.mutex.Lock()
+        delete(m.conns, conn)
+        m.mutex.Unlock()
+        conn.Close()
+    }()
+    for {
+        cmd, data, err := readPacket(conn)
+        if err != nil {
+            return
+        }
+        if cmd == ANTOAN_NOP {
+            continue
+        }
+        fault := m.check(cmd, data)
+        if fault != nil && fault.Drop {
+            return
+        }
+        if cmd == CUTOMA_FUSE_REGISTER {
+            ans, status := m.register(&reader{buf: data})
+            if fault != nil && fault.Status != 0 {
+                ans, status = nil, fault.Status
+            }
+            if ans == nil {
+                ans = []byte{status}
+            }
+            if writePacket(conn, MATOCU_FUSE_REGISTER, ans) != nil {
+                return
+            }
+            continue
+        }
+
+        r := &reader{buf: data}
+        msgid := r.u32()
+        if r.err != nil {
+            return
+        }
+        var ans []byte
+        var status uint8
+        if fault != nil && fault.Status != 0 {
+            status = fault.Status
+        } else {
+            ans, status = m.handle(cmd, r)
+        }
+        if ans == nil {
+            ans = []byte{status}
+        }
+        if writePacket(conn, cmd+1, new(writer).u32(msgid).bytes(ans).buf) != nil {
+            return
+        }
+    }
+}
+
+func (m *Master) register(r *reader) ([]byte, uint8) {
+    blob := string(r.take(len(FUSE_REGISTER_BLOB_ACL)))
+    rcode := r.u8()
+    if r.err != nil || blob != FUSE_REGISTER_BLOB_ACL {
+        return nil, ERROR_REGISTER
+    }
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+    switch rcode {
+    case REGISTER_NEWSESSION:
+        sessionid := uint32(len(m.sessions) + 1)
+        m.sessions[sessionid] = true
+        // version, sessionid, sesflags, rootuid, rootgid, mapalluid, mapallgid
+        return new(writer).u32(VERSION).u32(sessionid).u8(0).u32(0).u32(0).u32(0).u32(0).buf, 0
+    case REGISTER_RECONNECT:
+        if !m.sessions[r.u32()] {
+            return nil, ERROR_BADSESSIONID
+        }
+        return nil, STATUS_OK
+    }
+    return nil, ERROR_EINVAL
+}
+
+func now() uint32 {
+    return uint32(time.Now().Unix())
+}
+
+func (m *Master) newNode(typ uint8, mode uint16, uid, gid uint32) *node {
+    t := now()
+    n := &node{inode: m.next_inode, typ: typ, mode: mode & 07777, uid: uid, gid: gid,
+        atime: t, mtime: t, ctime: t, nlink: 1}
+    if typ == TYPE_DIRECTORY {
+        n.nlink = 2
+        n.entries = make(map[string]uint32)
+    }
+    m.next_inode++
+    m.nodes[n.inode] = n
+    return n
+}
+
+// dir returns the directory inode after checking the permissions in mask
+func (m *Master) dir(inode, uid, gid uint32, mask uint8) (*node, uint8) {
+    d := m.nodes[inode]
+    if d == nil {
+        return nil, ERROR_ENOENT
+    }
+    if d.typ != TYPE_DIRECTORY {
+        return nil, ERROR_ENOTDIR
+    }
+    if !d.access(uid, gid, mask) {
+        return nil, ERROR_EACCES
+    }
+    return d, STATUS_OK
+}
+
+func (m *Master) file(inode uint32) (*node, uint8) {
+    n := m.nodes[inode]
+    if n == nil {
+        return nil, ERROR_ENOENT
+    }
+    if n.typ != TYPE_FILE {
+        return nil, ERROR_EPERM
+    }
+    return n, STATUS_OK
+}
+
+func validName(name string) bool {
+    if name == "" || name == "." || name == ".." || len(name) > MFS_NAME_MAX {
+        return false
+    }
+    for i := 0; i < len(name); i++ {
+        if name[i] == '/' || name[i] == 0 {
+            return false
+        }
+    }
+    return true
+}
+
+// create adds a new node called name into the directory parent
+func (m *Master) create(parent uint32, name string, typ uint8, mode uint16, uid, gid uint32) (*node, uint8) {
+    d, status := m.dir(parent, uid, gid, MODE_MASK_W|MODE_MASK_X)
+    if status != STATUS_OK {
+        return nil, status
+    }
+    if !validName(name) {
+        return nil, ERROR_EINVAL
+    }
+    if _, ok := d.entries[name]; ok {
+        return nil, ERROR_EEXIST
+    }
+    n := m.newNode(typ, mode, uid, gid)
+    d.entries[name] = n.inode
+    n.parent = d.inode
+    if typ == TYPE_DIRECTORY {
+        d.nlink++
+    }
+    d.mtime, d.ctime = n.mtime, n.mtime
+    return n, STATUS_OK
+}
+
+func (m *Master) entry(n *node) []byte {
+    return new(writer).u32(n.inode).bytes(n.attr()).buf
+}
+
+// unlink removes name from d, the node is released with its last link
+func (m *Master) unlink(d *node, name string) {
+    n := m.nodes[d.entries[name]]
+    delete(d.entries, name)
+    d.mtime, d.ctime = now(), now()
+    if n.typ == TYPE_DIRECTORY {
+        d.nlink--
+        n.nlink = 0
+    } else {
+        n.nlink--
+        n.ctime = d.ctime
+    }
+    if n.nlink == 0 {
+        for _, id := range n.chunks {
+            delete(m.chunks, id)
+        }
+        delete(m.nodes, n.inode)
+    }
+}
+
+func (m *Master) handle(cmd uint32, r *reader) (ans []byte, status uint8) {
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+    defer func() {
+        if r.err != nil {
+            ans, status = nil, ERROR_EINVAL
+        }
+    }()
+
+    switch cmd {
+    case CUTOMA_FUSE_STATFS:
+        var used uint64
+        for _, c := range m.chunks {
+            used += uint64(len(c.data))
+        }
+        avail := uint64(0)
+        if used < m.TotalSpace {
+            avail = m.TotalSpace - used
+        }
+        return new(writer).u64(m.TotalSpace).u64(avail).u64(0).u64(0).u32(uint32(len(m.nodes))).buf, 0
+
+    case CUTOMA_FUSE_ACCESS:
+        inode, uid, gid, mask := r.u32(), r.u32(), r.u32(), r.u8()
+        n := m.nodes[inode]
+        if n == nil {
+            return nil, ERROR_ENOENT
+        }
+        if !n.access(uid, gid, mask&7) {
+            return nil, ERROR_EACCES
+        }
+        return nil, STATUS_OK
+
+    case CUTOMA_FUSE_LOOKUP:
+        parent, name, uid, gid := r.u32(), r.name(), r.u32(), r.u32()
+        d, status := m.dir(parent, uid, gid, MODE_MASK_X)
+        if status != STATUS_OK {
+            return nil, status
+        }
+        var inode uint32
+        switch name {
+        case ".":
+            inode = d.inode
+        case "..":
+            inode = d.parent
+        default:
+            var ok bool
+            if inode, ok = d.entries[name]; !ok {
+                return nil, ERROR_ENOENT
+            }
+        }
+        return m.entry(m.nodes[inode]), 0
+
+    case CUTOMA_FUSE_GETATTR:
+        n := m.nodes[r.u32()]
+        if n == nil {
+            return nil, ERROR_ENOENT
+        }
+        return n.attr(), 0
+
+    case CUTOMA_FUSE_SETATTR:
+        inode, uid, _ := r.u32(), r.u32(), r.u32()
+        setmask, mode, attruid, attrgid, atime, mtime := r.u8(), r.u16(), r.u32(), r.u32(), r.u32(), r.u32()
+        n := m.nodes[inode]
+        if r.err != nil {
+            return nil, ERROR_EINVAL
+        }
+        if n == nil {
+            return nil, ERROR_ENOENT
+        }
+        if uid != 0 && uid != n.uid {
+            return nil, ERROR_EPERM
+        }
+        if setmask&SET_MODE_FLAG != 0 {
+            n.mode = mode & 07777
+        }
+        if setmask&SET_UID_FLAG != 0 {
+            n.uid = attruid
+        }
+        if setmask&SET_GID_FLAG != 0 {
+            n.gid = attrgid
+        }
+        if setmask&SET_ATIME_FLAG != 0 {
+            n.atime = atime
+        }
+        if setmask&SET_MTIME_FLAG != 0 {
+            n.mtime = mtime
+        }
+        n.ctime = now()
+        return n.attr(), 0
+
+    case CUTOMA_FUSE_READLINK:
+        n := m.nodes[r.u32()]
+        if n == nil {
+            return nil, ERROR_ENOENT
+        }
+        if n.typ != TYPE_SYMLINK {
+            return nil, ERROR_EINVAL
+        }
+        return new(writer).u32(uint32(len(n.target) + 1)).bytes([]byte(n.target)).u8(0).buf, 0
+
+    case CUTOMA_FUSE_SYMLINK:
+        parent, name, target, uid, gid := r.u32(), r.name(), r.str(), r.u32(), r.u32()
+        if r.err != nil {
+            return nil, ERROR_EINVAL
+        }
+        n, status := m.create(parent, name, TYPE_SYMLINK, 0777, uid, gid)
+        if status != STATUS_OK {
+            return nil, status
+        }
+        n.target = target
+        return m.entry(n), 0
+
+    case CUTOMA_FUSE_MKNOD:
+        parent, name, typ, mode, uid, gid, rdev := r.u32(), r.name(), r.u8(), r.u16(), r.u32(), r.u32(), r.u32()
+        switch typ {
+        case TYPE_FILE, TYPE_FIFO, TYPE_BLOCKDEV, TYPE_CHARDEV, TYPE_SOCKET:
+        default:
+            return nil, ERROR_EINVAL
+        }
+        if r.err != nil {
+            return nil, ERROR_EINVAL
+        }
+        n, status := m.create(parent, name, typ, mode, uid, gid)
+        if status != STATUS_OK {
+            return nil, status
+        }
+        n.rdev = rdev
+        return m.entry(n), 0
+
+    case CUTOMA_FUSE_MKDIR:
+        parent, name, mode, uid, gid := r.u32(), r.name(), r.u16(), r.u32(), r.u32()
+        if r.err != nil {
+            return nil, ERROR_EINVAL
+        }
+        n, status := m.create(parent, name, TYPE_DIRECTORY, mode, uid, gid)
+        if status != STATUS_OK {
+            return nil, status
+        }
+        return m.entry(n), 0
+
+    case CUTOMA_FUSE_UNLINK, CUTOMA_FUSE_RMDIR:
+        parent, name, uid, gid := r.u32(), r.name(), r.u32(), r.u32()
+        d, status := m.dir(parent, uid, gid, MODE_MASK_W|MODE_MASK_X)
+        if status != STATUS_OK {
+            return nil, status
+        }
+        n := m.nodes[d.entries[name]]
+        if n == nil {
+            return nil, ERROR_ENOENT
+        }
+        if cmd == CUTOMA_FUSE_UNLINK && n.typ == TYPE_DIRECTORY {
+            return nil, ERROR_EPERM
+        }
+        if cmd == CUTOMA_FUSE_RMDIR {
+            if n.typ != TYPE_DIRECTORY {
+                return nil, ERROR_ENOTDIR
+            }
+            if len(n.entries) > 0 {
+                return nil, ERROR_ENOTEMPTY
+            }
+        }
+        m.unlink(d, name)
+        return nil, STATUS_OK
+
+    case CUTOMA_FUSE_RENAME:
+        sparent, sname, dparent, dname, uid, gid := r.u32(), r.name(), r.u32(), r.name(), r.u32(), r.u32()
+        return nil, m.rename(sparent, sname, dparent, dname, uid, gid)
+
+    case CUTOMA_FUSE_LINK:
+        inode, parent, name, uid, gid := r.u32(), r.u32(), r.name(), r.u32(), r.u32()
+        n := m.nodes[inode]
+        if n == nil {
+            return nil, ERROR_ENOENT
+        }
+        if n.typ == TYPE_DIRECTORY {
+            return nil, ERROR_EPERM
+        }
+        d, status := m.dir(parent, uid, gid, MODE_MASK_W|MODE_MASK_X)
+        if status != STATUS_OK {
+            return nil, status
+        }
+        if !validName(name) {
+            return nil, ERROR_EINVAL
+        }
+        if _, ok := d.entries[name]; ok {
+            return nil, ERROR_EEXIST
+        }
+        d.entries[name] = n.inode
+        n.nlink++
+        n.ctime = now()
+        d.mtime, d.ctime = n.ctime, n.ctime
+        return m.entry(n), 0
+
+    case CUTOMA_FUSE_GETDIR:
+        inode, uid, gid := r.u32(), r.u32(), r.u32()
+        var flags uint8
+        if len(r.buf) > 0 {
+            flags = r.u8()
+        }
+        d, status := m.dir(inode, uid, gid, MODE_MASK_R)
+        if status != STATUS_OK {
+            return nil, status
+        }
+        names := make([]string, 0, len(d.entries))
+        for name := range d.entries {
+            names = append(names, name)
+        }
+        sort.Strings(names)
+        w := new(writer)
+        add := func(name string, n *node) {
+            w.name(name).u32(n.inode)
+            if flags&GETDIR_FLAG_WITHATTR != 0 {
+                w.bytes(n.attr())
+            } else {
+                w.u8(n.typ)
+            }
+        }
+        add(".", d)
+        add("..", m.nodes[d.parent])
+        for _, name := range names {
+            add(name, m.nodes[d.entries[name]])
+        }
+        if len(w.buf) == 0 {
+            return nil, STATUS_OK
+        }
+        return w.buf, 0
+
+    case CUTOMA_FUSE_OPEN:
+        inode, uid, gid, flags := r.u32(), r.u32(), r.u32(), r.u8()
+        n := m.nodes[inode]
+        if n == nil {
+            return nil, ERROR_ENOENT
+        }
+        var mask uint8
+        if flags&WANT_READ != 0 {
+            mask |= MODE_MASK_R
+        }
+        if flags&WANT_WRITE != 0 {
+            mask |= MODE_MASK_W
+        }
+        if !n.access(uid, gid, mask) {
+            return nil, ERROR_EACCES
+        }
+        return n.attr(), 0
+
+    case CUTOMA_FUSE_TRUNCATE:
+        inode, _, uid, gid, length := r.u32(), r.u8(), r.u32(), r.u32(), r.u64()
+        n, status := m.file(inode)
+        if status != STATUS_OK {
+            return nil, status
+        }
+        if !n.access(uid, gid, MODE_MASK_W) {
+            return nil, ERROR_EACCES
+        }
+        if r.err != nil || length > MFS_MAX_FILE_SIZE {
+            return nil, ERROR_EINVAL
+        }
+        m.truncate(n, length)
+        return n.attr(), 0
+
+    case CUTOMA_FUSE_READ_CHUNK:
+        inode, indx := r.u32(), r.u32()
+        n, status := m.file(inode)
+        if status != STATUS_OK {
+            return nil, status
+        }
+        if uint64(indx) >= MFS_MAX_FILE_SIZE/CHUNK_SIZE {
+            return nil, ERROR_INDEXTOOBIG
+        }
+        w := new(writer).u64(n.length)
+        if int(indx) < len(n.chunks) && n.chunks[indx] != 0 {
+            c := m.chunks[n.chunks[indx]]
+            w.u64(c.id).u32(c.version)
+            m.locations(w)
+        } else {
+            w.u64(0).u32(0)
+        }
+        return w.buf, 0
+
+    case CUTOMA_FUSE_WRITE_CHUNK:
+        inode, indx := r.u32(), r.u32()
+        n, status := m.file(inode)
+        if status != STATUS_OK {
+            return nil, status
+        }
+        if uint64(indx) >= MFS_MAX_FILE_SIZE/CHUNK_SIZE {
+            return nil, ERROR_INDEXTOOBIG
+        }
+        if len(m.servers) == 0 {
+            return nil, ERROR_NOCHUNKSERVERS
+        }
+        for len(n.chunks) <= int(indx) {
+            n.chunks = append(n.chunks, 0)
+        }
+        c := m.chunks[n.chunks[indx]]
+        if c == nil {
+            c = &chunk{id: m.next_chunk}
+            m.next_chunk++
+            m.chunks[c.id] = c
+            n.chunks[indx] = c.id
+        }
+        c.version++
+        w := new(writer).u64(n.length).u64(c.id).u32(c.version)
+        m.locations(w)
+        return w.buf, 0
+
+    case CUTOMA_FUSE_WRITE_CHUNK_END:
+        id, inode, length := r.u64(), r.u32(), r.u64()
+        n, status := m.file(inode)
+        if status != STATUS_OK {
+            return nil, status
+        }
+        if m.chunks[id] == nil {
+            return nil, ERROR_NOCHUNK
+        }
+        if length > n.length {
+            n.length = length
+        }
+        n.mtime, n.ctime = now(), now()
+        return nil, STATUS_OK
+    }
+    return nil, ERROR_EINVAL
+}
+
+func (m *Master) rename(sparent uint32, sname string, dparent uint32, dname string, uid, gid uint32) uint8 {
+    sd, status := m.dir(sparent, uid, gid, MODE_MASK_W|MODE_MASK_X)
+    if status != STATUS_OK {
+        return status
+    }
+    dd, status := m.dir(dparent, uid, gid, MODE_MASK_W|MODE_MASK_X)
+    if status != STATUS_OK {
+        return status
+    }
+    n := m.nodes[sd.entries[sname]]
+    if n == nil {
+        return ERROR_ENOENT
+    }
+    if !validName(dname) {
+        return ERROR_EINVAL
+    }
+    if n.typ == TYPE_DIRECTORY {
+        // a directory can not be moved below itself
+        for p := dd; ; p = m.nodes[p.parent] {
+            if p == n {
+                return ERROR_EINVAL
+            }
+            if p.inode == MFS_ROOT_ID {
+                break
+            }
+        }
+    }
+    if o := m.nodes[dd.entries[dname]]; o != nil {
+        if o == n {
+            return STATUS_OK
+        }
+        switch {
+        case o.typ == TYPE_DIRECTORY && n.typ != TYPE_DIRECTORY:
+            return ERROR_EPERM
+        case o.typ != TYPE_DIRECTORY && n.typ == TYPE_DIRECTORY:
+            return ERROR_ENOTDIR
+        case len(o.entries) > 0:
+            return ERROR_ENOTEMPTY
+        }
+        m.unlink(dd, dname)
+    }
+    delete(sd.entries, sname)
+    dd.entries[dname] = n.inode
+    if n.typ == TYPE_DIRECTORY {
+        n.parent = dd.inode
+        sd.nlink--
+        dd.nlink++
+    }
+    t := now()
+    n.ctime, sd.mtime, sd.ctime, dd.mtime, dd.ctime = t, t, t, t, t
+    return STATUS_OK
+}
+
+// truncate drops the chunks past length and zeroes the tail of the last one
+func (m *Master) truncate(n *node, length uint64) {
+    keep := int((length + CHUNK_SIZE - 1) / CHUNK_SIZE)
+    for i := keep; i < len(n.chunks); i++ {
+        delete(m.chunks, n.chunks[i])
+    }
+    if keep < len(n.chunks) {
+        n.chunks = n.chunks[:keep]
+    }
+    // growing the file, or truncating it before anything was written,
+    // leaves the chunks alone
+    if tail := length % CHUNK_SIZE; tail != 0 && keep > 0 && keep <= len(n.chunks) {
+        if c := m.chunks[n.chunks[keep-1]]; c != nil && uint64(len(c.data)) > tail {
+            c.data = c.data[:tail]
+            c.version++
+        }
+    }
+    n.length = length
+    n.mtime, n.ctime = now(), now()
+}
+
+// locations appends the addresses of the running chunkservers
+func (m *Master) locations(w *writer) {
+    for _, cs := range m.servers {
+        w.u32(cs.ip).u16(cs.port)
+    }
+}
+
+// readChunk returns a copy of size bytes at offset of the chunk id, the
+// part that was never written reads as zeros
+func (m *Master) readChunk(id uint64, version uint32, offset, size uint32) ([]byte, uint8) {
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+    c := m.chunks[id]
+    if c == nil {
+        return nil, ERROR_NOCHUNK
+    }
+    if c.version != version {
+        return nil, ERROR_WRONGVERSION
+    }
+    data := make([]byte, size)
+    if int(offset) < len(c.data) {
+        copy(data, c.data[offset:])
+    }
+    return data, STATUS_OK
+}
+
+// writeChunk stores data at offset of the chunk id
+func (m *Master) writeChunk(id uint64, version uint32, offset uint32, data []byte) uint8 {
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+    c := m.chunks[id]
+    if c == nil {
+        return ERROR_NOCHUNK
+    }
+    if c.version != version {
+        return ERROR_WRONGVERSION
+    }
+    end := int(offset) + len(data)
+    if end > len(c.data) {
+        c.data = append(c.data, make([]byte, end-len(c.data))...)
+    }
+    copy(c.data[offset:], data)
+    return STATUS_OK
+}
@@ -0,0 +1,53 @@
+package moosefstest_test
+
+import (
+    "bytes"
+    "moosefs"
+    "moosefstest"
+    "testing"
+)
+
+func TestTruncate(t *testing.T) {
+    m, err := moosefstest.Start(1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer m.Close()
+    c := moosefs.NewClient(m.Addr(), "/", false)
+    defer c.Close()
+
+    // before the data reached the chunkservers
+    f, err := c.Create("/trunc")
+    if err != nil {
+        t.Fatal(err)
+    }
+    f.WriteString("hello world")
+    if err := f.Truncate(5); err != nil {
+        t.Error("truncate before sync", err)
+    }
+    if err := f.Close(); err != nil {
+        t.Fatal(err)
+    }
+    if got, err := c.ReadFile("/trunc"); err != nil || string(got) != "hello" {
+        t.Error("after truncate before sync", string(got), err)
+    }
+
+    // growing a file reads zeros after the old end
+    if err := c.Truncate("/trunc", 100); err != nil {
+        t.Fatal("extend", err)
+    }
+    want := append([]byte("hello"), make([]byte, 95)...)
+    if got, err := c.ReadFile("/trunc"); err != nil || !bytes.Equal(got, want) {
+        t.Error("after extend", len(got), err)
+    }
+
+    // growing a file without chunks
+    f, _ = c.Create("/empty")
+    f.Close()
+    if err := c.Truncate("/empty", 10); err != nil {
+        t.Fatal("extend empty", err)
+    }
+    if got, err := c.ReadFile("/empty"); err != nil || !bytes.Equal(got, make([]byte, 10)) {
+        t.Error("after extend of empty file", got, err)
+    }
+}
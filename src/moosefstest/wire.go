@@ -0,0 +1,103 @@
+package moosefstest
+
+import (
+    "encoding/binary"
+    "errors"
+    "io"
+)
+
+// the largest packet the fakes accept, a full block plus headers
+const MAX_PACKET_SIZE = MFS_BLOCK_SIZE + 1024
+
+var errShort = errors.New("packet too short")
+
+// reader decodes the big endian fields of a packet. Reading past the end
+// sets err and returns zeros, so handlers only check err once.
+type reader struct {
+    buf []byte
+    err error
+}
+
+func (r *reader) take(n int) []byte {
+    if r.err != nil || n > len(r.buf) {
+        r.err = errShort
+        return make([]byte, n)
+    }
+    b := r.buf[:n]
+    r.buf = r.buf[n:]
+    return b
+}
+
+func (r *reader) u8() uint8   { return r.take(1)[0] }
+func (r *reader) u16() uint16 { return binary.BigEndian.Uint16(r.take(2)) }
+func (r *reader) u32() uint32 { return binary.BigEndian.Uint32(r.take(4)) }
+func (r *reader) u64() uint64 { return binary.BigEndian.Uint64(r.take(8)) }
+
+// name reads a NAME, a length byte followed by the bytes
+func (r *reader) name() string {
+    return string(r.take(int(r.u8())))
+}
+
+// str reads a string prefixed with a 32 bit length, which may end with \0
+func (r *reader) str() string {
+    b := r.take(int(r.u32()))
+    if len(b) > 0 && b[len(b)-1] == 0 {
+        b = b[:len(b)-1]
+    }
+    return string(b)
+}
+
+type writer struct {
+    buf []byte
+}
+
+func (w *writer) u8(v uint8) *writer {
+    w.buf = append(w.buf, v)
+    return w
+}
+
+func (w *writer) u16(v uint16) *writer {
+    w.buf = binary.BigEndian.AppendUint16(w.buf, v)
+    return w
+}
+
+func (w *writer) u32(v uint32) *writer {
+    w.buf = binary.BigEndian.AppendUint32(w.buf, v)
+    return w
+}
+
+func (w *writer) u64(v uint64) *writer {
+    w.buf = binary.BigEndian.AppendUint64(w.buf, v)
+    return w
+}
+
+func (w *writer) name(s string) *writer {
+    w.buf = append(append(w.buf, uint8(len(s))), s...)
+    return w
+}
+
+func (w *writer) bytes(b []byte) *writer {
+    w.buf = append(w.buf, b...)
+    return w
+}
+
+func readPacket(r io.Reader) (cmd uint32, data []byte, err error) {
+    var hdr [8]byte
+    if _, err = io.ReadFull(r, hdr[:]); err != nil {
+        return
+    }
+    cmd = binary.BigEndian.Uint32(hdr[:4])
+    size := binary.BigEndian.Uint32(hdr[4:])
+    if size > MAX_PACKET_SIZE {
+        return cmd, nil, errors.New("packet too big")
+    }
+    data = make([]byte, size)
+    _, err = io.ReadFull(r, data)
+    return
+}
+
+func writePacket(w io.Writer, cmd uint32, data []byte) error {
+    buf := new(writer).u32(cmd).u32(uint32(len(data))).bytes(data).buf
+    _, err := w.Write(buf)
+    return err
+}
@@ -0,0 +1,22 @@
+package vfs
+
+import (
+    "net/http"
+)
+
+type httpFS struct {
+    fs FileSystem
+}
+
+// HTTP adapts a FileSystem for http.FileServer.
+func HTTP(fs FileSystem) http.FileSystem {
+    return httpFS{fs}
+}
+
+func (h httpFS) Open(name string) (http.File, error) {
+    f, err := h.fs.Open(name)
+    if err != nil {
+        return nil, err
+    }
+    return f, nil
+}
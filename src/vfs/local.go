@@ -0,0 +1,78 @@
+package vfs
+
+import (
+    "os"
+    "path"
+    "path/filepath"
+)
+
+type localFS struct {
+    dir string
+}
+
+// Local returns a FileSystem rooted at dir on the local disk. Names can
+// not escape dir through "..", but symlinks are followed by the OS.
+func Local(dir string) FileSystem {
+    return localFS{dir}
+}
+
+func (l localFS) real(name string) string {
+    return filepath.Join(l.dir, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+func (l localFS) Open(name string) (File, error) {
+    return l.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (l localFS) Create(name string) (File, error) {
+    return l.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (l localFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+    f, err := os.OpenFile(l.real(name), flag, perm)
+    if err != nil {
+        return nil, err
+    }
+    return f, nil
+}
+
+func (l localFS) Stat(name string) (os.FileInfo, error) {
+    return os.Stat(l.real(name))
+}
+
+func (l localFS) Lstat(name string) (os.FileInfo, error) {
+    return os.Lstat(l.real(name))
+}
+
+func (l localFS) Mkdir(name string, perm os.FileMode) error {
+    return os.Mkdir(l.real(name), perm)
+}
+
+func (l localFS) MkdirAll(name string, perm os.FileMode) error {
+    return os.MkdirAll(l.real(name), perm)
+}
+
+func (l localFS) Remove(name string) error {
+    return os.Remove(l.real(name))
+}
+
+func (l localFS) RemoveAll(name string) error {
+    return os.RemoveAll(l.real(name))
+}
+
+func (l localFS) Rename(oldname, newname string) error {
+    return os.Rename(l.real(oldname), l.real(newname))
+}
+
+// Symlink stores oldname verbatim, like os.Symlink.
+func (l localFS) Symlink(oldname, newname string) error {
+    return os.Symlink(oldname, l.real(newname))
+}
+
+func (l localFS) Readlink(name string) (string, error) {
+    return os.Readlink(l.real(name))
+}
+
+func (l localFS) Truncate(name string, size int64) error {
+    return os.Truncate(l.real(name), size)
+}
@@ -0,0 +1,571 @@
+package vfs
+
+import (
+    "io"
+    "os"
+    "path"
+    "sort"
+    "strings"
+    "sync"
+    "syscall"
+    "time"
+)
+
+// maximum number of symlinks followed while resolving a name
+const MAX_SYMLINKS = 40
+
+type memNode struct {
+    mode    os.FileMode
+    mtime   time.Time
+    data    []byte
+    target  string
+    entries map[string]*memNode
+}
+
+func newMemNode(mode os.FileMode) *memNode {
+    n := &memNode{mode: mode, mtime: time.Now()}
+    if mode.IsDir() {
+        n.entries = make(map[string]*memNode)
+    }
+    return n
+}
+
+func (n *memNode) info(name string) os.FileInfo {
+    size := int64(len(n.data))
+    if n.mode&os.ModeSymlink != 0 {
+        size = int64(len(n.target))
+    }
+    return &memInfo{name, size, n.mode, n.mtime}
+}
+
+// contains tells whether o is n or lives below n
+func (n *memNode) contains(o *memNode) bool {
+    if n == o {
+        return true
+    }
+    for _, e := range n.entries {
+        if e.mode.IsDir() && e.contains(o) {
+            return true
+        }
+    }
+    return false
+}
+
+type memInfo struct {
+    name  string
+    size  int64
+    mode  os.FileMode
+    mtime time.Time
+}
+
+func (fi *memInfo) Name() string       { return fi.name }
+func (fi *memInfo) Size() int64        { return fi.size }
+func (fi *memInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *memInfo) ModTime() time.Time { return fi.mtime }
+func (fi *memInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *memInfo) Sys() interface{}   { return nil }
+
+type memFS struct {
+    mutex sync.Mutex
+    root  *memNode
+}
+
+// NewMem returns an empty FileSystem kept in memory, mostly for tests.
+func NewMem() FileSystem {
+    return &memFS{root: newMemNode(os.ModeDir | 0755)}
+}
+
+func splitPath(name string) []string {
+    var parts []string
+    for _, p := range strings.Split(name, "/") {
+        if p != "" && p != "." {
+            parts = append(parts, p)
+        }
+    }
+    return parts
+}
+
+// walk resolves name into its parent directory, last component and node
+// (nil if it does not exist). Symlinks are followed in every component but
+// the last one, which is followed only when follow is set or name ends
+// with "/". base is empty when name resolves to the root or ends with "..".
+// Like in the MooseFS client, ".." goes to the parent of the directory a
+// symlink led to, so components are resolved one at a time.
+func (m *memFS) walk(op, name string, follow bool) (dir *memNode, base string, node *memNode, err error) {
+    if strings.HasSuffix(name, "/") {
+        follow = true
+    }
+    parts := splitPath(name)
+    stack := []*memNode{m.root}
+    hops := 0
+    for len(parts) > 0 {
+        part := parts[0]
+        parts = parts[1:]
+        if part == ".." {
+            if len(stack) > 1 {
+                stack = stack[:len(stack)-1]
+            }
+            continue
+        }
+        dir = stack[len(stack)-1]
+        if !dir.mode.IsDir() {
+            return nil, "", nil, &os.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+        }
+        n := dir.entries[part]
+        last := len(parts) == 0
+        if n != nil && n.mode&os.ModeSymlink != 0 && (follow || !last) {
+            if hops++; hops > MAX_SYMLINKS {
+                return nil, "", nil, &os.PathError{Op: op, Path: name, Err: syscall.ELOOP}
+            }
+            if path.IsAbs(n.target) {
+                stack = stack[:1]
+            }
+            parts = append(splitPath(n.target), parts...)
+            continue
+        }
+        if last {
+            return dir, part, n, nil
+        }
+        if n == nil {
+            return nil, "", nil, &os.PathError{Op: op, Path: name, Err: syscall.ENOENT}
+        }
+        stack = append(stack, n)
+    }
+    node = stack[len(stack)-1]
+    dir = node
+    if len(stack) > 1 {
+        dir = stack[len(stack)-2]
+    }
+    return dir, "", node, nil
+}
+
+func (m *memFS) Open(name string) (File, error) {
+    return m.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (m *memFS) Create(name string) (File, error) {
+    return m.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (m *memFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+    dir, base, n, err := m.walk("open", name, true)
+    if err != nil {
+        return nil, err
+    }
+    writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+    if n == nil {
+        if flag&os.O_CREATE == 0 {
+            return nil, &os.PathError{Op: "open", Path: name, Err: syscall.ENOENT}
+        }
+        n = newMemNode(perm & os.ModePerm)
+        dir.entries[base] = n
+        dir.mtime = n.mtime
+    } else if flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+        return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EEXIST}
+    } else if n.mode.IsDir() && writable {
+        return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+    } else if flag&os.O_TRUNC != 0 && writable {
+        n.data = nil
+        n.mtime = time.Now()
+    }
+    return &memFile{fs: m, node: n, name: name, flag: flag}, nil
+}
+
+func (m *memFS) Stat(name string) (os.FileInfo, error) {
+    return m.stat("stat", name, true)
+}
+
+func (m *memFS) Lstat(name string) (os.FileInfo, error) {
+    return m.stat("lstat", name, false)
+}
+
+func (m *memFS) stat(op, name string, follow bool) (os.FileInfo, error) {
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+    _, base, n, err := m.walk(op, name, follow)
+    if err != nil {
+        return nil, err
+    }
+    if n == nil {
+        return nil, &os.PathError{Op: op, Path: name, Err: syscall.ENOENT}
+    }
+    if base == "" {
+        base = path.Base(path.Clean("/" + name))
+    }
+    return n.info(base), nil
+}
+
+// create adds a new node called name, which must not exist yet
+func (m *memFS) create(op, name string, n *memNode) error {
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+    dir, base, o, err := m.walk(op, name, false)
+    if err != nil {
+        return err
+    }
+    if o != nil {
+        return &os.PathError{Op: op, Path: name, Err: syscall.EEXIST}
+    }
+    dir.entries[base] = n
+    dir.mtime = n.mtime
+    return nil
+}
+
+func (m *memFS) Mkdir(name string, perm os.FileMode) error {
+    return m.create("mkdir", name, newMemNode(os.ModeDir|perm&os.ModePerm))
+}
+
+func (m *memFS) MkdirAll(name string, perm os.FileMode) error {
+    name = path.Clean("/" + name)
+    if fi, err := m.Stat(name); err == nil {
+        if fi.IsDir() {
+            return nil
+        }
+        return &os.PathError{Op: "mkdir", Path: name, Err: syscall.ENOTDIR}
+    }
+    if err := m.MkdirAll(path.Dir(name), perm); err != nil {
+        return err
+    }
+    err := m.Mkdir(name, perm)
+    if err != nil {
+        if fi, e := m.Lstat(name); e == nil && fi.IsDir() {
+            return nil
+        }
+    }
+    return err
+}
+
+func (m *memFS) Symlink(oldname, newname string) error {
+    n := newMemNode(os.ModeSymlink | 0777)
+    n.target = oldname
+    return m.create("symlink", newname, n)
+}
+
+func (m *memFS) Readlink(name string) (string, error) {
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+    _, _, n, err := m.walk("readlink", name, false)
+    if err != nil {
+        return "", err
+    }
+    if n == nil {
+        return "", &os.PathError{Op: "readlink", Path: name, Err: syscall.ENOENT}
+    }
+    if n.mode&os.ModeSymlink == 0 {
+        return "", &os.PathError{Op: "readlink", Path: name, Err: syscall.EINVAL}
+    }
+    return n.target, nil
+}
+
+func (m *memFS) Remove(name string) error {
+    return m.remove(name, false)
+}
+
+func (m *memFS) RemoveAll(name string) error {
+    return m.remove(name, true)
+}
+
+func (m *memFS) remove(name string, all bool) error {
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+    dir, base, n, err := m.walk("remove", name, false)
+    if err != nil {
+        if all {
+            if pe, ok := err.(*os.PathError); ok && pe.Err == syscall.ENOENT {
+                return nil
+            }
+        }
+        return err
+    }
+    if n == nil {
+        if all {
+            return nil
+        }
+        return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOENT}
+    }
+    if base == "" {
+        return &os.PathError{Op: "remove", Path: name, Err: syscall.EINVAL}
+    }
+    if !all && len(n.entries) > 0 {
+        return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+    }
+    delete(dir.entries, base)
+    dir.mtime = time.Now()
+    return nil
+}
+
+func (m *memFS) Rename(oldname, newname string) error {
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+    linkErr := func(err error) error {
+        return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+    }
+    odir, obase, o, err := m.walk("rename", oldname, false)
+    if err != nil {
+        return err
+    }
+    if o == nil {
+        return linkErr(syscall.ENOENT)
+    }
+    ndir, nbase, n, err := m.walk("rename", newname, false)
+    if err != nil {
+        return err
+    }
+    if obase == "" || nbase == "" {
+        return linkErr(syscall.EINVAL)
+    }
+    if n == o {
+        return nil
+    }
+    if n != nil {
+        switch {
+        case n.mode.IsDir() && !o.mode.IsDir():
+            return linkErr(syscall.EISDIR)
+        case !n.mode.IsDir() && o.mode.IsDir():
+            return linkErr(syscall.ENOTDIR)
+        case len(n.entries) > 0:
+            return linkErr(syscall.ENOTEMPTY)
+        }
+    }
+    if o.mode.IsDir() && o.contains(ndir) {
+        return linkErr(syscall.EINVAL)
+    }
+    delete(odir.entries, obase)
+    ndir.entries[nbase] = o
+    odir.mtime = time.Now()
+    ndir.mtime = odir.mtime
+    return nil
+}
+
+func (m *memFS) Truncate(name string, size int64) error {
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+    _, _, n, err := m.walk("truncate", name, true)
+    if err != nil {
+        return err
+    }
+    if n == nil {
+        return &os.PathError{Op: "truncate", Path: name, Err: syscall.ENOENT}
+    }
+    if n.mode.IsDir() {
+        return &os.PathError{Op: "truncate", Path: name, Err: syscall.EISDIR}
+    }
+    return n.truncate(name, size)
+}
+
+func (n *memNode) truncate(name string, size int64) error {
+    if size < 0 {
+        return &os.PathError{Op: "truncate", Path: name, Err: syscall.EINVAL}
+    }
+    if size <= int64(len(n.data)) {
+        n.data = n.data[:size]
+    } else {
+        n.data = append(n.data, make([]byte, size-int64(len(n.data)))...)
+    }
+    n.mtime = time.Now()
+    return nil
+}
+
+type memFile struct {
+    fs     *memFS
+    node   *memNode
+    name   string
+    flag   int
+    offset int64
+    names  []string // remaining directory entries, nil until first listed
+    closed bool
+}
+
+func (f *memFile) check(op string, write bool) error {
+    var err error
+    switch {
+    case f.closed:
+        err = os.ErrClosed
+    case write && f.flag&(os.O_WRONLY|os.O_RDWR) == 0:
+        err = syscall.EBADF
+    case !write && f.flag&os.O_WRONLY != 0:
+        err = syscall.EBADF
+    case f.node.mode.IsDir():
+        err = syscall.EISDIR
+    default:
+        return nil
+    }
+    return &os.PathError{Op: op, Path: f.name, Err: err}
+}
+
+func (f *memFile) Read(b []byte) (int, error) {
+    f.fs.mutex.Lock()
+    defer f.fs.mutex.Unlock()
+    if err := f.check("read", false); err != nil {
+        return 0, err
+    }
+    n, err := f.readAt(b, f.offset)
+    f.offset += int64(n)
+    if err == io.EOF && n > 0 {
+        err = nil
+    }
+    return n, err
+}
+
+func (f *memFile) ReadAt(b []byte, off int64) (int, error) {
+    f.fs.mutex.Lock()
+    defer f.fs.mutex.Unlock()
+    if err := f.check("read", false); err != nil {
+        return 0, err
+    }
+    if off < 0 {
+        return 0, &os.PathError{Op: "readat", Path: f.name, Err: syscall.EINVAL}
+    }
+    return f.readAt(b, off)
+}
+
+func (f *memFile) readAt(b []byte, off int64) (int, error) {
+    if off >= int64(len(f.node.data)) {
+        if len(b) == 0 {
+            return 0, nil
+        }
+        return 0, io.EOF
+    }
+    n := copy(b, f.node.data[off:])
+    if n < len(b) {
+        return n, io.EOF
+    }
+    return n, nil
+}
+
+func (f *memFile) Write(b []byte) (int, error) {
+    f.fs.mutex.Lock()
+    defer f.fs.mutex.Unlock()
+    if err := f.check("write", true); err != nil {
+        return 0, err
+    }
+    if f.flag&os.O_APPEND != 0 {
+        f.offset = int64(len(f.node.data))
+    }
+    n := f.writeAt(b, f.offset)
+    f.offset += int64(n)
+    return n, nil
+}
+
+func (f *memFile) WriteAt(b []byte, off int64) (int, error) {
+    f.fs.mutex.Lock()
+    defer f.fs.mutex.Unlock()
+    if err := f.check("write", true); err != nil {
+        return 0, err
+    }
+    if off < 0 {
+        return 0, &os.PathError{Op: "writeat", Path: f.name, Err: syscall.EINVAL}
+    }
+    return f.writeAt(b, off), nil
+}
+
+func (f *memFile) writeAt(b []byte, off int64) int {
+    if end := off + int64(len(b)); end > int64(len(f.node.data)) {
+        f.node.truncate(f.name, end)
+    }
+    f.node.mtime = time.Now()
+    return copy(f.node.data[off:], b)
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+    f.fs.mutex.Lock()
+    defer f.fs.mutex.Unlock()
+    if f.closed {
+        return 0, &os.PathError{Op: "seek", Path: f.name, Err: os.ErrClosed}
+    }
+    switch whence {
+    case io.SeekCurrent:
+        offset += f.offset
+    case io.SeekEnd:
+        offset += int64(len(f.node.data))
+    }
+    if offset < 0 {
+        return 0, &os.PathError{Op: "seek", Path: f.name, Err: syscall.EINVAL}
+    }
+    f.offset = offset
+    return offset, nil
+}
+
+func (f *memFile) Close() error {
+    f.fs.mutex.Lock()
+    defer f.fs.mutex.Unlock()
+    if f.closed {
+        return &os.PathError{Op: "close", Path: f.name, Err: os.ErrClosed}
+    }
+    f.closed = true
+    return nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+    f.fs.mutex.Lock()
+    defer f.fs.mutex.Unlock()
+    if f.closed {
+        return nil, &os.PathError{Op: "stat", Path: f.name, Err: os.ErrClosed}
+    }
+    return f.node.info(path.Base(path.Clean("/" + f.name))), nil
+}
+
+func (f *memFile) Readdir(n int) ([]os.FileInfo, error) {
+    f.fs.mutex.Lock()
+    defer f.fs.mutex.Unlock()
+    names, err := f.readdirnames(n)
+    fis := make([]os.FileInfo, 0, len(names))
+    for _, name := range names {
+        // entries removed meanwhile are skipped, like os.File does
+        if e := f.node.entries[name]; e != nil {
+            fis = append(fis, e.info(name))
+        }
+    }
+    return fis, err
+}
+
+func (f *memFile) Readdirnames(n int) ([]string, error) {
+    f.fs.mutex.Lock()
+    defer f.fs.mutex.Unlock()
+    return f.readdirnames(n)
+}
+
+func (f *memFile) readdirnames(n int) ([]string, error) {
+    if f.closed {
+        return nil, &os.PathError{Op: "readdirent", Path: f.name, Err: os.ErrClosed}
+    }
+    if !f.node.mode.IsDir() {
+        return nil, &os.PathError{Op: "readdirent", Path: f.name, Err: syscall.ENOTDIR}
+    }
+    if f.names == nil {
+        f.names = make([]string, 0, len(f.node.entries))
+        for name := range f.node.entries {
+            f.names = append(f.names, name)
+        }
+        sort.Strings(f.names)
+    }
+    if n > 0 && len(f.names) == 0 {
+        return nil, io.EOF
+    }
+    if n <= 0 || n > len(f.names) {
+        n = len(f.names)
+    }
+    names := f.names[:n:n]
+    f.names = f.names[n:]
+    return names, nil
+}
+
+func (f *memFile) Sync() error {
+    f.fs.mutex.Lock()
+    defer f.fs.mutex.Unlock()
+    if f.closed {
+        return &os.PathError{Op: "sync", Path: f.name, Err: os.ErrClosed}
+    }
+    return nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+    f.fs.mutex.Lock()
+    defer f.fs.mutex.Unlock()
+    if err := f.check("truncate", true); err != nil {
+        return err
+    }
+    return f.node.truncate(f.name, size)
+}
@@ -0,0 +1,92 @@
+package vfs
+
+import (
+    "os"
+
+    "moosefs"
+)
+
+type mooseFS struct {
+    c *moosefs.Client
+}
+
+// MooseFS returns a FileSystem backed by a MooseFS client. The errors of
+// the client are returned as *os.PathError or *os.LinkError, like the os
+// package does.
+func MooseFS(c *moosefs.Client) FileSystem {
+    return mooseFS{c}
+}
+
+func pathError(op, name string, err error) error {
+    if err == nil {
+        return nil
+    }
+    return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+func linkError(op, oldname, newname string, err error) error {
+    if err == nil {
+        return nil
+    }
+    return &os.LinkError{Op: op, Old: oldname, New: newname, Err: err}
+}
+
+func (m mooseFS) Open(name string) (File, error) {
+    return m.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (m mooseFS) Create(name string) (File, error) {
+    return m.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (m mooseFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+    f, err := m.c.OpenFile(name, flag, perm)
+    if err != nil {
+        // never hand out a typed nil
+        return nil, pathError("open", name, err)
+    }
+    return f, nil
+}
+
+func (m mooseFS) Stat(name string) (os.FileInfo, error) {
+    fi, err := m.c.Stat(name)
+    return fi, pathError("stat", name, err)
+}
+
+func (m mooseFS) Lstat(name string) (os.FileInfo, error) {
+    fi, err := m.c.Lstat(name)
+    return fi, pathError("lstat", name, err)
+}
+
+func (m mooseFS) Mkdir(name string, perm os.FileMode) error {
+    return pathError("mkdir", name, m.c.Mkdir(name, perm))
+}
+
+func (m mooseFS) MkdirAll(name string, perm os.FileMode) error {
+    return pathError("mkdir", name, m.c.MkdirAll(name, perm))
+}
+
+func (m mooseFS) Remove(name string) error {
+    return pathError("remove", name, m.c.Remove(name))
+}
+
+func (m mooseFS) RemoveAll(name string) error {
+    return pathError("remove", name, m.c.RemoveAll(name))
+}
+
+func (m mooseFS) Rename(oldname, newname string) error {
+    return linkError("rename", oldname, newname, m.c.Rename(oldname, newname))
+}
+
+func (m mooseFS) Symlink(oldname, newname string) error {
+    return linkError("symlink", oldname, newname, m.c.Symlink(oldname, newname))
+}
+
+func (m mooseFS) Readlink(name string) (string, error) {
+    target, err := m.c.Readlink(name)
+    return target, pathError("readlink", name, err)
+}
+
+func (m mooseFS) Truncate(name string, size int64) error {
+    return pathError("truncate", name, m.c.Truncate(name, size))
+}
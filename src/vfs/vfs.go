@@ -0,0 +1,42 @@
+// Package vfs defines a small filesystem interface that can be backed by
+// MooseFS, a local directory or memory, so callers (like mfsserver) can be
+// run and tested without a live master.
+package vfs
+
+import (
+    "io"
+    "os"
+)
+
+// File is an open file or directory of a FileSystem.
+type File interface {
+    io.Reader
+    io.ReaderAt
+    io.Writer
+    io.WriterAt
+    io.Seeker
+    io.Closer
+    Stat() (os.FileInfo, error)
+    Readdir(n int) ([]os.FileInfo, error)
+    Readdirnames(n int) ([]string, error)
+    Sync() error
+    Truncate(size int64) error
+}
+
+// FileSystem is the set of operations shared by all backends.
+// Names are slash separated; errors follow the os package conventions.
+type FileSystem interface {
+    Open(name string) (File, error)
+    Create(name string) (File, error)
+    OpenFile(name string, flag int, perm os.FileMode) (File, error)
+    Stat(name string) (os.FileInfo, error)
+    Lstat(name string) (os.FileInfo, error)
+    Mkdir(name string, perm os.FileMode) error
+    MkdirAll(name string, perm os.FileMode) error
+    Remove(name string) error
+    RemoveAll(name string) error
+    Rename(oldname, newname string) error
+    Symlink(oldname, newname string) error
+    Readlink(name string) (string, error)
+    Truncate(name string, size int64) error
+}
@@ -0,0 +1,208 @@
+package vfs
+
+import (
+    "errors"
+    "io"
+    "io/ioutil"
+    "moosefs"
+    "moosefstest"
+    "os"
+    "reflect"
+    "syscall"
+    "testing"
+)
+
+func testFileSystem(t *testing.T, fs FileSystem) {
+    if err := fs.MkdirAll("/a/b/c", 0755); err != nil {
+        t.Fatal("mkdirall", err)
+    }
+    if err := fs.MkdirAll("/a/b", 0755); err != nil {
+        t.Error("mkdirall existing", err)
+    }
+    if err := fs.Mkdir("/a", 0755); !errors.Is(err, os.ErrExist) {
+        t.Error("mkdir existing", err)
+    }
+
+    f, err := fs.Create("/a/hello")
+    if err != nil {
+        t.Fatal("create", err)
+    }
+    if n, err := f.Write([]byte("hello world")); n != 11 || err != nil {
+        t.Error("write", n, err)
+    }
+    if _, err := f.WriteAt([]byte("W"), 6); err != nil {
+        t.Error("writeat", err)
+    }
+    if off, err := f.Seek(0, io.SeekStart); off != 0 || err != nil {
+        t.Error("seek", off, err)
+    }
+    if data, err := ioutil.ReadAll(f); string(data) != "hello World" || err != nil {
+        t.Error("read", string(data), err)
+    }
+    buf := make([]byte, 5)
+    if n, err := f.ReadAt(buf, 8); n != 3 || err != io.EOF || string(buf[:n]) != "rld" {
+        t.Error("readat", n, err)
+    }
+    if err := f.Truncate(5); err != nil {
+        t.Error("truncate", err)
+    }
+    if fi, err := f.Stat(); err != nil || fi.Size() != 5 || fi.Name() != "hello" {
+        t.Error("fstat", fi, err)
+    }
+    f.Close()
+
+    if _, err := fs.OpenFile("/a/hello", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644); !errors.Is(err, os.ErrExist) {
+        t.Error("excl", err)
+    }
+    if _, err := fs.Open("/a/missing"); !errors.Is(err, os.ErrNotExist) {
+        t.Error("open missing", err)
+    }
+    f, err = fs.OpenFile("/a/hello", os.O_WRONLY|os.O_APPEND, 0)
+    if err != nil {
+        t.Fatal("append", err)
+    }
+    f.Write([]byte("!"))
+    if _, err := f.Read(buf); err == nil {
+        t.Error("read on write only file")
+    }
+    f.Close()
+    if fi, err := fs.Stat("/a/hello"); err != nil || fi.Size() != 6 {
+        t.Error("stat", fi, err)
+    }
+
+    if err := fs.Symlink("hello", "/a/link"); err != nil {
+        t.Fatal("symlink", err)
+    }
+    if target, err := fs.Readlink("/a/link"); target != "hello" || err != nil {
+        t.Error("readlink", target, err)
+    }
+    if fi, err := fs.Stat("/a/link"); err != nil || fi.Size() != 6 || !fi.Mode().IsRegular() {
+        t.Error("stat link", fi, err)
+    }
+    if fi, err := fs.Lstat("/a/link"); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+        t.Error("lstat link", fi, err)
+    }
+    if err := fs.Truncate("/a/link", 2); err != nil {
+        t.Error("truncate link", err)
+    }
+    if fi, _ := fs.Stat("/a/hello"); fi == nil || fi.Size() != 2 {
+        t.Error("truncate through link", fi)
+    }
+
+    if err := fs.Rename("/a/hello", "/a/b/moved"); err != nil {
+        t.Error("rename", err)
+    }
+    if _, err := fs.Stat("/a/hello"); !errors.Is(err, os.ErrNotExist) {
+        t.Error("renamed source", err)
+    }
+    d, err := fs.Open("/a")
+    if err != nil {
+        t.Fatal("open dir", err)
+    }
+    if names, err := d.Readdirnames(1); len(names) != 1 || err != nil {
+        t.Error("readdirnames", names, err)
+    }
+    if fis, err := d.Readdir(-1); len(fis) != 1 || err != nil {
+        t.Error("readdir", fis, err)
+    }
+    if _, err := d.Readdir(1); err != io.EOF {
+        t.Error("readdir at end", err)
+    }
+    d.Close()
+    d, _ = fs.Open("/a/b")
+    names, _ := d.Readdirnames(-1)
+    d.Close()
+    if len(names) == 2 && names[0] > names[1] {
+        names[0], names[1] = names[1], names[0]
+    }
+    if !reflect.DeepEqual(names, []string{"c", "moved"}) {
+        t.Error("readdirnames", names)
+    }
+
+    if err := fs.Remove("/a/b"); err == nil {
+        t.Error("remove non empty dir")
+    }
+    if err := fs.RemoveAll("/a"); err != nil {
+        t.Error("removeall", err)
+    }
+    if _, err := fs.Lstat("/a"); !errors.Is(err, os.ErrNotExist) {
+        t.Error("removed", err)
+    }
+    if err := fs.RemoveAll("/a"); err != nil {
+        t.Error("removeall missing", err)
+    }
+}
+
+// testSymlinkParent checks that ".." after a symlink goes to the parent of
+// its target. Local leaves this out, it cleans names to stay in its dir.
+func testSymlinkParent(t *testing.T, fs FileSystem) {
+    fs.MkdirAll("/p/q/r", 0755)
+    fs.MkdirAll("/s", 0755)
+    defer fs.RemoveAll("/p")
+    defer fs.RemoveAll("/s")
+    if err := fs.Symlink("../p/q/r", "/s/link"); err != nil {
+        t.Fatal("symlink", err)
+    }
+    f, err := fs.Create("/s/link/../marker")
+    if err != nil {
+        t.Fatal("create through link/..", err)
+    }
+    f.Close()
+    if _, err := fs.Stat("/p/q/marker"); err != nil {
+        t.Error("link/.. is not the parent of the target", err)
+    }
+    if _, err := fs.Stat("/s/marker"); !errors.Is(err, os.ErrNotExist) {
+        t.Error("link/.. removed lexically", err)
+    }
+    if fi, err := fs.Stat("/s/link/../r"); err != nil || !fi.IsDir() {
+        t.Error("stat link/../r", fi, err)
+    }
+}
+
+func TestLocal(t *testing.T) {
+    testFileSystem(t, Local(t.TempDir()))
+}
+
+func TestMem(t *testing.T) {
+    testFileSystem(t, NewMem())
+    testSymlinkParent(t, NewMem())
+}
+
+func TestMooseFS(t *testing.T) {
+    m, err := moosefstest.Start(2)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer m.Close()
+    c := moosefs.NewClient(m.Addr(), "/", false)
+    defer c.Close()
+    testFileSystem(t, MooseFS(c))
+    testSymlinkParent(t, MooseFS(c))
+
+    _, err = MooseFS(c).Stat("/missing")
+    if pe, ok := err.(*os.PathError); !ok || pe.Op != "stat" || pe.Path != "/missing" {
+        t.Error("path error", err)
+    }
+}
+
+func TestMemSymlinks(t *testing.T) {
+    fs := NewMem()
+    fs.MkdirAll("/x/y", 0755)
+    fs.Symlink("../x/y", "/x/up")
+    fs.Symlink("/x", "/abs")
+    fs.Symlink("loop", "/loop")
+    f, err := fs.Create("/abs/up/file")
+    if err != nil {
+        t.Fatal(err)
+    }
+    f.Close()
+    if _, err := fs.Stat("/x/y/file"); err != nil {
+        t.Error("relative and absolute links", err)
+    }
+    if _, err := fs.Stat("/loop"); !errors.Is(err, syscall.ELOOP) {
+        t.Error("loop", err)
+    }
+    if err := fs.Rename("/x", "/x/y/z"); err == nil {
+        t.Error("rename into itself")
+    }
+}